@@ -0,0 +1,403 @@
+package torrent
+
+import (
+	"math"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// A banned peer IP.
+type PeerBan struct {
+	IP     net.IP
+	Reason string
+	// When the ban was made.
+	Created time.Time
+	// Zero if the ban doesn't expire.
+	Expires time.Time
+}
+
+func (me PeerBan) expired(now time.Time) bool {
+	return !me.Expires.IsZero() && !now.Before(me.Expires)
+}
+
+// Misbehaviour attributed to a peer IP, across all torrents. When the score reaches
+// ClientConfig.PeerBanScore, the IP is banned.
+type PeerReputation struct {
+	// Pieces that failed their hash check and that the IP contributed data to.
+	HashFailures int
+	// Connections closed because the peer broke the protocol.
+	ProtocolViolations int
+	// Requests from the peer that were rejected, because it was choked or had too many outstanding.
+	RejectedRequests int
+	// Accumulated from the events above, halving every peerReputationHalfLife. It's reset when the
+	// IP is banned or unbanned.
+	Score int
+}
+
+// How much each kind of misbehaviour adds to a peer IP's reputation score.
+const (
+	hashFailureScore       = 25
+	protocolViolationScore = 10
+	rejectedRequestScore   = 1
+)
+
+const (
+	peerReputationHalfLife = time.Hour
+	// Limits memory used by reputations. IPs with no score left, and then those that misbehaved
+	// least recently, are forgotten to make room.
+	maxPeerReputations = 10000
+	// Changes to bans and reputations are saved together after this long.
+	banSaveDelay = 5 * time.Second
+)
+
+// A peer IP's reputation, and when its score was last brought up to date.
+type peerReputation struct {
+	PeerReputation
+	updated time.Time
+}
+
+// Returns the reputation with its score decayed to now.
+func (me peerReputation) at(now time.Time) PeerReputation {
+	ret := me.PeerReputation
+	if elapsed := now.Sub(me.updated); elapsed > 0 && ret.Score != 0 {
+		ret.Score = int(math.Round(float64(ret.Score) * math.Pow(0.5, float64(elapsed)/float64(peerReputationHalfLife))))
+	}
+	return ret
+}
+
+// Tracks banned peer IPs and peer IP reputations, and persists them to
+// ClientConfig.BanStatePath. All methods require the client lock. Lookups don't modify anything, so
+// they're safe with only the read lock.
+type banManager struct {
+	bans       map[string]PeerBan
+	reputation map[string]peerReputation
+	// Set while a save is pending.
+	saveTimer *time.Timer
+	// Serializes writing the state file. Taken before the client lock.
+	saveMu sync.Mutex
+}
+
+type banFileState struct {
+	Bans       map[string]banFileBan        `bencode:"bans"`
+	Reputation map[string]banFileReputation `bencode:"reputation"`
+}
+
+type banFileBan struct {
+	Reason string `bencode:"reason"`
+	// Unix seconds.
+	Created int64 `bencode:"created"`
+	// Unix seconds, or zero if the ban doesn't expire.
+	Expires int64 `bencode:"expires,omitempty"`
+}
+
+type banFileReputation struct {
+	HashFailures       int `bencode:"hash failures"`
+	ProtocolViolations int `bencode:"protocol violations"`
+	RejectedRequests   int `bencode:"rejected requests"`
+	Score              int `bencode:"score"`
+	// Unix seconds. Scores are decayed from then.
+	Updated int64 `bencode:"updated,omitempty"`
+}
+
+func (me *banManager) init() {
+	me.bans = make(map[string]PeerBan)
+	me.reputation = make(map[string]peerReputation)
+}
+
+// Returns the IP's reputation, with its score decayed to now.
+func (me *banManager) reputationAt(key string, now time.Time) PeerReputation {
+	return me.reputation[key].at(now)
+}
+
+func (me *banManager) setReputation(key string, r PeerReputation, now time.Time) {
+	if _, ok := me.reputation[key]; !ok && len(me.reputation) >= maxPeerReputations {
+		me.pruneReputations(now)
+	}
+	me.reputation[key] = peerReputation{r, now}
+}
+
+// Forgets reputations to make room for more, starting with those that have no score left, then
+// those updated least recently.
+func (me *banManager) pruneReputations(now time.Time) {
+	for key, r := range me.reputation {
+		if r.at(now).Score == 0 {
+			delete(me.reputation, key)
+		}
+	}
+	target := maxPeerReputations * 9 / 10
+	if len(me.reputation) <= target {
+		return
+	}
+	keys := make([]string, 0, len(me.reputation))
+	for key := range me.reputation {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return me.reputation[keys[i]].updated.Before(me.reputation[keys[j]].updated)
+	})
+	for _, key := range keys[:len(keys)-target] {
+		delete(me.reputation, key)
+	}
+}
+
+// Returns the ban for the IP, if it's banned.
+func (me *banManager) lookup(ip net.IP, now time.Time) (ban PeerBan, ok bool) {
+	ban, ok = me.bans[ip.String()]
+	if ok && ban.expired(now) {
+		ok = false
+	}
+	return
+}
+
+// Returns the bans that haven't expired.
+func (me *banManager) active(now time.Time) (ret []PeerBan) {
+	for _, ban := range me.bans {
+		if !ban.expired(now) {
+			ret = append(ret, ban)
+		}
+	}
+	return
+}
+
+func (me *banManager) pruneExpired(now time.Time) {
+	for key, ban := range me.bans {
+		if ban.expired(now) {
+			delete(me.bans, key)
+		}
+	}
+}
+
+func (cl *Client) loadBans() {
+	path := cl.config.BanStatePath
+	if path == "" {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var state banFileState
+	if err == nil {
+		err = bencode.Unmarshal(b, &state)
+	}
+	if err != nil {
+		cl.logger.Printf("error loading ban state: %v", err)
+		return
+	}
+	for key, ban := range state.Bans {
+		ip := net.ParseIP(key)
+		if ip == nil {
+			continue
+		}
+		pb := PeerBan{
+			IP:      ip,
+			Reason:  ban.Reason,
+			Created: time.Unix(ban.Created, 0),
+		}
+		if ban.Expires != 0 {
+			pb.Expires = time.Unix(ban.Expires, 0)
+		}
+		cl.bans.bans[ip.String()] = pb
+	}
+	for key, r := range state.Reputation {
+		ip := net.ParseIP(key)
+		if ip == nil {
+			continue
+		}
+		cl.bans.reputation[ip.String()] = peerReputation{
+			PeerReputation: PeerReputation{
+				HashFailures:       r.HashFailures,
+				ProtocolViolations: r.ProtocolViolations,
+				RejectedRequests:   r.RejectedRequests,
+				Score:              r.Score,
+			},
+			updated: time.Unix(r.Updated, 0),
+		}
+	}
+	cl.bans.pruneExpired(time.Now())
+}
+
+// Arranges for the bans and reputations to be written to ClientConfig.BanStatePath, if it's set.
+// Changes made in the meantime are written together, so the client lock isn't held for the write.
+func (cl *Client) saveBans() {
+	if cl.config.BanStatePath == "" || cl.bans.saveTimer != nil {
+		return
+	}
+	cl.bans.saveTimer = time.AfterFunc(banSaveDelay, func() {
+		cl.writeBans(false)
+	})
+}
+
+// Writes the bans and reputations to ClientConfig.BanStatePath. Expired bans are dropped. It's
+// called without the client lock. If stop is set, pending saves are cancelled, such as when the
+// client is closed.
+func (cl *Client) writeBans(stop bool) {
+	path := cl.config.BanStatePath
+	if path == "" {
+		return
+	}
+	cl.bans.saveMu.Lock()
+	defer cl.bans.saveMu.Unlock()
+	cl.lock()
+	if stop && cl.bans.saveTimer != nil {
+		cl.bans.saveTimer.Stop()
+	}
+	cl.bans.saveTimer = nil
+	b, err := cl.marshalBans()
+	cl.unlock()
+	if err == nil {
+		tmp := path + ".tmp"
+		err = os.WriteFile(tmp, b, 0o644)
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		cl.logger.Printf("error saving ban state: %v", err)
+	}
+}
+
+func (cl *Client) marshalBans() ([]byte, error) {
+	cl.bans.pruneExpired(time.Now())
+	state := banFileState{
+		Bans:       make(map[string]banFileBan, len(cl.bans.bans)),
+		Reputation: make(map[string]banFileReputation, len(cl.bans.reputation)),
+	}
+	for key, ban := range cl.bans.bans {
+		fb := banFileBan{
+			Reason:  ban.Reason,
+			Created: ban.Created.Unix(),
+		}
+		if !ban.Expires.IsZero() {
+			fb.Expires = ban.Expires.Unix()
+		}
+		state.Bans[key] = fb
+	}
+	for key, r := range cl.bans.reputation {
+		state.Reputation[key] = banFileReputation{
+			HashFailures:       r.HashFailures,
+			ProtocolViolations: r.ProtocolViolations,
+			RejectedRequests:   r.RejectedRequests,
+			Score:              r.Score,
+			Updated:            r.updated.Unix(),
+		}
+	}
+	return bencode.Marshal(state)
+}
+
+// Bans the peer IP, closing any connections from it. If duration is zero, the ban doesn't expire.
+// Banning an IP that's already banned replaces its ban.
+func (cl *Client) BanPeerIP(ip net.IP, reason string, duration time.Duration) {
+	cl.lock()
+	defer cl.unlock()
+	cl.banPeerIP(ip, reason, duration)
+}
+
+// Removes any ban on the peer IP, and resets its reputation score. Returns whether it was banned.
+func (cl *Client) UnbanPeerIP(ip net.IP) bool {
+	cl.lock()
+	defer cl.unlock()
+	key := ip.String()
+	ban, ok := cl.bans.bans[key]
+	if ok {
+		delete(cl.bans.bans, key)
+		ok = !ban.expired(time.Now())
+	}
+	if r, have := cl.bans.reputation[key]; have {
+		r.Score = 0
+		cl.bans.reputation[key] = r
+	}
+	cl.saveBans()
+	return ok
+}
+
+// Returns the peer IPs that are banned.
+func (cl *Client) PeerBans() []PeerBan {
+	cl.rLock()
+	defer cl.rUnlock()
+	return cl.bans.active(time.Now())
+}
+
+// Returns the misbehaviour attributed to the peer IP.
+func (cl *Client) PeerReputation(ip net.IP) PeerReputation {
+	cl.rLock()
+	defer cl.rUnlock()
+	return cl.bans.reputationAt(ip.String(), time.Now())
+}
+
+func (cl *Client) banPeerIP(ip net.IP, reason string, duration time.Duration) {
+	if ip == nil {
+		return
+	}
+	cl.logger.Printf("banning ip %v: %v", ip, reason)
+	now := time.Now()
+	ban := PeerBan{
+		IP:      ip,
+		Reason:  reason,
+		Created: now,
+	}
+	if duration != 0 {
+		ban.Expires = now.Add(duration)
+	}
+	key := ip.String()
+	cl.bans.bans[key] = ban
+	if r, ok := cl.bans.reputation[key]; ok {
+		r.Score = 0
+		cl.bans.reputation[key] = r
+	}
+	cl.saveBans()
+	for _, t := range cl.torrents {
+		for c := range t.conns {
+			if c.remoteIp().Equal(ip) {
+				c.drop()
+			}
+		}
+	}
+}
+
+func (cl *Client) peerBanned(ip net.IP) bool {
+	_, ok := cl.bans.lookup(ip, time.Now())
+	return ok
+}
+
+// Adds misbehaviour to the peer IP's reputation, and bans it if the score reaches the limit.
+func (cl *Client) addPeerReputation(ip net.IP, update func(*PeerReputation)) {
+	if ip == nil || cl.peerBanned(ip) {
+		return
+	}
+	key := ip.String()
+	now := time.Now()
+	r := cl.bans.reputationAt(key, now)
+	update(&r)
+	cl.bans.setReputation(key, r, now)
+	cl.saveBans()
+	if limit := cl.config.PeerBanScore; limit > 0 && r.Score >= limit {
+		cl.banPeerIP(ip, "reputation score reached limit", cl.config.PeerBanDuration)
+	}
+}
+
+func (cl *Client) onPeerHashFailure(ip net.IP) {
+	cl.addPeerReputation(ip, func(r *PeerReputation) {
+		r.HashFailures++
+		r.Score += hashFailureScore
+	})
+}
+
+func (cl *Client) onPeerProtocolViolation(ip net.IP) {
+	cl.addPeerReputation(ip, func(r *PeerReputation) {
+		r.ProtocolViolations++
+		r.Score += protocolViolationScore
+	})
+}
+
+func (cl *Client) onPeerRequestRejected(ip net.IP) {
+	cl.addPeerReputation(ip, func(r *PeerReputation) {
+		r.RejectedRequests++
+		r.Score += rejectedRequestScore
+	})
+}
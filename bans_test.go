@@ -0,0 +1,126 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestBanPeerIP(t *testing.T) {
+	cfg := TestingConfig(t)
+	cfg.BanStatePath = filepath.Join(t.TempDir(), "bans")
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	ip := net.ParseIP("1.2.3.4")
+	cl.BanPeerIP(ip, "testing", 0)
+	cl.BanPeerIP(net.ParseIP("5.6.7.8"), "expired", -time.Second)
+	assert.True(t, cl.badPeerIPPort(ip, 1234))
+	assert.False(t, cl.badPeerIPPort(net.ParseIP("5.6.7.8"), 1234))
+	assert.EqualValues(t, []string{"1.2.3.4"}, cl.BadPeerIPs())
+	bans := cl.PeerBans()
+	require.Len(t, bans, 1)
+	assert.Equal(t, "testing", bans[0].Reason)
+	assert.True(t, bans[0].Expires.IsZero())
+	require.Empty(t, cl.Close())
+
+	// Bans survive restarts.
+	cl, err = NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	assert.True(t, cl.badPeerIPPort(ip, 1234))
+	assert.True(t, cl.UnbanPeerIP(ip))
+	assert.False(t, cl.UnbanPeerIP(ip))
+	assert.False(t, cl.badPeerIPPort(ip, 1234))
+	assert.Empty(t, cl.BadPeerIPs())
+}
+
+func TestPeerReputationBans(t *testing.T) {
+	cfg := TestingConfig(t)
+	cfg.BanStatePath = filepath.Join(t.TempDir(), "bans")
+	cfg.PeerBanScore = 3 * protocolViolationScore
+	cfg.PeerBanDuration = time.Hour
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	ip := net.ParseIP("1.2.3.4")
+	cl.lock()
+	cl.onPeerProtocolViolation(ip)
+	cl.onPeerRequestRejected(ip)
+	cl.onPeerProtocolViolation(ip)
+	cl.unlock()
+	assert.False(t, cl.badPeerIPPort(ip, 1234))
+	assert.Equal(t, PeerReputation{
+		ProtocolViolations: 2,
+		RejectedRequests:   1,
+		Score:              2*protocolViolationScore + rejectedRequestScore,
+	}, cl.PeerReputation(ip))
+	cl.lock()
+	cl.onPeerHashFailure(ip)
+	cl.unlock()
+	assert.True(t, cl.badPeerIPPort(ip, 1234))
+	bans := cl.PeerBans()
+	require.Len(t, bans, 1)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), bans[0].Expires, time.Minute)
+	assert.Equal(t, PeerReputation{
+		HashFailures:       1,
+		ProtocolViolations: 2,
+		RejectedRequests:   1,
+	}, cl.PeerReputation(ip))
+	require.Empty(t, cl.Close())
+
+	cl, err = NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	assert.Equal(t, 1, cl.PeerReputation(ip).HashFailures)
+	assert.True(t, cl.badPeerIPPort(ip, 1234))
+}
+
+func TestPeerReputationDecays(t *testing.T) {
+	now := time.Now()
+	r := peerReputation{PeerReputation{ProtocolViolations: 4, Score: 40}, now}
+	assert.Equal(t, 40, r.at(now).Score)
+	assert.Equal(t, 20, r.at(now.Add(peerReputationHalfLife)).Score)
+	assert.Equal(t, 0, r.at(now.Add(10*peerReputationHalfLife)).Score)
+	assert.Equal(t, 4, r.at(now.Add(10*peerReputationHalfLife)).ProtocolViolations)
+
+	var bans banManager
+	bans.init()
+	for i := 0; i < maxPeerReputations; i++ {
+		score := 1
+		if i == 0 {
+			score = 0
+		}
+		bans.setReputation(fmt.Sprint(i), PeerReputation{Score: score}, now.Add(time.Duration(i)))
+	}
+	bans.setReputation("new", PeerReputation{Score: 1}, now.Add(maxPeerReputations))
+	assert.Len(t, bans.reputation, maxPeerReputations*9/10+1)
+	// The IP with no score left and the least recently updated are forgotten.
+	assert.NotContains(t, bans.reputation, "0")
+	assert.NotContains(t, bans.reputation, "1")
+	assert.Contains(t, bans.reputation, fmt.Sprint(maxPeerReputations-1))
+}
+
+func TestChokedRequestGrace(t *testing.T) {
+	var cl Client
+	cl.init(TestingConfig(t))
+	cl.initLogger()
+	ip := net.ParseIP("1.2.3.4")
+	tor := cl.newTorrent(metainfo.Hash{}, nil)
+	addr := &net.TCPAddr{IP: ip, Port: 4747}
+	c := cl.newConnection(nil, false, addr, addr.Network(), "")
+	c.setTorrent(tor)
+	c.lastChokeSent = time.Now()
+	cl.lock()
+	defer cl.unlock()
+	require.NoError(t, c.onReadRequest(newRequest(0, 0, defaultChunkSize)))
+	assert.Equal(t, 0, cl.bans.reputationAt(ip.String(), time.Now()).RejectedRequests)
+	c.lastChokeSent = time.Now().Add(-chokedRequestGrace)
+	require.NoError(t, c.onReadRequest(newRequest(0, 0, defaultChunkSize)))
+	assert.Equal(t, 1, cl.bans.reputationAt(ip.String(), time.Now()).RejectedRequests)
+}
@@ -0,0 +1,72 @@
+package torrent
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/anacrolix/torrent/iplist"
+)
+
+// Replaces the IP blocklist, including for the Client's anacrolix/dht servers. Connections to
+// peers that are blocked by the new list are closed. A nil list blocks nothing.
+func (cl *Client) SetIPBlockList(list iplist.Ranger) {
+	cl.lock()
+	defer cl.unlock()
+	cl.ipBlockList = list
+	cl.eachDhtServer(func(s DhtServer) {
+		if setter, ok := s.(interface{ SetIPBlockList(iplist.Ranger) }); ok {
+			setter.SetIPBlockList(list)
+		}
+	})
+	if list == nil {
+		return
+	}
+	for _, t := range cl.torrents {
+		for c := range t.conns {
+			if ip := c.remoteIp(); ip != nil && cl.ipIsBlocked(ip) {
+				c.drop()
+			}
+		}
+	}
+}
+
+// Loads ClientConfig.IPBlocklistSources, and reloads them at the configured interval until the
+// Client is closed. The current blocklist is kept if loading fails.
+func (cl *Client) reloadIPBlocklists() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-cl.closed.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: cl.config.HTTPProxy,
+		},
+	}
+	for {
+		list, err := iplist.LoadSources(ctx, cl.config.IPBlocklistSources, httpClient)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			cl.logger.Printf("error loading ip blocklists: %v", err)
+		} else {
+			cl.logger.Printf("loaded ip blocklists with %d ranges", list.NumRanges())
+			cl.SetIPBlockList(list)
+		}
+		interval := cl.config.IPBlocklistReloadInterval
+		if interval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package torrent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPBlocklistReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(path, []byte("a:1.2.3.0-1.2.3.255\n"), 0o644))
+	cfg := TestingConfig(t)
+	cfg.IPBlocklistSources = []string{path}
+	cfg.IPBlocklistReloadInterval = 10 * time.Millisecond
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	blocked := func(ip string) func() bool {
+		return func() bool {
+			cl.rLock()
+			defer cl.rUnlock()
+			return cl.badPeerIPPort(net.ParseIP(ip), 1234)
+		}
+	}
+	require.Eventually(t, blocked("1.2.3.4"), 10*time.Second, time.Millisecond)
+	assert.False(t, blocked("5.6.7.8")())
+	require.NoError(t, os.WriteFile(path, []byte("001.002.003.000 - 001.002.003.255 , 200 , allowed\n5.6.7.0/24\n"), 0o644))
+	require.Eventually(t, blocked("5.6.7.8"), 10*time.Second, time.Millisecond)
+	assert.False(t, blocked("1.2.3.4")())
+}
@@ -25,6 +25,20 @@ type Callbacks struct {
 	SentRequest        []func(PeerRequestEvent)
 	PeerClosed         []func(*Peer)
 	NewPeer            []func(*Peer)
+	// Called when the background scrubber has re-hashed a completed piece. The Client lock is held.
+	ScrubbedPiece []func(ScrubbedPieceEvent)
+	// Called when the consensus of our external IP for an address family changes. See
+	// Client.ExternalIps. The Client lock is held.
+	ExternalIpChanged []func(ExternalIpChangedEvent)
+}
+
+type ScrubbedPieceEvent struct {
+	Torrent *Torrent
+	Piece   int
+	// Whether the piece data still matched its hash. If not, the piece was marked not complete.
+	Passed bool
+	// Any error reading the piece from storage.
+	Err error
 }
 
 type ReceivedUsefulDataEvent = PeerMessageEvent
@@ -67,13 +67,23 @@ type Client struct {
 	listeners      []Listener
 	dhtServers     []DhtServer
 	ipBlockList    iplist.Ranger
+	diskIo         diskIo
+	pieceHashes    pieceHashScheduler
+	scrubber       scrubber
+	bans           banManager
+	connCounts     connCounts
+	connLimitStats ConnLimitStats
+	externalIpMu   sync.Mutex
+	externalIp4    externalIpVotes
+	externalIp6    externalIpVotes
 
 	// Set of addresses that have our client ID. This intentionally will
 	// include ourselves if we end up trying to connect to our own address
 	// through legitimate channels.
 	dopplegangerAddrs map[string]struct{}
-	badPeerIPs        map[string]struct{}
 	torrents          map[InfoHash]*Torrent
+	// Aggregate ConnStats by peer country.
+	countryStats map[string]*ConnStats
 
 	acceptLimiter   map[ipStr]int
 	dialRateLimiter *rate.Limiter
@@ -95,11 +105,8 @@ func (cl *Client) BadPeerIPs() (ips []string) {
 }
 
 func (cl *Client) badPeerIPsLocked() (ips []string) {
-	ips = make([]string, len(cl.badPeerIPs))
-	i := 0
-	for k := range cl.badPeerIPs {
-		ips[i] = k
-		i += 1
+	for _, ban := range cl.bans.active(time.Now()) {
+		ips = append(ips, ban.IP.String())
 	}
 	return
 }
@@ -138,10 +145,14 @@ func (cl *Client) WriteStatus(_w io.Writer) {
 	fmt.Fprintf(w, "Extension bits: %v\n", cl.config.Extensions)
 	fmt.Fprintf(w, "Announce key: %x\n", cl.announceKey())
 	fmt.Fprintf(w, "Banned IPs: %d\n", len(cl.badPeerIPsLocked()))
+	fmt.Fprintf(w, "Established conns: %d\n", cl.connCounts.total)
+	fmt.Fprintf(w, "Conns refused by limit: %+v\n", cl.connLimitStats.Copy())
 	cl.eachDhtServer(func(s DhtServer) {
 		fmt.Fprintf(w, "%s DHT server at %s:\n", s.Addr().Network(), s.Addr().String())
 		writeDhtServerStatus(w, s)
 	})
+	cl.diskIo.writeStatus(w)
+	cl.pieceHashes.writeStatus(w)
 	spew.Fdump(w, &cl.stats)
 	torrentsSlice := cl.torrentsAsSlice()
 	fmt.Fprintf(w, "# Torrents: %d\n", len(torrentsSlice))
@@ -202,6 +213,8 @@ func (cl *Client) init(cfg *ClientConfig) {
 	cl.activeAnnounceLimiter.SlotsPerKey = 2
 	cl.event.L = cl.locker()
 	cl.ipBlockList = cfg.IPBlocklist
+	cl.bans.init()
+	cl.diskIo.init(cfg.DiskIOWorkers, cfg.DiskIOMaxPendingBytes, cl.onDiskIoBacklogCleared)
 	cl.webseedHttpClient = &http.Client{
 		Transport: &http.Transport{
 			Proxy:           cfg.HTTPProxy,
@@ -220,6 +233,14 @@ func NewClient(cfg *ClientConfig) (cl *Client, err error) {
 	cl = &client
 	go cl.acceptLimitClearer()
 	cl.initLogger()
+	cl.loadBans()
+	if len(cfg.IPBlocklistSources) != 0 {
+		go cl.reloadIPBlocklists()
+	}
+	if cfg.ScrubInterval != 0 {
+		cl.scrubber.cl = cl
+		go cl.scrubber.run()
+	}
 	defer func() {
 		if err != nil {
 			cl.Close()
@@ -384,7 +405,7 @@ func (cl *Client) listenNetworks() (ns []network) {
 func (cl *Client) NewAnacrolixDhtServer(conn net.PacketConn) (s *dht.Server, err error) {
 	cfg := dht.ServerConfig{
 		IPBlocklist:    cl.ipBlockList,
-		Conn:           conn,
+		Conn:           externalIpVotingPacketConn{conn, cl},
 		OnAnnouncePeer: cl.onDHTAnnouncePeer,
 		PublicIP: func() net.IP {
 			if connIsIpv6(conn) && cl.config.PublicIp6 != nil {
@@ -422,6 +443,18 @@ func (cl *Client) eachDhtServer(f func(DhtServer)) {
 	}
 }
 
+// Peers stop making new requests while storage is behind, so they need prompting when it catches
+// up.
+func (cl *Client) onDiskIoBacklogCleared() {
+	cl.lock()
+	defer cl.unlock()
+	for _, t := range cl.torrents {
+		t.iterPeers(func(p *Peer) {
+			p.updateRequests("disk io backlog cleared")
+		})
+	}
+}
+
 // Stops the client. All connections to peers are closed and all activity will
 // come to a halt.
 func (cl *Client) Close() (errs []error) {
@@ -442,6 +475,7 @@ func (cl *Client) Close() (errs []error) {
 		cl.onClose[len(cl.onClose)-1-i]()
 	}
 	cl.unlock()
+	cl.writeBans(true)
 	return
 }
 
@@ -491,6 +525,9 @@ func (cl *Client) rejectAccepted(conn net.Conn) error {
 		if cl.badPeerIPPort(rip, missinggo.AddrPort(ra)) {
 			return errors.New("bad source addr")
 		}
+		if err := cl.checkIPConnLimits(rip); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -717,9 +754,9 @@ func (cl *Client) establishOutgoingConnEx(t *Torrent, addr PeerRemoteAddr, obfus
 	nc := dr.Conn
 	if nc == nil {
 		if dialCtx.Err() != nil {
-			return nil, fmt.Errorf("dialing: %w", dialCtx.Err())
+			return nil, dialFailureError{dialFailureConnect, fmt.Errorf("dialing: %w", dialCtx.Err())}
 		}
-		return nil, errors.New("dial failed")
+		return nil, dialFailureError{dialFailureConnect, errors.New("dial failed")}
 	}
 	c, err := cl.initiateProtocolHandshakes(context.Background(), nc, t, true, obfuscatedHeader, addr, dr.Dialer.DialerNetwork(), regularNetConnPeerConnConnString(nc))
 	if err != nil {
@@ -732,7 +769,11 @@ func (cl *Client) establishOutgoingConnEx(t *Torrent, addr PeerRemoteAddr, obfus
 // for valid reasons.
 func (cl *Client) establishOutgoingConn(t *Torrent, addr PeerRemoteAddr) (c *PeerConn, err error) {
 	torrent.Add("establish outgoing connection", 1)
-	obfuscatedHeaderFirst := cl.config.HeaderObfuscationPolicy.Preferred
+	obfuscatedHeaderFirst := func() bool {
+		cl.rLock()
+		defer cl.rUnlock()
+		return t.dialHeaderObfuscationFirst(addr.String())
+	}()
 	c, err = cl.establishOutgoingConnEx(t, addr, obfuscatedHeaderFirst)
 	if err == nil {
 		torrent.Add("initiated conn with preferred header obfuscation", 1)
@@ -744,6 +785,10 @@ func (cl *Client) establishOutgoingConn(t *Torrent, addr PeerRemoteAddr) (c *Pee
 		// there's nothing else to try.
 		return
 	}
+	if dialFailureKindOf(err) == dialFailureConnect {
+		// The peer isn't reachable, so a different header obfuscation won't help.
+		return
+	}
 	// Try again with encryption if we didn't earlier, or without if we did.
 	c, err = cl.establishOutgoingConnEx(t, addr, !obfuscatedHeaderFirst)
 	if err == nil {
@@ -765,6 +810,7 @@ func (cl *Client) outgoingConnection(t *Torrent, addr PeerRemoteAddr, ps PeerSou
 	defer cl.unlock()
 	// Don't release lock between here and addPeerConn, unless it's for
 	// failure.
+	t.recordDialResult(addr.String(), c, err)
 	cl.noLongerHalfOpen(t, addr.String())
 	if err != nil {
 		if cl.config.Debug {
@@ -798,15 +844,15 @@ func (cl *Client) initiateHandshakes(c *PeerConn, t *Torrent) error {
 		)
 		c.setRW(rw)
 		if err != nil {
-			return fmt.Errorf("header obfuscation handshake: %w", err)
+			return dialFailureError{dialFailureObfuscation, fmt.Errorf("header obfuscation handshake: %w", err)}
 		}
 	}
 	ih, err := cl.connBtHandshake(c, &t.infoHash)
 	if err != nil {
-		return fmt.Errorf("bittorrent protocol handshake: %w", err)
+		return dialFailureError{dialFailureHandshake, fmt.Errorf("bittorrent protocol handshake: %w", err)}
 	}
 	if ih != t.infoHash {
-		return errors.New("bittorrent protocol handshake: peer infohash didn't match")
+		return dialFailureError{dialFailureInfohash, errors.New("bittorrent protocol handshake: peer infohash didn't match")}
 	}
 	return nil
 }
@@ -895,6 +941,7 @@ func (cl *Client) connBtHandshake(c *PeerConn, ih *metainfo.Hash) (ret metainfo.
 	ret = res.Hash
 	c.PeerExtensionBytes = res.PeerExtensionBits
 	c.PeerID = res.PeerID
+	c.PeerIDClient, _ = c.PeerID.Client()
 	c.completedHandshake = time.Now()
 	if cb := cl.config.Callbacks.CompletedHandshake; cb != nil {
 		cb(c, res.Hash)
@@ -957,8 +1004,12 @@ func (cl *Client) runHandshookConn(c *PeerConn, t *Torrent) error {
 		t.logger.WithLevel(log.Debug).Printf("local and remote peer ids are the same")
 		return nil
 	}
+	if cl.rejectPeerClient(c) {
+		return fmt.Errorf("%w: %v", errPeerClientRejected, c.PeerIDClient)
+	}
 	c.r = deadlineReader{c.conn, c.r}
 	completedHandshakeConnectionFlags.Add(c.connectionFlags(), 1)
+	peerClientConns.Add(c.PeerIDClient.typeName(), 1)
 	if connIsIpv6(c.conn) {
 		torrent.Add("completed handshake over ipv6", 1)
 	}
@@ -1019,6 +1070,7 @@ func (cl *Client) sendInitialMessages(conn *PeerConn, torrent *Torrent) {
 				msg := pp.ExtendedHandshakeMessage{
 					M: map[pp.ExtensionName]pp.ExtensionNumber{
 						pp.ExtensionNameMetadata: metadataExtendedId,
+						pp.ExtensionNameDontHave: dontHaveExtendedId,
 					},
 					V:            cl.config.ExtendedHandshakeClientVersion,
 					Reqq:         localClientReqq,
@@ -1135,7 +1187,10 @@ func (cl *Client) badPeerIPPort(ip net.IP, port int) bool {
 	if _, ok := cl.ipBlockRange(ip); ok {
 		return true
 	}
-	if _, ok := cl.badPeerIPs[ip.String()]; ok {
+	if cl.peerBanned(ip) {
+		return true
+	}
+	if !cl.countryPolicyAllows(cl.config.CountryPolicy, ip) {
 		return true
 	}
 	return false
@@ -1181,6 +1236,7 @@ func (cl *Client) newTorrentOpt(opts AddTorrentOpts) (t *Torrent) {
 		webSeeds:     make(map[string]*Peer),
 		gotMetainfoC: make(chan struct{}),
 	}
+	t.peers.getDialFailures = t.peerDialFailures
 	t.networkingEnabled.Set()
 	t.logger = cl.logger.WithContextValue(t)
 	if opts.ChunkSize == 0 {
@@ -1385,6 +1441,7 @@ func (cl *Client) dropTorrent(infoHash metainfo.Hash, wg *sync.WaitGroup) (err e
 		panic(err)
 	}
 	delete(cl.torrents, infoHash)
+	cl.scrubber.forget(infoHash)
 	return
 }
 
@@ -1478,12 +1535,12 @@ func (cl *Client) AddDhtNodes(nodes []string) {
 	}
 }
 
-func (cl *Client) banPeerIP(ip net.IP) {
-	cl.logger.Printf("banning ip %v", ip)
-	if cl.badPeerIPs == nil {
-		cl.badPeerIPs = make(map[string]struct{})
-	}
-	cl.badPeerIPs[ip.String()] = struct{}{}
+var errPeerClientRejected = errors.New("peer client rejected")
+
+// Applies ClientConfig.RejectPeerClient to the connection.
+func (cl *Client) rejectPeerClient(c *PeerConn) bool {
+	f := cl.config.RejectPeerClient
+	return f != nil && f(c.PeerIDClient, c.PeerClientName)
 }
 
 func (cl *Client) newConnection(nc net.Conn, outgoing bool, remoteAddr PeerRemoteAddr, network, connString string) (c *PeerConn) {
@@ -1506,6 +1563,9 @@ func (cl *Client) newConnection(nc net.Conn, outgoing bool, remoteAddr PeerRemot
 	}
 	c.peerImpl = c
 	c.logger = cl.logger.WithDefaultLevel(log.Warning).WithContextValue(c)
+	if cl.config.GeoIP != nil {
+		c.PeerGeo = cl.lookupGeoIP(c.remoteIp())
+	}
 	c.setRW(connStatsReadWriter{nc, c})
 	c.r = &rateLimitedReader{
 		l: cl.config.DownloadRateLimiter,
@@ -1558,16 +1618,15 @@ func (cl *Client) findListener(f func(Listener) bool) (ret Listener) {
 }
 
 func (cl *Client) publicIp(peer net.IP) net.IP {
-	// TODO: Use BEP 10 to determine how peers are seeing us.
 	if peer.To4() != nil {
 		return firstNotNil(
-			cl.config.PublicIp4,
+			cl.externalIp4Locked(),
 			cl.findListenerIp(func(ip net.IP) bool { return ip.To4() != nil }),
 		)
 	}
 
 	return firstNotNil(
-		cl.config.PublicIp6,
+		cl.externalIp6Locked(),
 		cl.findListenerIp(func(ip net.IP) bool { return ip.To4() == nil }),
 	)
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 
 	"github.com/anacrolix/tagflag"
 
@@ -19,14 +22,28 @@ var builtinAnnounceList = [][]string{
 func main() {
 	log.SetFlags(log.Flags() | log.Lshortfile)
 	var args struct {
-		AnnounceList      []string `name:"a" help:"extra announce-list tier entry"`
-		EmptyAnnounceList bool     `name:"n" help:"exclude default announce-list entries"`
-		Comment           string   `name:"t" help:"comment"`
-		CreatedBy         string   `name:"c" help:"created by"`
+		AnnounceList      []string      `name:"a" help:"extra announce-list tier entry"`
+		EmptyAnnounceList bool          `name:"n" help:"exclude default announce-list entries"`
+		Comment           string        `name:"t" help:"comment"`
+		CreatedBy         string        `name:"c" help:"created by"`
+		PieceLength       tagflag.Bytes `help:"piece length, chosen from the total size if zero"`
+		Workers           int           `help:"pieces hashed at once, defaults to the number of CPUs"`
+		Include           []string      `help:"glob for files to include, matched against relative paths and base names"`
+		Exclude           []string      `help:"glob for files and directories to exclude"`
+		Symlinks          string        `help:"follow, skip or error"`
+		SkipHidden        bool          `help:"exclude names starting with '.'"`
+		Private           bool          `help:"set the private flag"`
+		Source            string        `help:"source field"`
+		Resume            string        `help:"file to save hashing progress to, and resume from"`
+		Quiet             bool          `name:"q" help:"don't report progress on stderr"`
 		tagflag.StartPos
 		Root string
 	}
 	tagflag.Parse(&args, tagflag.Description("Creates a torrent metainfo for the file system rooted at ROOT, and outputs it to stdout."))
+	symlinks, err := parseSymlinkPolicy(args.Symlinks)
+	if err != nil {
+		log.Fatal(err)
+	}
 	mi := metainfo.MetaInfo{
 		AnnounceList: builtinAnnounceList,
 	}
@@ -43,10 +60,33 @@ func main() {
 	if len(args.CreatedBy) > 0 {
 		mi.CreatedBy = args.CreatedBy
 	}
-	info := metainfo.Info{
-		PieceLength: 256 * 1024,
+	builder := metainfo.Builder{
+		Root:        args.Root,
+		PieceLength: args.PieceLength.Int64(),
+		Workers:     args.Workers,
+		Include:     args.Include,
+		Exclude:     args.Exclude,
+		Symlinks:    symlinks,
+		SkipHidden:  args.SkipHidden,
+		Source:      args.Source,
+		ResumePath:  args.Resume,
+	}
+	if args.Private {
+		builder.Private = &args.Private
 	}
-	err := info.BuildFromFilePath(args.Root)
+	if !args.Quiet {
+		builder.Progress = func(p metainfo.BuildProgress) {
+			fmt.Fprintf(os.Stderr, "\rhashed %d/%d pieces (%.1f%%)",
+				p.PiecesHashed, p.TotalPieces, 100*float64(p.BytesHashed)/float64(p.TotalBytes))
+			if p.PiecesHashed == p.TotalPieces {
+				fmt.Fprintln(os.Stderr)
+			}
+		}
+	}
+	// Interrupting saves progress to the resume file, if there is one.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	info, err := builder.Build(ctx)
+	stop()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -59,3 +99,16 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+func parseSymlinkPolicy(s string) (metainfo.SymlinkPolicy, error) {
+	switch s {
+	case "", "follow":
+		return metainfo.SymlinkFollow, nil
+	case "skip":
+		return metainfo.SymlinkSkip, nil
+	case "error":
+		return metainfo.SymlinkError, nil
+	default:
+		return 0, fmt.Errorf("unknown symlink policy %q", s)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/anacrolix/torrent/version"
 	"golang.org/x/time/rate"
 
+	"github.com/anacrolix/torrent/geoip"
 	"github.com/anacrolix/torrent/iplist"
 	"github.com/anacrolix/torrent/mse"
 	"github.com/anacrolix/torrent/storage"
@@ -61,6 +62,38 @@ type ClientConfig struct {
 	DownloadRateLimiter *rate.Limiter
 	// Maximum unverified bytes across all torrents. Not used if zero.
 	MaxUnverifiedBytes int64
+	// The number of extra peers a chunk may be requested from once every wanted chunk in a torrent
+	// has been requested from someone (end-game mode). Zero disables end-game mode, so each chunk
+	// is only requested from one peer at a time.
+	MaxEndGameDuplicateRequests int
+	// The outstanding request window for each peer is sized so that it holds this much time worth
+	// of data at the peer's measured download rate, in addition to the measured round-trip time. If
+	// zero, peers are sent as many requests as they advertise they will accept.
+	RequestQueueTime time.Duration
+	// The number of goroutines performing storage IO for chunk writes, and separately for reads for
+	// peer requests and piece hashing, across all torrents.
+	DiskIOWorkers int
+	// The most chunk data that can be held in buffers waiting on storage IO. While it's exceeded,
+	// reads for peer requests are delayed and no new requests are made to peers. Not used if zero.
+	DiskIOMaxPendingBytes int64
+	// The most pieces that are hashed at once across all torrents. Not limited if zero.
+	PieceHashers int
+	// The most pieces hashed at once for torrents with storage on the same device, where the
+	// storage can identify its device. Not limited if zero.
+	PieceHashersPerDevice int
+	// Limits the rate storage is read for hashing pieces. Each limiter token represents one byte.
+	// Hashing a piece waits for its whole length first, in steps that fit the burst, unless the
+	// burst is zero. Not limited if nil.
+	PieceHashRateLimiter *rate.Limiter
+	// If non-zero, completed pieces are re-hashed in the background to find data that has been
+	// corrupted in storage. A torrent is scrubbed in full at most once per interval. Pieces that
+	// fail are marked not complete, and downloaded again.
+	ScrubInterval time.Duration
+	// The most bytes per second read by the scrubber. Not used if zero.
+	ScrubRate int64
+	// If set, scrub progress is persisted to this file, so that scrubbing resumes where it left off
+	// when the Client is restarted.
+	ScrubStatePath string
 
 	// User-provided Client peer ID. If not present, one is generated automatically.
 	PeerID string
@@ -83,6 +116,25 @@ type ClientConfig struct {
 	DisableIPv6      bool `long:"disable-ipv6"`
 	DisableIPv4      bool
 	DisableIPv4Peers bool
+	// Blocklist file paths and HTTP(S) URLs, in the formats handled by iplist.ParseRanges. They're
+	// loaded in the background and replace IPBlocklist once they've all loaded.
+	IPBlocklistSources []string
+	// How often IPBlocklistSources are reloaded. They're only loaded once if zero.
+	IPBlocklistReloadInterval time.Duration
+	// Looks up the country and autonomous system of peer IPs. See geoip.Open for MaxMind
+	// databases. CountryPolicy, Torrent.SetCountryPolicy and Client.CountryConnStats require it.
+	GeoIP geoip.Lookuper
+	// Restricts the countries of peers for all torrents.
+	CountryPolicy CountryPolicy
+	// If set, banned peer IPs and peer IP reputations are persisted to this file, so they survive
+	// restarts.
+	BanStatePath string
+	// How long peer IPs are banned for when they misbehave. Bans don't expire if zero. Defaults to a
+	// day.
+	PeerBanDuration time.Duration
+	// Peer IPs are banned when their reputation score reaches this. Bans are only made for sending
+	// data that fails hash checks if it isn't positive.
+	PeerBanScore int
 	// Perform logging and any other behaviour that will help debug.
 	Debug  bool `help:"enable debugging"`
 	Logger log.Logger
@@ -111,6 +163,19 @@ type ClientConfig struct {
 	EstablishedConnsPerTorrent int
 	HalfOpenConnsPerTorrent    int
 	TotalHalfOpenConns         int
+	// Established connections across all torrents. When reached, torrents with fewer than their
+	// fair share can replace the worst connections of torrents with more. Unlimited if zero.
+	TotalEstablishedConns int
+	// Established connections to a single peer IP, across all torrents. Unlimited if zero.
+	EstablishedConnsPerIP int
+	// Established connections to peers in an IPv4 /24 or IPv6 /64, across all torrents. Unlimited
+	// if zero.
+	EstablishedConnsPerSubnet int
+	// How long to wait before dialing an address again after it fails to connect or handshake. It
+	// doubles with each consecutive failure, up to MaxPeerDialBackoff. Peers that don't have the
+	// torrent wait MaxPeerDialBackoff. Trusted peers aren't held back.
+	PeerDialBackoff    time.Duration
+	MaxPeerDialBackoff time.Duration
 	// Maximum number of peer addresses in reserve.
 	TorrentPeersHighWater int
 	// Minumum number of peers before effort is made to obtain more peers.
@@ -125,7 +190,9 @@ type ClientConfig struct {
 	KeepAliveTimeout time.Duration
 
 	// The IP addresses as our peers should see them. May differ from the
-	// local interfaces due to NAT or other network configurations.
+	// local interfaces due to NAT or other network configurations. If not
+	// set, what peers, trackers and the DHT report is used instead. See
+	// Client.ExternalIps.
 	PublicIp4 net.IP
 	PublicIp6 net.IP
 
@@ -151,6 +218,10 @@ type ClientConfig struct {
 	Extensions PeerExtensionBits
 	// Bits that peers must have set to proceed past handshakes.
 	MinPeerExtensions PeerExtensionBits
+	// Drops connections to peers using unwanted clients. It's called after the handshake, with the
+	// client identified from the peer ID, and again with the extended handshake's version once that
+	// is received.
+	RejectPeerClient func(_ PeerIDClient, extendedVersion string) bool
 
 	DisableWebtorrent bool
 	DisableWebseeds   bool
@@ -176,6 +247,8 @@ func NewDefaultClientConfig() *ClientConfig {
 		UpnpID:                         version.DefaultUpnpId,
 		NominalDialTimeout:             20 * time.Second,
 		MinDialTimeout:                 3 * time.Second,
+		PeerDialBackoff:                30 * time.Second,
+		MaxPeerDialBackoff:             time.Hour,
 		EstablishedConnsPerTorrent:     50,
 		HalfOpenConnsPerTorrent:        25,
 		TotalHalfOpenConns:             100,
@@ -191,6 +264,16 @@ func NewDefaultClientConfig() *ClientConfig {
 		UploadRateLimiter:                 unlimited,
 		DownloadRateLimiter:               unlimited,
 		DisableAcceptRateLimiting:         true,
+		MaxEndGameDuplicateRequests:       2,
+		RequestQueueTime:                  3 * time.Second,
+		DiskIOWorkers:                     8,
+		DiskIOMaxPendingBytes:             64 << 20,
+		PieceHashers:                      4,
+		PeerBanScore:                      100,
+		PeerBanDuration:                   24 * time.Hour,
+		IPBlocklistReloadInterval:         24 * time.Hour,
+		PieceHashersPerDevice:             2,
+		ScrubRate:                         4 << 20,
 		DropMutuallyCompletePeers:         true,
 		HeaderObfuscationPolicy: HeaderObfuscationPolicy{
 			Preferred:        true,
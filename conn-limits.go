@@ -0,0 +1,180 @@
+package torrent
+
+import (
+	"errors"
+	"net"
+)
+
+// Counts of peer connections that were refused, or not attempted, because of connection limits.
+type ConnLimitStats struct {
+	// The torrent had its maximum established connections, and none were bad enough to replace.
+	TorrentLimit Count
+	// ClientConfig.TotalEstablishedConns was reached, and the torrent had its fair share.
+	GlobalLimit Count
+	// ClientConfig.EstablishedConnsPerIP was reached for the peer's IP.
+	IPLimit Count
+	// ClientConfig.EstablishedConnsPerSubnet was reached for the peer's subnet.
+	SubnetLimit Count
+}
+
+func (me *ConnLimitStats) Copy() (ret ConnLimitStats) {
+	ret.TorrentLimit.Add(me.TorrentLimit.Int64())
+	ret.GlobalLimit.Add(me.GlobalLimit.Int64())
+	ret.IPLimit.Add(me.IPLimit.Int64())
+	ret.SubnetLimit.Add(me.SubnetLimit.Int64())
+	return
+}
+
+var (
+	errTorrentConnLimit = errors.New("torrent connection limit reached")
+	errGlobalConnLimit  = errors.New("global connection limit reached")
+	errIPConnLimit      = errors.New("connection limit for ip reached")
+	errSubnetConnLimit  = errors.New("connection limit for subnet reached")
+)
+
+// Established connections across all of a Client's torrents.
+type connCounts struct {
+	total    int
+	bySubnet map[string]int
+	byIP     map[string]int
+}
+
+// Returns the subnet that connections are limited by: /24 for IPv4, and /64 for IPv6.
+func connLimitSubnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+func addCount(m map[string]int, key string, delta int) {
+	m[key] += delta
+	if m[key] == 0 {
+		delete(m, key)
+	}
+}
+
+func (me *connCounts) add(ip net.IP, delta int) {
+	me.total += delta
+	if ip == nil {
+		return
+	}
+	if me.byIP == nil {
+		me.byIP = make(map[string]int)
+		me.bySubnet = make(map[string]int)
+	}
+	addCount(me.byIP, ip.String(), delta)
+	addCount(me.bySubnet, connLimitSubnet(ip), delta)
+}
+
+func (cl *Client) onConnAdded(c *PeerConn) {
+	cl.connCounts.add(c.remoteIp(), 1)
+}
+
+func (cl *Client) onConnDeleted(c *PeerConn) {
+	cl.connCounts.add(c.remoteIp(), -1)
+}
+
+// Returns an error if there are already as many connections to the IP, or its subnet, as allowed.
+// The refusal is counted. Only requires the read lock.
+func (cl *Client) checkIPConnLimits(ip net.IP) error {
+	if ip == nil {
+		return nil
+	}
+	if limit := cl.config.EstablishedConnsPerIP; limit > 0 && cl.connCounts.byIP[ip.String()] >= limit {
+		cl.connLimitStats.IPLimit.Add(1)
+		return errIPConnLimit
+	}
+	if limit := cl.config.EstablishedConnsPerSubnet; limit > 0 && cl.connCounts.bySubnet[connLimitSubnet(ip)] >= limit {
+		cl.connLimitStats.SubnetLimit.Add(1)
+		return errSubnetConnLimit
+	}
+	return nil
+}
+
+// Returns how many established connections each torrent that wants them is entitled to under
+// ClientConfig.TotalEstablishedConns.
+func (cl *Client) fairConnShare() int {
+	n := 0
+	for _, t := range cl.torrents {
+		if len(t.conns) != 0 || t.wantConnsIgnoringLimits() {
+			n++
+		}
+	}
+	if n == 0 {
+		n = 1
+	}
+	return (cl.config.TotalEstablishedConns + n - 1) / n
+}
+
+func (cl *Client) globalConnLimitReached() bool {
+	total := cl.config.TotalEstablishedConns
+	return total > 0 && cl.connCounts.total >= total
+}
+
+// Returns the worst connection of the torrent other than except that is furthest over its fair
+// share of connections. Only that torrent's connections are compared, so the cost doesn't grow with
+// the Client's total connections.
+func (cl *Client) worstConnOverFairShare(except *Torrent, share int) *PeerConn {
+	var most *Torrent
+	for _, t := range cl.torrents {
+		if t == except || len(t.conns) <= share {
+			continue
+		}
+		if most == nil || len(t.conns) > len(most.conns) {
+			most = t
+		}
+	}
+	if most == nil {
+		return nil
+	}
+	return most.worstConn()
+}
+
+// Returns whether a connection for the torrent could be established without exceeding
+// ClientConfig.TotalEstablishedConns, by replacing another torrent's connection if necessary.
+func (t *Torrent) haveGlobalConnRoom() bool {
+	cl := t.cl
+	if !cl.globalConnLimitReached() {
+		return true
+	}
+	share := cl.fairConnShare()
+	if len(t.conns) >= share {
+		return false
+	}
+	for _, other := range cl.torrents {
+		if other != t && len(other.conns) > share {
+			return true
+		}
+	}
+	return false
+}
+
+// Makes room for a connection for the torrent under ClientConfig.TotalEstablishedConns, by closing
+// the worst connection of a torrent that has more than its fair share, or one of the torrent's own
+// bad connections.
+func (t *Torrent) makeGlobalConnRoom() error {
+	cl := t.cl
+	if !cl.globalConnLimitReached() {
+		return nil
+	}
+	share := cl.fairConnShare()
+	var victim *PeerConn
+	if len(t.conns) < share {
+		victim = cl.worstConnOverFairShare(t, share)
+	} else {
+		victim = t.worstBadConn()
+	}
+	if victim == nil {
+		cl.connLimitStats.GlobalLimit.Add(1)
+		return errGlobalConnLimit
+	}
+	victim.close()
+	victim.t.deletePeerConn(victim)
+	return nil
+}
+
+// Returns stats on peer connections refused because of connection limits.
+func (cl *Client) ConnLimitStats() ConnLimitStats {
+	return cl.connLimitStats.Copy()
+}
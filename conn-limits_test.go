@@ -0,0 +1,94 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func testConnLimitsConn(cl *Client, t *Torrent, ip string) *PeerConn {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 4747}
+	c := cl.newConnection(nil, false, addr, addr.Network(), "")
+	c.setTorrent(t)
+	return c
+}
+
+func TestConnLimitsPerIPAndSubnet(t *testing.T) {
+	cfg := TestingConfig(t)
+	cfg.EstablishedConnsPerIP = 1
+	cfg.EstablishedConnsPerSubnet = 2
+	var cl Client
+	cl.init(cfg)
+	cl.initLogger()
+	tor := cl.newTorrent(metainfo.Hash{}, nil)
+	require.NoError(t, tor.addPeerConn(testConnLimitsConn(&cl, tor, "1.2.3.4")))
+	assert.Equal(t, errIPConnLimit, tor.addPeerConn(testConnLimitsConn(&cl, tor, "1.2.3.4")))
+	require.NoError(t, tor.addPeerConn(testConnLimitsConn(&cl, tor, "1.2.3.5")))
+	assert.Equal(t, errSubnetConnLimit, tor.addPeerConn(testConnLimitsConn(&cl, tor, "1.2.3.6")))
+	require.NoError(t, tor.addPeerConn(testConnLimitsConn(&cl, tor, "1.2.4.6")))
+	for c := range tor.conns {
+		if c.remoteIp().Equal(net.ParseIP("1.2.3.4")) {
+			c.close()
+			tor.deletePeerConn(c)
+		}
+	}
+	require.NoError(t, tor.addPeerConn(testConnLimitsConn(&cl, tor, "1.2.3.6")))
+	assert.Equal(t, 3, cl.connCounts.total)
+	stats := cl.ConnLimitStats()
+	assert.EqualValues(t, 1, stats.IPLimit.Int64())
+	assert.EqualValues(t, 1, stats.SubnetLimit.Int64())
+}
+
+func TestGlobalConnLimitFairShare(t *testing.T) {
+	cfg := TestingConfig(t)
+	cfg.TotalEstablishedConns = 4
+	var cl Client
+	cl.init(cfg)
+	cl.initLogger()
+	t1 := cl.newTorrent(metainfo.Hash{1}, nil)
+	cl.torrents[t1.infoHash] = t1
+	for i := 0; i < 4; i++ {
+		require.NoError(t, t1.addPeerConn(testConnLimitsConn(&cl, t1, fmt.Sprintf("1.2.3.%d", i))))
+	}
+	assert.False(t, t1.haveGlobalConnRoom())
+	// A second torrent is entitled to half the connections, and takes them from the first.
+	t2 := cl.newTorrent(metainfo.Hash{2}, nil)
+	cl.torrents[t2.infoHash] = t2
+	assert.True(t, t2.haveGlobalConnRoom())
+	for i := 0; i < 2; i++ {
+		require.NoError(t, t2.addPeerConn(testConnLimitsConn(&cl, t2, fmt.Sprintf("5.6.7.%d", i))))
+	}
+	assert.Len(t, t1.conns, 2)
+	assert.Len(t, t2.conns, 2)
+	assert.False(t, t2.haveGlobalConnRoom())
+	assert.Equal(t, errGlobalConnLimit, t2.addPeerConn(testConnLimitsConn(&cl, t2, "5.6.7.8")))
+	stats := cl.ConnLimitStats()
+	assert.EqualValues(t, 1, stats.GlobalLimit.Int64())
+	assert.Equal(t, 4, cl.connCounts.total)
+}
+
+func TestWorstConnOverFairShareTakesFromMostOver(t *testing.T) {
+	var cl Client
+	cl.init(TestingConfig(t))
+	cl.initLogger()
+	addTorrent := func(b byte, conns int) *Torrent {
+		tt := cl.newTorrent(metainfo.Hash{b}, nil)
+		cl.torrents[tt.infoHash] = tt
+		for i := 0; i < conns; i++ {
+			require.NoError(t, tt.addPeerConn(testConnLimitsConn(&cl, tt, fmt.Sprintf("1.2.%d.%d", b, i))))
+		}
+		return tt
+	}
+	t1 := addTorrent(1, 3)
+	t2 := addTorrent(2, 5)
+	t3 := addTorrent(3, 1)
+	c := cl.worstConnOverFairShare(t3, 2)
+	require.NotNil(t, c)
+	assert.Equal(t, t2, c.t)
+	assert.Nil(t, cl.worstConnOverFairShare(t1, 5))
+}
@@ -24,6 +24,9 @@ type ConnStats struct {
 	BytesReadData               Count
 	BytesReadUsefulData         Count
 	BytesReadUsefulIntendedData Count
+	// Data for chunks we already had by the time they arrived, such as the losing copies of
+	// duplicate requests made in end-game mode.
+	BytesReadWastedData Count
 
 	ChunksWritten Count
 
@@ -31,6 +34,12 @@ type ConnStats struct {
 	ChunksReadUseful Count
 	ChunksReadWasted Count
 
+	// Requests sent for chunks that were already outstanding with another peer. These only occur in
+	// end-game mode.
+	DuplicateRequestsSent Count
+	// Cancels sent because a duplicate request was satisfied by another peer first.
+	EndGameCancelsSent Count
+
 	MetadataChunksRead Count
 
 	// Number of pieces data was written to, that subsequently passed verification.
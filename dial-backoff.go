@@ -0,0 +1,157 @@
+package torrent
+
+import (
+	"errors"
+	"time"
+)
+
+// Why an outgoing connection to a peer failed.
+type dialFailureKind int
+
+const (
+	// No connection could be made to the address.
+	dialFailureConnect dialFailureKind = iota
+	// The header obfuscation handshake failed.
+	dialFailureObfuscation
+	// The BitTorrent protocol handshake failed.
+	dialFailureHandshake
+	// The peer doesn't have the torrent.
+	dialFailureInfohash
+)
+
+func (me dialFailureKind) String() string {
+	switch me {
+	case dialFailureConnect:
+		return "connect"
+	case dialFailureObfuscation:
+		return "header obfuscation"
+	case dialFailureHandshake:
+		return "handshake"
+	case dialFailureInfohash:
+		return "infohash mismatch"
+	default:
+		return "unknown"
+	}
+}
+
+// An error establishing an outgoing connection, classified by what it implies about retrying the
+// address.
+type dialFailureError struct {
+	kind dialFailureKind
+	err  error
+}
+
+func (me dialFailureError) Error() string {
+	return me.err.Error()
+}
+
+func (me dialFailureError) Unwrap() error {
+	return me.err
+}
+
+func dialFailureKindOf(err error) dialFailureKind {
+	var dfe dialFailureError
+	if errors.As(err, &dfe) {
+		return dfe.kind
+	}
+	return dialFailureHandshake
+}
+
+// What's known from dialing a peer address for a torrent.
+type peerDialHistory struct {
+	// Consecutive failed dials.
+	failures    int
+	lastFailure dialFailureKind
+	// The address isn't dialed again until then, unless the peer is trusted.
+	retryAfter time.Time
+	// Whether a header obfuscation setting has worked, and which one worked last.
+	obfuscationKnown bool
+	obfuscatedHeader bool
+}
+
+func (t *Torrent) dialHistoryFor(addr string) *peerDialHistory {
+	h, ok := t.dialHistory[addr]
+	if !ok {
+		if t.dialHistory == nil {
+			t.dialHistory = make(map[string]*peerDialHistory)
+		}
+		h = new(peerDialHistory)
+		t.dialHistory[addr] = h
+	}
+	return h
+}
+
+// Returns how long to wait before dialing an address again after its nth consecutive failure.
+func (cl *Client) peerDialBackoff(failures int, kind dialFailureKind) time.Duration {
+	max := cl.config.MaxPeerDialBackoff
+	if kind == dialFailureInfohash {
+		// The peer isn't likely to get the torrent soon.
+		return max
+	}
+	d := cl.config.PeerDialBackoff
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Returns whether the address shouldn't be dialed yet because of earlier failures.
+func (t *Torrent) peerDialBackedOff(addr string) bool {
+	h, ok := t.dialHistory[addr]
+	return ok && time.Now().Before(h.retryAfter)
+}
+
+// The number of consecutive failed dials to the peer, used to order dialing.
+func (t *Torrent) peerDialFailures(p PeerInfo) int {
+	if h, ok := t.dialHistory[p.Addr.String()]; ok {
+		return h.failures
+	}
+	return 0
+}
+
+// Returns the header obfuscation to try first when dialing the address.
+func (t *Torrent) dialHeaderObfuscationFirst(addr string) bool {
+	policy := t.cl.config.HeaderObfuscationPolicy
+	if policy.RequirePreferred {
+		return policy.Preferred
+	}
+	if h, ok := t.dialHistory[addr]; ok && h.obfuscationKnown {
+		return h.obfuscatedHeader
+	}
+	return policy.Preferred
+}
+
+// Records the outcome of establishing an outgoing connection to the address. c is the connection
+// if err is nil.
+func (t *Torrent) recordDialResult(addr string, c *PeerConn, err error) {
+	h := t.dialHistoryFor(addr)
+	if err == nil {
+		h.failures = 0
+		h.retryAfter = time.Time{}
+		h.obfuscationKnown = true
+		h.obfuscatedHeader = c.headerEncrypted
+		return
+	}
+	h.failures++
+	h.lastFailure = dialFailureKindOf(err)
+	h.retryAfter = time.Now().Add(t.cl.peerDialBackoff(h.failures, h.lastFailure))
+	torrent.Add("peer dial failures: "+h.lastFailure.String(), 1)
+	t.pruneDialHistory()
+}
+
+// Forgets about addresses that have been out of backoff for a while, so the history doesn't grow
+// without bound in large swarms.
+func (t *Torrent) pruneDialHistory() {
+	if len(t.dialHistory) <= 2*t.cl.config.TorrentPeersHighWater {
+		return
+	}
+	cutoff := time.Now().Add(-t.cl.config.MaxPeerDialBackoff)
+	for addr, h := range t.dialHistory {
+		if h.retryAfter.Before(cutoff) {
+			delete(t.dialHistory, addr)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package torrent
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestPeerDialBackoff(t *testing.T) {
+	cfg := TestingConfig(t)
+	cfg.PeerDialBackoff = time.Minute
+	cfg.MaxPeerDialBackoff = 5 * time.Minute
+	var cl Client
+	cl.init(cfg)
+	cl.initLogger()
+	for _, _case := range []struct {
+		failures int
+		kind     dialFailureKind
+		backoff  time.Duration
+	}{
+		{1, dialFailureConnect, time.Minute},
+		{2, dialFailureHandshake, 2 * time.Minute},
+		{3, dialFailureConnect, 4 * time.Minute},
+		{4, dialFailureConnect, 5 * time.Minute},
+		{1, dialFailureInfohash, 5 * time.Minute},
+	} {
+		assert.Equal(t, _case.backoff, cl.peerDialBackoff(_case.failures, _case.kind), "%+v", _case)
+	}
+
+	tor := cl.newTorrent(metainfo.Hash{}, nil)
+	tor.networkingEnabled.Clear()
+	addr := ipPortAddr{net.ParseIP("1.2.3.4"), 4747}
+	tor.recordDialResult(addr.String(), nil, dialFailureError{dialFailureConnect, errors.New("dial failed")})
+	assert.True(t, tor.peerDialBackedOff(addr.String()))
+	assert.False(t, tor.addPeer(PeerInfo{Addr: addr}))
+	assert.True(t, tor.addPeer(PeerInfo{Addr: addr, Trusted: true}))
+	assert.Equal(t, 1, tor.peers.Len())
+
+	// Peers that have failed are dialed after those that haven't.
+	fresh := ipPortAddr{net.ParseIP("5.6.7.8"), 4747}
+	tor.peers.DeleteMin()
+	tor.dialHistory[addr.String()].retryAfter = time.Time{}
+	assert.True(t, tor.addPeer(PeerInfo{Addr: addr}))
+	assert.True(t, tor.addPeer(PeerInfo{Addr: fresh}))
+	assert.Equal(t, fresh.String(), tor.peers.PopMax().Addr.String())
+
+	tcpAddr := &net.TCPAddr{IP: addr.IP, Port: addr.Port}
+	c := cl.newConnection(nil, false, tcpAddr, tcpAddr.Network(), "")
+	c.headerEncrypted = !cfg.HeaderObfuscationPolicy.Preferred
+	tor.recordDialResult(addr.String(), c, nil)
+	assert.Equal(t, 0, tor.peerDialFailures(PeerInfo{Addr: addr}))
+	assert.Equal(t, c.headerEncrypted, tor.dialHeaderObfuscationFirst(addr.String()))
+}
@@ -0,0 +1,170 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+type diskIoKind int
+
+const (
+	diskIoWrite diskIoKind = iota
+	diskIoRead
+	diskIoHash
+	numDiskIoKinds
+)
+
+func (me diskIoKind) String() string {
+	switch me {
+	case diskIoWrite:
+		return "write"
+	case diskIoRead:
+		return "read"
+	case diskIoHash:
+		return "hash"
+	default:
+		return fmt.Sprintf("diskIoKind(%d)", int(me))
+	}
+}
+
+type diskIoJob struct {
+	// The size of the buffer the job holds while it's outstanding.
+	bytes int64
+	f     func()
+}
+
+// Runs storage IO for all torrents in a Client on a bounded number of goroutines. Chunk writes, reads
+// for peer requests, and piece hashes are queued separately. Reads and hashes wait for writes to
+// their piece, so writes have their own workers, and can't be stuck behind them. Read and hash
+// workers take from each queue in turn so that neither is starved. Buffers for queued writes and
+// running reads are counted against a memory limit. Reads wait while the limit is exceeded, and the
+// client stops making requests until writes catch up.
+type diskIo struct {
+	mu              sync.Mutex
+	maxWorkers      int
+	maxPendingBytes int64
+	// Called without the lock held when pending bytes drop back below the limit.
+	onBacklogCleared func()
+
+	// Running workers, for writes and for reads and hashes.
+	writeWorkers int
+	workers      int
+	queues       [numDiskIoKinds][]diskIoJob
+	running      [numDiskIoKinds]int
+	nextKind     diskIoKind
+	pendingBytes int64
+}
+
+func (me *diskIo) init(maxWorkers int, maxPendingBytes int64, onBacklogCleared func()) {
+	if maxWorkers <= 0 {
+		maxWorkers = 1
+	}
+	me.maxWorkers = maxWorkers
+	me.maxPendingBytes = maxPendingBytes
+	me.onBacklogCleared = onBacklogCleared
+}
+
+// Queues f to run on a worker. bytes is the size of the buffer the job holds.
+func (me *diskIo) submit(kind diskIoKind, bytes int64, f func()) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.queues[kind] = append(me.queues[kind], diskIoJob{bytes, f})
+	if kind == diskIoWrite {
+		// The data is already in memory.
+		me.pendingBytes += bytes
+	}
+	if kind == diskIoWrite {
+		if me.writeWorkers < me.maxWorkers {
+			me.writeWorkers++
+			go me.worker(true)
+		}
+	} else if me.workers < me.maxWorkers {
+		me.workers++
+		go me.worker(false)
+	}
+}
+
+func (me *diskIo) backlogged() bool {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.backloggedLocked()
+}
+
+func (me *diskIo) backloggedLocked() bool {
+	return me.maxPendingBytes > 0 && me.pendingBytes >= me.maxPendingBytes
+}
+
+// Returns the next job to run for a write worker, or a read and hash worker, rotating through the
+// read and hash queues. Reads aren't started while over the memory limit, unless nothing else is
+// outstanding.
+func (me *diskIo) popJob(writes bool) (kind diskIoKind, job diskIoJob, ok bool) {
+	for i := diskIoKind(0); i < numDiskIoKinds; i++ {
+		kind = (me.nextKind + i) % numDiskIoKinds
+		if (kind == diskIoWrite) != writes {
+			continue
+		}
+		q := me.queues[kind]
+		if len(q) == 0 {
+			continue
+		}
+		job = q[0]
+		if kind == diskIoRead && me.maxPendingBytes > 0 && me.pendingBytes != 0 &&
+			me.pendingBytes+job.bytes > me.maxPendingBytes {
+			continue
+		}
+		q[0] = diskIoJob{}
+		me.queues[kind] = q[1:]
+		if kind == diskIoRead {
+			me.pendingBytes += job.bytes
+		}
+		if !writes {
+			me.nextKind = (kind + 1) % numDiskIoKinds
+		}
+		return kind, job, true
+	}
+	return
+}
+
+func (me *diskIo) worker(writes bool) {
+	me.mu.Lock()
+	for {
+		kind, job, ok := me.popJob(writes)
+		if !ok {
+			break
+		}
+		me.running[kind]++
+		me.mu.Unlock()
+		job.f()
+		me.mu.Lock()
+		me.running[kind]--
+		wasBacklogged := me.backloggedLocked()
+		me.pendingBytes -= job.bytes
+		if len(me.queues[diskIoRead]) != 0 && me.workers < me.maxWorkers {
+			// Reads may have been held back for memory.
+			me.workers++
+			go me.worker(false)
+		}
+		if wasBacklogged && !me.backloggedLocked() && me.onBacklogCleared != nil {
+			me.mu.Unlock()
+			me.onBacklogCleared()
+			me.mu.Lock()
+		}
+	}
+	if writes {
+		me.writeWorkers--
+	} else {
+		me.workers--
+	}
+	me.mu.Unlock()
+}
+
+func (me *diskIo) writeStatus(w io.Writer) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	fmt.Fprintf(w, "Disk IO: %v/%v write workers, %v/%v read and hash workers, %v/%v pending bytes\n",
+		me.writeWorkers, me.maxWorkers, me.workers, me.maxWorkers, me.pendingBytes, me.maxPendingBytes)
+	for k := diskIoKind(0); k < numDiskIoKinds; k++ {
+		fmt.Fprintf(w, "  %v: %v queued, %v running\n", k, len(me.queues[k]), me.running[k])
+	}
+}
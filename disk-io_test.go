@@ -0,0 +1,60 @@
+package torrent
+
+import (
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDiskIoReadsWaitForMemory(t *testing.T) {
+	c := qt.New(t)
+	var cleared sync.WaitGroup
+	cleared.Add(1)
+	var dio diskIo
+	dio.init(2, 10, cleared.Done)
+	var mu sync.Mutex
+	var order []diskIoKind
+	record := func(k diskIoKind) {
+		mu.Lock()
+		order = append(order, k)
+		mu.Unlock()
+	}
+	unblock := make(chan struct{})
+	var done sync.WaitGroup
+	done.Add(2)
+	dio.submit(diskIoWrite, 10, func() {
+		<-unblock
+		record(diskIoWrite)
+		done.Done()
+	})
+	c.Check(dio.backlogged(), qt.IsTrue)
+	dio.submit(diskIoRead, 1, func() {
+		record(diskIoRead)
+		done.Done()
+	})
+	// The second worker can't start the read while the write's buffer is outstanding.
+	close(unblock)
+	done.Wait()
+	cleared.Wait()
+	c.Check(order, qt.DeepEquals, []diskIoKind{diskIoWrite, diskIoRead})
+	c.Check(dio.backlogged(), qt.IsFalse)
+}
+
+func TestDiskIoHashesDontBlockWrites(t *testing.T) {
+	c := qt.New(t)
+	var dio diskIo
+	dio.init(1, 0, nil)
+	written := make(chan struct{})
+	hashed := make(chan struct{})
+	// A hash that waits for a write to its piece that's queued after it.
+	dio.submit(diskIoHash, 0, func() {
+		<-written
+		close(hashed)
+	})
+	dio.submit(diskIoWrite, 1, func() {
+		close(written)
+	})
+	<-hashed
+	c.Check(dio.backlogged(), qt.IsFalse)
+}
@@ -0,0 +1,262 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/anacrolix/dht/v2/krpc"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+const (
+	// Votes older than this are ignored, so that a new consensus is reached after a network change.
+	externalIpVoteTtl = 30 * time.Minute
+	// Limits memory used by votes. The oldest vote is discarded to make room.
+	maxExternalIpVotes = 200
+	// An IP needs votes from at least this many distinct voter subnets, or voters with unknown IPs,
+	// to be the consensus.
+	minExternalIpConsensusGroups = 2
+)
+
+// Where an external IP vote came from.
+type ExternalIpSource string
+
+const (
+	ExternalIpSourcePeer    ExternalIpSource = "peer"
+	ExternalIpSourceTracker ExternalIpSource = "tracker"
+	ExternalIpSourceDht     ExternalIpSource = "dht"
+)
+
+type ExternalIpChangedEvent struct {
+	// Whether the IP is IPv6.
+	Ipv6 bool
+	// Either may be nil, if no consensus was reached.
+	Old, New net.IP
+}
+
+type externalIpVote struct {
+	ip     string
+	source ExternalIpSource
+	// Votes in the same group only count once toward a consensus.
+	group string
+	when  time.Time
+}
+
+// Collects what other hosts report as our IP for one address family, and finds the consensus. The
+// votes are guarded by Client.externalIpMu. The consensus is only changed with the client lock held
+// too, so it can be read with either.
+type externalIpVotes struct {
+	// Keyed by the voter, so each gets one vote.
+	votes     map[string]externalIpVote
+	consensus net.IP
+	// Whether a tracker or DHT node voted for the consensus, so it isn't only what peers claim.
+	consensusConfirmed bool
+}
+
+func (me *externalIpVotes) add(voter string, vote externalIpVote) {
+	if me.votes == nil {
+		me.votes = make(map[string]externalIpVote)
+	}
+	if _, ok := me.votes[voter]; !ok && len(me.votes) >= maxExternalIpVotes {
+		var oldest string
+		for v, vote := range me.votes {
+			if oldest == "" || vote.when.Before(me.votes[oldest].when) {
+				oldest = v
+			}
+		}
+		delete(me.votes, oldest)
+	}
+	me.votes[voter] = vote
+}
+
+// Returns the IP with votes from the most distinct groups, breaking ties by the most recent vote,
+// and whether any of its votes came from other than peers. Expired votes are dropped.
+func (me *externalIpVotes) tally(now time.Time) (ip net.IP, confirmed bool) {
+	groups := make(map[string]map[string]bool)
+	latest := make(map[string]time.Time)
+	confirmedBy := make(map[string]bool)
+	for v, vote := range me.votes {
+		if now.Sub(vote.when) > externalIpVoteTtl {
+			delete(me.votes, v)
+			continue
+		}
+		if groups[vote.ip] == nil {
+			groups[vote.ip] = make(map[string]bool)
+		}
+		groups[vote.ip][vote.group] = true
+		if vote.source != ExternalIpSourcePeer {
+			confirmedBy[vote.ip] = true
+		}
+		if vote.when.After(latest[vote.ip]) {
+			latest[vote.ip] = vote.when
+		}
+	}
+	var best string
+	for ip, g := range groups {
+		n, bestN := len(g), len(groups[best])
+		if best == "" || n > bestN || n == bestN && latest[ip].After(latest[best]) {
+			best = ip
+		}
+	}
+	if best == "" || len(groups[best]) < minExternalIpConsensusGroups {
+		return nil, false
+	}
+	ip = net.ParseIP(best)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ip, confirmedBy[best]
+}
+
+// Returns the group for a vote: the voter's subnet if its IP is known, so that a host can't vote
+// many times from nearby addresses, or otherwise the voter itself.
+func externalIpVoteGroup(source ExternalIpSource, voter string, voterIp net.IP) string {
+	if voterIp == nil {
+		return string(source) + " " + voter
+	}
+	if ip4 := voterIp.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return voterIp.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// Returns whether a host at the IP sees our external IP. Hosts on the local network see our local
+// address.
+func externalIpVoterUsable(ip net.IP) bool {
+	return ip == nil || !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// Records that a voter reports our IP as ip. voterIp is the voter's own IP, if known. The client
+// lock must be held.
+func (cl *Client) addExternalIpVote(source ExternalIpSource, voter string, voterIp net.IP, ip net.IP) {
+	if cl.recordExternalIpVote(source, voter, voterIp, ip) {
+		cl.updateExternalIpConsensus()
+	}
+}
+
+// Like addExternalIpVote, for when the client lock isn't held. It's only taken if the consensus
+// changes.
+func (cl *Client) addExternalIpVoteUnlocked(source ExternalIpSource, voter string, voterIp net.IP, ip net.IP) {
+	if cl.recordExternalIpVote(source, voter, voterIp, ip) {
+		cl.lock()
+		defer cl.unlock()
+		cl.updateExternalIpConsensus()
+	}
+}
+
+// Adds the vote, and returns whether the consensus has changed because of it.
+func (cl *Client) recordExternalIpVote(source ExternalIpSource, voter string, voterIp net.IP, ip net.IP) bool {
+	if ip == nil || ip.IsUnspecified() || ip.IsMulticast() || !externalIpVoterUsable(voterIp) {
+		return false
+	}
+	votes := &cl.externalIp4
+	if ip.To4() == nil {
+		votes = &cl.externalIp6
+	} else {
+		ip = ip.To4()
+	}
+	now := time.Now()
+	cl.externalIpMu.Lock()
+	defer cl.externalIpMu.Unlock()
+	votes.add(string(source)+" "+voter, externalIpVote{
+		ip:     ip.String(),
+		source: source,
+		group:  externalIpVoteGroup(source, voter, voterIp),
+		when:   now,
+	})
+	torrent.Add("external ip votes from "+string(source), 1)
+	consensus, confirmed := votes.tally(now)
+	return !consensus.Equal(votes.consensus) || confirmed != votes.consensusConfirmed
+}
+
+// Brings the consensus for each address family up to date with the votes. The client lock must be
+// held.
+func (cl *Client) updateExternalIpConsensus() {
+	var events []ExternalIpChangedEvent
+	now := time.Now()
+	cl.externalIpMu.Lock()
+	for _, votes := range []*externalIpVotes{&cl.externalIp4, &cl.externalIp6} {
+		old := votes.consensus
+		votes.consensus, votes.consensusConfirmed = votes.tally(now)
+		if !old.Equal(votes.consensus) {
+			events = append(events, ExternalIpChangedEvent{
+				Ipv6: votes == &cl.externalIp6,
+				Old:  old,
+				New:  votes.consensus,
+			})
+		}
+	}
+	cl.externalIpMu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+	for _, e := range events {
+		cl.logger.Printf("external ip changed from %v to %v", e.Old, e.New)
+	}
+	for _, t := range cl.torrents {
+		t.peers.Reprioritize()
+	}
+	for _, e := range events {
+		for _, f := range cl.config.Callbacks.ExternalIpChanged {
+			f(e)
+		}
+	}
+}
+
+// Returns our IPv4 and IPv6 addresses as other hosts see them. ClientConfig.PublicIp4 and
+// PublicIp6 take precedence over the consensus of what peers, trackers and the DHT report.
+func (cl *Client) ExternalIps() (ip4, ip6 net.IP) {
+	cl.rLock()
+	defer cl.rUnlock()
+	return cl.externalIp4Locked(), cl.externalIp6Locked()
+}
+
+func (cl *Client) externalIp4Locked() net.IP {
+	return firstNotNil(cl.config.PublicIp4, cl.externalIp4.consensus)
+}
+
+func (cl *Client) externalIp6Locked() net.IP {
+	return firstNotNil(cl.config.PublicIp6, cl.externalIp6.consensus)
+}
+
+// Returns the IPs to give trackers in announces. A consensus only peers voted for isn't used, since
+// peers could collude to have trackers give out the wrong address.
+func (cl *Client) announceIpsLocked() (ip4, ip6 net.IP) {
+	ip4, ip6 = cl.config.PublicIp4, cl.config.PublicIp6
+	if ip4 == nil && cl.externalIp4.consensusConfirmed {
+		ip4 = cl.externalIp4.consensus
+	}
+	if ip6 == nil && cl.externalIp6.consensusConfirmed {
+		ip6 = cl.externalIp6.consensus
+	}
+	return
+}
+
+// Passes through packets for a DHT server, voting with the IPs that responses report for us (BEP
+// 42).
+type externalIpVotingPacketConn struct {
+	net.PacketConn
+	cl *Client
+}
+
+func (me externalIpVotingPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = me.PacketConn.ReadFrom(b)
+	if err == nil && bytes.Contains(b[:n], []byte("2:ip")) {
+		me.vote(b[:n], addr)
+	}
+	return
+}
+
+func (me externalIpVotingPacketConn) vote(b []byte, addr net.Addr) {
+	voterIp := addrIpOrNil(addr)
+	if !externalIpVoterUsable(voterIp) {
+		return
+	}
+	var m krpc.Msg
+	if bencode.Unmarshal(b, &m) != nil || m.Y != "r" || m.IP.IP == nil {
+		return
+	}
+	me.cl.addExternalIpVoteUnlocked(ExternalIpSourceDht, voterIp.String(), voterIp, m.IP.IP)
+}
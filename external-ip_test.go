@@ -0,0 +1,126 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+func TestExternalIpVotesTally(t *testing.T) {
+	var votes externalIpVotes
+	now := time.Now()
+	vote := func(voter, ip string, source ExternalIpSource, when time.Time) {
+		votes.add(voter, externalIpVote{
+			ip:     ip,
+			source: source,
+			group:  externalIpVoteGroup(source, voter, net.ParseIP(voter)),
+			when:   when,
+		})
+	}
+	ip, _ := votes.tally(now)
+	assert.Nil(t, ip)
+	// A lone vote isn't enough.
+	vote("10.0.0.1", "1.2.3.4", ExternalIpSourcePeer, now)
+	ip, _ = votes.tally(now)
+	assert.Nil(t, ip)
+	// Nor are votes from the same subnet.
+	vote("10.0.0.2", "1.2.3.4", ExternalIpSourcePeer, now)
+	ip, _ = votes.tally(now)
+	assert.Nil(t, ip)
+	vote("10.0.1.1", "1.2.3.4", ExternalIpSourcePeer, now)
+	ip, confirmed := votes.tally(now)
+	assert.Equal(t, "1.2.3.4", ip.String())
+	assert.False(t, confirmed)
+	// Votes from voters with unknown IPs are grouped by voter.
+	vote("http://a/announce", "5.6.7.8", ExternalIpSourceTracker, now.Add(time.Second))
+	vote("http://b/announce", "5.6.7.8", ExternalIpSourceTracker, now.Add(time.Second))
+	ip, confirmed = votes.tally(now)
+	assert.Equal(t, "5.6.7.8", ip.String())
+	assert.True(t, confirmed)
+	// Voters only get one vote.
+	vote("http://b/announce", "1.2.3.4", ExternalIpSourceTracker, now.Add(2*time.Second))
+	ip, confirmed = votes.tally(now)
+	assert.Equal(t, "1.2.3.4", ip.String())
+	assert.True(t, confirmed)
+	// Old votes expire.
+	later := now.Add(externalIpVoteTtl + 3*time.Second)
+	vote("10.0.2.1", "9.9.9.9", ExternalIpSourcePeer, later)
+	ip, _ = votes.tally(later)
+	assert.Nil(t, ip)
+	assert.Len(t, votes.votes, 1)
+}
+
+func TestExternalIpConsensus(t *testing.T) {
+	cfg := TestingConfig(t)
+	var events []ExternalIpChangedEvent
+	cfg.Callbacks.ExternalIpChanged = append(cfg.Callbacks.ExternalIpChanged, func(e ExternalIpChangedEvent) {
+		events = append(events, e)
+	})
+	var cl Client
+	cl.init(cfg)
+	cl.initLogger()
+	// Local peers see our local address.
+	cl.addExternalIpVote(ExternalIpSourcePeer, "192.168.1.2", net.ParseIP("192.168.1.2"), net.ParseIP("192.168.1.3"))
+	cl.addExternalIpVote(ExternalIpSourcePeer, "192.168.2.2", net.ParseIP("192.168.2.2"), net.ParseIP("192.168.1.3"))
+	assert.Empty(t, events)
+	// Peers alone give a consensus, but it isn't announced to trackers.
+	cl.addExternalIpVote(ExternalIpSourcePeer, "1.1.1.1", net.ParseIP("1.1.1.1"), net.ParseIP("1.2.3.4"))
+	assert.Empty(t, events)
+	cl.addExternalIpVote(ExternalIpSourcePeer, "2.2.2.2", net.ParseIP("2.2.2.2"), net.ParseIP("1.2.3.4"))
+	require.Len(t, events, 1)
+	assert.Equal(t, ExternalIpChangedEvent{New: net.ParseIP("1.2.3.4").To4()}, events[0])
+	ip4, ip6 := cl.ExternalIps()
+	assert.Equal(t, "1.2.3.4", ip4.String())
+	assert.Nil(t, ip6)
+	assert.Equal(t, "1.2.3.4", cl.publicIp(net.ParseIP("5.6.7.8")).String())
+	ip4, _ = cl.announceIpsLocked()
+	assert.Nil(t, ip4)
+	cl.addExternalIpVoteUnlocked(ExternalIpSourceTracker, "http://tracker/announce", nil, net.ParseIP("1.2.3.4"))
+	require.Len(t, events, 1)
+	ip4, _ = cl.announceIpsLocked()
+	assert.Equal(t, "1.2.3.4", ip4.String())
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer sender.Close()
+	voting := externalIpVotingPacketConn{conn, &cl}
+	for _, ip := range []string{"2001:db8::1", "2001:db8::1"} {
+		b := bencode.MustMarshal(krpc.Msg{
+			T:  "aa",
+			Y:  "r",
+			R:  &krpc.Return{},
+			IP: krpc.NodeAddr{IP: net.ParseIP(ip), Port: 42069},
+		})
+		_, err = sender.WriteTo(b, conn.LocalAddr())
+		require.NoError(t, err)
+		buf := make([]byte, 1500)
+		n, _, err := voting.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, b, buf[:n])
+	}
+	// The DHT responses came from a loopback address, so they don't count.
+	require.Len(t, events, 1)
+	for _, voter := range []string{"8.8.8.8", "9.9.9.9"} {
+		voting.vote(bencode.MustMarshal(krpc.Msg{
+			T:  "aa",
+			Y:  "r",
+			R:  &krpc.Return{},
+			IP: krpc.NodeAddr{IP: net.ParseIP("2001:db8::1"), Port: 42069},
+		}), &net.UDPAddr{IP: net.ParseIP(voter), Port: 6881})
+	}
+	require.Len(t, events, 2)
+	assert.True(t, events[1].Ipv6)
+	_, ip6 = cl.ExternalIps()
+	assert.Equal(t, "2001:db8::1", ip6.String())
+	_, ip6 = cl.announceIpsLocked()
+	assert.Equal(t, "2001:db8::1", ip6.String())
+}
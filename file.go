@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"github.com/RoaringBitmap/roaring"
+	"github.com/anacrolix/log"
 	"github.com/anacrolix/missinggo/v2/bitmap"
 
 	"github.com/anacrolix/torrent/metainfo"
@@ -15,7 +16,14 @@ type File struct {
 	length      int64
 	fi          metainfo.FileInfo
 	displayPath string
+	// The path given to storage for the file with File.SetPath, if any. It may be absolute, and
+	// use OS separators.
+	storagePath string
 	prio        piecePriority
+	// Index into the torrent's files.
+	index int
+	// Whether storage has been asked to allocate space for the file.
+	allocated bool
 }
 
 func (f *File) Torrent() *Torrent {
@@ -32,11 +40,21 @@ func (f File) FileInfo() metainfo.FileInfo {
 	return f.fi
 }
 
-// The file's path components joined by '/'.
+// The file's path components joined by '/'. If the file was given a relative path with
+// File.SetPath, that is returned instead.
 func (f File) Path() string {
+	f.t.cl.rLock()
+	defer f.t.cl.rUnlock()
 	return f.path
 }
 
+// The path the file was given with File.SetPath, as it was given, or "" if it wasn't.
+func (f *File) StoragePath() string {
+	f.t.cl.rLock()
+	defer f.t.cl.rUnlock()
+	return f.storagePath
+}
+
 // The file's length in bytes.
 func (f *File) Length() int64 {
 	return f.length
@@ -92,9 +110,17 @@ func (f *File) bytesLeft() (left int64) {
 // The relative file path for a multi-file torrent, and the torrent name for a
 // single-file torrent. Dir separators are '/'.
 func (f *File) DisplayPath() string {
+	f.t.cl.rLock()
+	defer f.t.cl.rUnlock()
 	return f.displayPath
 }
 
+// Renames or relocates the file in storage, moving any data already written. See
+// Torrent.RenameFile.
+func (f *File) SetPath(path string) error {
+	return f.t.RenameFile(f.index, path)
+}
+
 // The download status of a piece that comprises part of a File.
 type FilePieceState struct {
 	Bytes int64 // Bytes within the piece that are part of this File.
@@ -146,6 +172,23 @@ func (f *File) NewReader() Reader {
 
 // Sets the minimum priority for pieces in the File.
 func (f *File) SetPriority(prio piecePriority) {
+	// Storage is told first, so that it doesn't create the file for any data written as a result of
+	// the change. It's told even if the priority is unchanged, since files start out wanted.
+	f.t.cl.rLock()
+	s := f.t.storage
+	f.t.cl.rUnlock()
+	if s != nil && s.SetFileWanted != nil {
+		f.t.storageLock.RLock()
+		var err error
+		if !f.t.closed.IsSet() {
+			err = s.SetFileWanted(f.index, prio != PiecePriorityNone)
+		}
+		f.t.storageLock.RUnlock()
+		if err != nil {
+			f.t.logger.WithDefaultLevel(log.Warning).Printf(
+				"error setting file %q wanted in storage: %v", f.DisplayPath(), err)
+		}
+	}
 	f.t.cl.lock()
 	if prio != f.prio {
 		f.prio = prio
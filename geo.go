@@ -0,0 +1,106 @@
+package torrent
+
+import (
+	"net"
+	"strings"
+
+	"github.com/anacrolix/torrent/geoip"
+)
+
+// Restricts peers by the country of their IP, as found by ClientConfig.GeoIP. Countries are ISO
+// 3166-1 alpha-2 codes, such as "NZ", and are matched case-insensitively.
+type CountryPolicy struct {
+	// If not empty, only peers in these countries are allowed.
+	Allow []string
+	// Peers in these countries aren't allowed.
+	Deny []string
+	// Don't allow peers whose country isn't known. Otherwise they're allowed, even if Allow is
+	// not empty.
+	DenyUnknown bool
+}
+
+func countryIn(country string, countries []string) bool {
+	for _, c := range countries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+func (me CountryPolicy) isZero() bool {
+	return len(me.Allow) == 0 && len(me.Deny) == 0 && !me.DenyUnknown
+}
+
+// Returns whether peers in the country are allowed. An empty country is unknown.
+func (me CountryPolicy) Allows(country string) bool {
+	if country == "" {
+		return !me.DenyUnknown
+	}
+	if len(me.Allow) != 0 && !countryIn(country, me.Allow) {
+		return false
+	}
+	return !countryIn(country, me.Deny)
+}
+
+// Looks up the IP with ClientConfig.GeoIP, if it's set.
+func (cl *Client) lookupGeoIP(ip net.IP) (ret geoip.Record) {
+	if cl.config.GeoIP == nil || ip == nil {
+		return
+	}
+	ret, _ = cl.config.GeoIP.Lookup(ip)
+	return
+}
+
+// Returns whether the policy allows the IP. The database isn't consulted for empty policies.
+func (cl *Client) countryPolicyAllows(policy CountryPolicy, ip net.IP) bool {
+	if policy.isZero() || cl.config.GeoIP == nil {
+		return true
+	}
+	return policy.Allows(cl.lookupGeoIP(ip).Country)
+}
+
+// Returns whether the policy allows a country that was looked up earlier. Policies aren't applied
+// without ClientConfig.GeoIP.
+func (cl *Client) countryAllowed(policy CountryPolicy, country string) bool {
+	return cl.config.GeoIP == nil || policy.Allows(country)
+}
+
+// Returns the aggregate stats for connections to peers in the country, creating them if needed.
+func (cl *Client) countryConnStats(country string) *ConnStats {
+	country = strings.ToUpper(country)
+	cs, ok := cl.countryStats[country]
+	if !ok {
+		if cl.countryStats == nil {
+			cl.countryStats = make(map[string]*ConnStats)
+		}
+		cs = new(ConnStats)
+		cl.countryStats[country] = cs
+	}
+	return cs
+}
+
+// Returns connection-level aggregate stats by the country of the peers, as found by
+// ClientConfig.GeoIP. Peers whose country isn't known aren't included.
+func (cl *Client) CountryConnStats() map[string]ConnStats {
+	cl.rLock()
+	defer cl.rUnlock()
+	ret := make(map[string]ConnStats, len(cl.countryStats))
+	for country, cs := range cl.countryStats {
+		ret[country] = cs.Copy()
+	}
+	return ret
+}
+
+// Sets a policy for the countries of peers that this torrent connects to, in addition to
+// ClientConfig.CountryPolicy. Connections to peers the policy doesn't allow are closed.
+func (t *Torrent) SetCountryPolicy(policy CountryPolicy) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.countryPolicy = policy
+	for c := range t.conns {
+		if !t.cl.countryAllowed(policy, c.PeerGeo.Country) {
+			c.drop()
+		}
+	}
+}
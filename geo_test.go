@@ -0,0 +1,75 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/geoip"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Maps IPs to records, for testing.
+type testGeoIP map[string]geoip.Record
+
+func (me testGeoIP) Lookup(ip net.IP) (r geoip.Record, ok bool) {
+	r, ok = me[ip.String()]
+	return
+}
+
+func TestCountryPolicyAllows(t *testing.T) {
+	for _, _case := range []struct {
+		policy  CountryPolicy
+		country string
+		allowed bool
+	}{
+		{CountryPolicy{}, "NZ", true},
+		{CountryPolicy{}, "", true},
+		{CountryPolicy{Allow: []string{"nz", "AU"}}, "NZ", true},
+		{CountryPolicy{Allow: []string{"NZ", "AU"}}, "US", false},
+		{CountryPolicy{Allow: []string{"NZ"}}, "", true},
+		{CountryPolicy{Allow: []string{"NZ"}, DenyUnknown: true}, "", false},
+		{CountryPolicy{Deny: []string{"US"}}, "US", false},
+		{CountryPolicy{Deny: []string{"US"}}, "NZ", true},
+		{CountryPolicy{Allow: []string{"NZ", "US"}, Deny: []string{"US"}}, "US", false},
+	} {
+		assert.Equal(t, _case.allowed, _case.policy.Allows(_case.country), "%+v %q", _case.policy, _case.country)
+	}
+}
+
+func TestGeoIPPeerPolicies(t *testing.T) {
+	cfg := TestingConfig(t)
+	cfg.GeoIP = testGeoIP{
+		"1.2.3.4": {Country: "NZ", ASN: 4771},
+		"5.6.7.8": {Country: "US"},
+		"9.9.9.9": {Country: "KP"},
+	}
+	cfg.CountryPolicy = CountryPolicy{Deny: []string{"KP"}}
+	var cl Client
+	cl.init(cfg)
+	cl.initLogger()
+	assert.False(t, cl.badPeerIPPort(net.ParseIP("1.2.3.4"), 1234))
+	assert.True(t, cl.badPeerIPPort(net.ParseIP("9.9.9.9"), 1234))
+
+	tor := cl.newTorrent(metainfo.Hash{}, nil)
+	tor.countryPolicy = CountryPolicy{Allow: []string{"NZ"}}
+	assert.True(t, tor.addPeer(PeerInfo{Addr: ipPortAddr{net.ParseIP("1.2.3.4"), 1234}}))
+	assert.False(t, tor.addPeer(PeerInfo{Addr: ipPortAddr{net.ParseIP("5.6.7.8"), 1234}}))
+	var peers []PeerInfo
+	tor.peers.Each(func(p PeerInfo) {
+		peers = append(peers, p)
+	})
+	require.Len(t, peers, 1)
+	assert.Equal(t, geoip.Record{Country: "NZ", ASN: 4771}, peers[0].Geo)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 4747}
+	c := cl.newConnection(nil, false, addr, addr.Network(), "")
+	assert.Equal(t, "US", c.PeerGeo.Country)
+	c.setTorrent(tor)
+	assert.EqualError(t, tor.addPeerConn(c), "peer country not allowed")
+	c.readBytes(10)
+	stats := cl.CountryConnStats()["US"]
+	assert.EqualValues(t, 10, stats.BytesRead.Int64())
+}
@@ -0,0 +1,223 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Data field types in the MaxMind DB format.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// Limits nesting, and chains of pointers, in corrupt databases.
+const maxDecodeDepth = 64
+
+var errTruncated = errors.New("unexpected end of data")
+
+// Decodes the data section format, where pointers are offsets from the start of b.
+type decoder struct {
+	b []byte
+}
+
+// Returns the control byte's type and payload size, and the offset of the payload.
+func (d decoder) control(offset uint) (typ int, size uint, next uint, err error) {
+	if offset >= uint(len(d.b)) {
+		err = errTruncated
+		return
+	}
+	ctrl := d.b[offset]
+	next = offset + 1
+	typ = int(ctrl >> 5)
+	if typ == typePointer {
+		size = uint(ctrl & 0x1f)
+		return
+	}
+	if typ == typeExtended {
+		if next >= uint(len(d.b)) {
+			err = errTruncated
+			return
+		}
+		typ = 7 + int(d.b[next])
+		next++
+	}
+	size = uint(ctrl & 0x1f)
+	if size < 29 {
+		return
+	}
+	n := size - 28
+	if next+n > uint(len(d.b)) {
+		err = errTruncated
+		return
+	}
+	extra := d.uint(d.b[next : next+n])
+	next += n
+	switch size {
+	case 29:
+		size = 29 + extra
+	case 30:
+		size = 285 + extra
+	default:
+		size = 65821 + extra
+	}
+	return
+}
+
+func (d decoder) uint(b []byte) (ret uint) {
+	for _, c := range b {
+		ret = ret<<8 | uint(c)
+	}
+	return
+}
+
+// Decodes the value at offset, returning it and the offset after it.
+func (d decoder) decode(offset uint, depth int) (value interface{}, next uint, err error) {
+	if depth > maxDecodeDepth {
+		err = errors.New("data nested too deeply")
+		return
+	}
+	typ, size, next, err := d.control(offset)
+	if err != nil {
+		return
+	}
+	if typ == typePointer {
+		var target uint
+		target, next, err = d.pointer(size, next)
+		if err != nil {
+			return
+		}
+		value, _, err = d.decode(target, depth+1)
+		return
+	}
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			k, next, err = d.decode(next, depth+1)
+			if err != nil {
+				return
+			}
+			key, ok := k.(string)
+			if !ok {
+				err = fmt.Errorf("map key has type %T", k)
+				return
+			}
+			v, next, err = d.decode(next, depth+1)
+			if err != nil {
+				return
+			}
+			m[key] = v
+		}
+		value = m
+		return
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			v, next, err = d.decode(next, depth+1)
+			if err != nil {
+				return
+			}
+			a = append(a, v)
+		}
+		value = a
+		return
+	case typeBool:
+		value = size != 0
+		return
+	case typeContainer, typeEndMarker:
+		err = fmt.Errorf("unexpected data type %v", typ)
+		return
+	}
+	if next+size > uint(len(d.b)) {
+		err = errTruncated
+		return
+	}
+	payload := d.b[next : next+size]
+	next += size
+	switch typ {
+	case typeString:
+		value = string(payload)
+	case typeBytes:
+		value = append([]byte(nil), payload...)
+	case typeDouble:
+		if size != 8 {
+			err = fmt.Errorf("double has size %v", size)
+			return
+		}
+		value = math.Float64frombits(binary.BigEndian.Uint64(payload))
+	case typeFloat:
+		if size != 4 {
+			err = fmt.Errorf("float has size %v", size)
+			return
+		}
+		value = math.Float32frombits(binary.BigEndian.Uint32(payload))
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			err = fmt.Errorf("uint has size %v", size)
+			return
+		}
+		value = uint64(d.uint(payload))
+	case typeInt32:
+		if size > 4 {
+			err = fmt.Errorf("int32 has size %v", size)
+			return
+		}
+		var v uint32
+		for _, c := range payload {
+			v = v<<8 | uint32(c)
+		}
+		value = int32(v)
+	case typeUint128:
+		if size > 16 {
+			err = fmt.Errorf("uint128 has size %v", size)
+			return
+		}
+		value = new(big.Int).SetBytes(payload)
+	default:
+		err = fmt.Errorf("unknown data type %v", typ)
+	}
+	return
+}
+
+// Decodes a pointer, where size is the low 5 bits of the control byte.
+func (d decoder) pointer(size uint, offset uint) (target uint, next uint, err error) {
+	n := (size>>3)&0x3 + 1
+	if offset+n > uint(len(d.b)) {
+		err = errTruncated
+		return
+	}
+	b := d.b[offset : offset+n]
+	next = offset + n
+	vvv := size & 0x7
+	switch n {
+	case 1:
+		target = vvv<<8 | d.uint(b)
+	case 2:
+		target = (vvv<<16 | d.uint(b)) + 2048
+	case 3:
+		target = (vvv<<24 | d.uint(b)) + 526336
+	default:
+		target = d.uint(b)
+	}
+	return
+}
@@ -0,0 +1,49 @@
+// Package geoip looks up the country and autonomous system of IP addresses in MaxMind DB format
+// databases, such as GeoLite2-Country and GeoLite2-ASN. See
+// https://maxmind.github.io/MaxMind-DB/.
+package geoip
+
+import (
+	"net"
+)
+
+// What's known about an IP. Fields are empty if the database doesn't have them.
+type Record struct {
+	// ISO 3166-1 alpha-2 country code, such as "NZ".
+	Country string
+	// Autonomous system number.
+	ASN uint32
+	// The organization that the autonomous system is registered to.
+	ASOrganization string
+}
+
+func (me Record) IsZero() bool {
+	return me == Record{}
+}
+
+type Lookuper interface {
+	// Returns what's known about the IP. ok is false if the IP isn't in the database.
+	Lookup(net.IP) (r Record, ok bool)
+}
+
+// Combines the results of several Lookupers, such as a country database and an ASN database.
+// Fields are taken from the first Lookuper that has them.
+type Lookupers []Lookuper
+
+func (me Lookupers) Lookup(ip net.IP) (ret Record, ok bool) {
+	for _, l := range me {
+		r, found := l.Lookup(ip)
+		if !found {
+			continue
+		}
+		ok = true
+		if ret.Country == "" {
+			ret.Country = r.Country
+		}
+		if ret.ASN == 0 {
+			ret.ASN = r.ASN
+			ret.ASOrganization = r.ASOrganization
+		}
+	}
+	return
+}
@@ -0,0 +1,176 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// The marker that precedes the metadata section, at the end of the database.
+var metadataStart = []byte("\xab\xcd\xefMaxMind.com")
+
+// Search tree records are followed by 16 zero bytes before the data section.
+const dataSectionSeparatorLen = 16
+
+// Reads a MaxMind DB format database. It's safe for concurrent use.
+type Reader struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	// The node for ::/96, where IPv4 addresses are found in IPv6 databases.
+	ipv4Start     uint
+	ipv4StartBits int
+	// Metadata about the database.
+	DatabaseType string
+	IPVersion    uint
+	// Unix seconds.
+	BuildEpoch uint64
+}
+
+var _ Lookuper = (*Reader)(nil)
+
+// Opens a database file. The whole file is read into memory.
+func Open(path string) (*Reader, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(b)
+}
+
+// Creates a Reader from the contents of a database.
+func FromBytes(b []byte) (*Reader, error) {
+	i := bytes.LastIndex(b, metadataStart)
+	if i == -1 {
+		return nil, errors.New("metadata not found")
+	}
+	metaDec := decoder{b[i+len(metadataStart):]}
+	metaValue, _, err := metaDec.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("decoding metadata: %w", err)
+	}
+	meta, ok := metaValue.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata isn't a map")
+	}
+	r := &Reader{buf: b}
+	r.nodeCount = uint(metaUint(meta, "node_count"))
+	r.recordSize = uint(metaUint(meta, "record_size"))
+	r.IPVersion = uint(metaUint(meta, "ip_version"))
+	r.BuildEpoch = metaUint(meta, "build_epoch")
+	r.DatabaseType, _ = meta["database_type"].(string)
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %v", r.recordSize)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+dataSectionSeparatorLen > uint(i) {
+		return nil, errors.New("search tree larger than database")
+	}
+	r.data = b[treeSize+dataSectionSeparatorLen : i]
+	if r.IPVersion == 6 {
+		for ; r.ipv4StartBits < 96 && r.ipv4Start < r.nodeCount; r.ipv4StartBits++ {
+			r.ipv4Start = r.readRecord(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+func metaUint(meta map[string]interface{}, key string) uint64 {
+	v, _ := meta[key].(uint64)
+	return v
+}
+
+// Returns the left (bit 0) or right (bit 1) record of a search tree node.
+func (r *Reader) readRecord(node uint, bit uint) uint {
+	b := r.buf[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		off := bit * 3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// Returns the data section offset for the IP, if it's in the database.
+func (r *Reader) lookupOffset(ip net.IP) (offset uint, ok bool) {
+	node := uint(0)
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+		if r.IPVersion == 6 {
+			node = r.ipv4Start
+			if r.ipv4StartBits != 96 {
+				// The tree ends before ::/96.
+				return r.recordOffset(node)
+			}
+		}
+	} else if r.IPVersion == 4 {
+		return 0, false
+	}
+	bitCount := len(ip) * 8
+	for i := 0; i < bitCount && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.readRecord(node, bit)
+	}
+	return r.recordOffset(node)
+}
+
+// Converts a search tree record pointing outside the tree to a data section offset.
+func (r *Reader) recordOffset(record uint) (uint, bool) {
+	if record <= r.nodeCount {
+		// Either an empty record, or an IP that's shorter than the tree is deep.
+		return 0, false
+	}
+	offset := record - r.nodeCount - dataSectionSeparatorLen
+	if offset >= uint(len(r.data)) {
+		return 0, false
+	}
+	return offset, true
+}
+
+// Returns the raw data for the IP, as decoded maps, slices, strings and numbers.
+func (r *Reader) LookupValue(ip net.IP) (value interface{}, ok bool, err error) {
+	offset, ok := r.lookupOffset(ip)
+	if !ok {
+		return
+	}
+	value, _, err = decoder{r.data}.decode(offset, 0)
+	return
+}
+
+func (r *Reader) Lookup(ip net.IP) (ret Record, ok bool) {
+	value, ok, err := r.LookupValue(ip)
+	if err != nil || !ok {
+		return Record{}, false
+	}
+	m, _ := value.(map[string]interface{})
+	ret.Country = nestedString(m, "country", "iso_code")
+	if ret.Country == "" {
+		ret.Country = nestedString(m, "registered_country", "iso_code")
+	}
+	if asn, ok := m["autonomous_system_number"].(uint64); ok && asn <= math.MaxUint32 {
+		ret.ASN = uint32(asn)
+	}
+	ret.ASOrganization, _ = m["autonomous_system_organization"].(string)
+	return
+}
+
+func nestedString(m map[string]interface{}, keys ...string) string {
+	for _, k := range keys[:len(keys)-1] {
+		m, _ = m[k].(map[string]interface{})
+	}
+	s, _ := m[keys[len(keys)-1]].(string)
+	return s
+}
@@ -0,0 +1,238 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sort"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func encodeControl(typ int, size int) []byte {
+	var ret []byte
+	ctrlType := typ
+	if typ > 7 {
+		ctrlType = typeExtended
+	}
+	var sizeBits int
+	var extra []byte
+	switch {
+	case size < 29:
+		sizeBits = size
+	case size < 285:
+		sizeBits = 29
+		extra = []byte{byte(size - 29)}
+	case size < 65821:
+		sizeBits = 30
+		extra = []byte{byte((size - 285) >> 8), byte(size - 285)}
+	default:
+		sizeBits = 31
+		s := size - 65821
+		extra = []byte{byte(s >> 16), byte(s >> 8), byte(s)}
+	}
+	ret = append(ret, byte(ctrlType<<5|sizeBits))
+	if typ > 7 {
+		ret = append(ret, byte(typ-7))
+	}
+	return append(ret, extra...)
+}
+
+// A pointer to a data section offset, encoded with its smallest form.
+type testPointer uint
+
+func encodeValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(encodeControl(typeString, len(v)), v...)
+	case uint64:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], v)
+		payload := bytes.TrimLeft(b[:], "\x00")
+		return append(encodeControl(typeUint32, len(payload)), payload...)
+	case testPointer:
+		if v < 2048 {
+			return []byte{byte(typePointer<<5 | int(v>>8)), byte(v)}
+		}
+		v -= 2048
+		return []byte{byte(typePointer<<5 | 1<<3 | int(v>>16)), byte(v >> 8), byte(v)}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		ret := encodeControl(typeMap, len(v))
+		for _, k := range keys {
+			ret = append(ret, encodeValue(k)...)
+			ret = append(ret, encodeValue(v[k])...)
+		}
+		return ret
+	default:
+		panic(v)
+	}
+}
+
+type testNode struct {
+	children [2]*testNode
+	// Data section offset, if the node is a leaf.
+	data int
+}
+
+type testNetwork struct {
+	cidr string
+	// Data section offset.
+	data int
+}
+
+// Builds an IPv6 database with the given networks, and data section.
+func buildTestDatabase(recordSize int, networks []testNetwork, data []byte) []byte {
+	root := &testNode{data: -1}
+	for _, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			panic(err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP.To16()
+		if ipNet.IP.To4() != nil {
+			// IPv4 networks are at ::/96.
+			ip = append(make(net.IP, 12), ipNet.IP.To4()...)
+			ones += 96
+		}
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &testNode{data: -1}
+			}
+			node = node.children[bit]
+		}
+		node.data = n.data
+	}
+	// Number the nodes in breadth-first order.
+	var nodes []*testNode
+	ids := make(map[*testNode]int)
+	for queue := []*testNode{root}; len(queue) != 0; queue = queue[1:] {
+		n := queue[0]
+		if n.data != -1 {
+			continue
+		}
+		ids[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+	nodeCount := len(nodes)
+	record := func(c *testNode) uint32 {
+		switch {
+		case c == nil:
+			return uint32(nodeCount)
+		case c.data != -1:
+			return uint32(nodeCount + dataSectionSeparatorLen + c.data)
+		default:
+			return uint32(ids[c])
+		}
+	}
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		left, right := record(n.children[0]), record(n.children[1])
+		switch recordSize {
+		case 24:
+			buf.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			buf.Write([]byte{
+				byte(left >> 16), byte(left >> 8), byte(left),
+				byte(left>>24)<<4 | byte(right>>24),
+				byte(right >> 16), byte(right >> 8), byte(right),
+			})
+		case 32:
+			binary.Write(&buf, binary.BigEndian, [2]uint32{left, right})
+		}
+	}
+	buf.Write(make([]byte, dataSectionSeparatorLen))
+	buf.Write(data)
+	buf.Write(metadataStart)
+	buf.Write(encodeValue(map[string]interface{}{
+		"node_count":    uint64(nodeCount),
+		"record_size":   uint64(recordSize),
+		"ip_version":    uint64(6),
+		"database_type": "Test",
+	}))
+	return buf.Bytes()
+}
+
+func TestReader(t *testing.T) {
+	c := qt.New(t)
+	var data []byte
+	nzOffset := len(data)
+	data = append(data, encodeValue(map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "NZ"},
+	})...)
+	asOffset := len(data)
+	data = append(data, encodeValue(map[string]interface{}{
+		"registered_country":             map[string]interface{}{"iso_code": "AU"},
+		"autonomous_system_number":       uint64(4771),
+		"autonomous_system_organization": "Spark New Zealand",
+	})...)
+	pointerOffset := len(data)
+	data = append(data, encodeValue(testPointer(nzOffset))...)
+	networks := []testNetwork{
+		{"1.2.0.0/16", nzOffset},
+		{"5.6.7.0/24", asOffset},
+		{"2001:db8::/32", pointerOffset},
+	}
+	for _, recordSize := range []int{24, 28, 32} {
+		r, err := FromBytes(buildTestDatabase(recordSize, networks, data))
+		c.Assert(err, qt.IsNil)
+		c.Check(r.DatabaseType, qt.Equals, "Test")
+		for _, _case := range []struct {
+			ip  string
+			rec Record
+			ok  bool
+		}{
+			{"1.2.3.4", Record{Country: "NZ"}, true},
+			{"::ffff:1.2.255.255", Record{Country: "NZ"}, true},
+			{"1.3.0.0", Record{}, false},
+			{"5.6.7.8", Record{Country: "AU", ASN: 4771, ASOrganization: "Spark New Zealand"}, true},
+			{"2001:db8::1", Record{Country: "NZ"}, true},
+			{"2001:db9::1", Record{}, false},
+		} {
+			rec, ok := r.Lookup(net.ParseIP(_case.ip))
+			c.Check(ok, qt.Equals, _case.ok, qt.Commentf("%v with record size %v", _case.ip, recordSize))
+			c.Check(rec, qt.Equals, _case.rec, qt.Commentf("%v with record size %v", _case.ip, recordSize))
+		}
+	}
+}
+
+func TestLookupers(t *testing.T) {
+	c := qt.New(t)
+	country, err := FromBytes(buildTestDatabase(24, []testNetwork{{"1.2.0.0/16", 0}},
+		encodeValue(map[string]interface{}{"country": map[string]interface{}{"iso_code": "NZ"}})))
+	c.Assert(err, qt.IsNil)
+	asn, err := FromBytes(buildTestDatabase(24, []testNetwork{{"1.0.0.0/8", 0}},
+		encodeValue(map[string]interface{}{"autonomous_system_number": uint64(4771)})))
+	c.Assert(err, qt.IsNil)
+	l := Lookupers{country, asn}
+	rec, ok := l.Lookup(net.ParseIP("1.2.3.4"))
+	c.Check(ok, qt.IsTrue)
+	c.Check(rec, qt.Equals, Record{Country: "NZ", ASN: 4771})
+	rec, ok = l.Lookup(net.ParseIP("1.3.3.4"))
+	c.Check(ok, qt.IsTrue)
+	c.Check(rec, qt.Equals, Record{ASN: 4771})
+	_, ok = l.Lookup(net.ParseIP("2.3.3.4"))
+	c.Check(ok, qt.IsFalse)
+}
+
+func TestReaderBadDatabase(t *testing.T) {
+	c := qt.New(t)
+	_, err := FromBytes([]byte("nonsense"))
+	c.Check(err, qt.ErrorMatches, "metadata not found")
+	b := buildTestDatabase(24, []testNetwork{{"1.2.0.0/16", 0}}, encodeValue("x"))
+	_, err = FromBytes(b[len(b)-20:])
+	c.Check(err, qt.IsNotNil)
+}
@@ -21,6 +21,7 @@ const (
 const (
 	metadataExtendedId = iota + 1 // 0 is reserved for deleting keys
 	pexExtendedId
+	dontHaveExtendedId
 )
 
 func defaultPeerExtensionBytes() PeerExtensionBits {
@@ -58,4 +59,12 @@ var (
 	pieceInclinationsPut    = expvar.NewInt("pieceInclinationsPut")
 
 	concurrentChunkWrites = expvar.NewInt("torrentConcurrentChunkWrites")
+
+	// Completed handshakes, and pieces that failed their hash check with data from each peer, by
+	// the client identified from the peer ID.
+	peerClientConns     = expvar.NewMap("peerClientConns")
+	peerClientBadPieces = expvar.NewMap("peerClientBadPieces")
+
+	piecesScrubbed       = expvar.NewInt("piecesScrubbed")
+	piecesScrubbedFailed = expvar.NewInt("piecesScrubbedFailed")
 )
@@ -44,7 +44,7 @@ require (
 	go.etcd.io/bbolt v1.3.6
 	golang.org/x/crypto v0.0.0-20210813211128-0a44fdfbc16e // indirect
 	golang.org/x/net v0.0.0-20210813160813-60bc85c4be6d // indirect
-	golang.org/x/sys v0.0.0-20211023085530-d6a326fbbf70 // indirect
+	golang.org/x/sys v0.0.0-20211023085530-d6a326fbbf70
 	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
 	zombiezen.com/go/sqlite v0.8.0
 )
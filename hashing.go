@@ -0,0 +1,216 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/anacrolix/missinggo/v2/bitmap"
+	"golang.org/x/time/rate"
+)
+
+// Chooses which queued pieces are hashed across all of a Client's torrents, within the configured
+// concurrency limits. Pieces that readers are waiting on go first. Otherwise torrents are served in
+// the order they started queueing pieces, so that rechecking many torrents proceeds a torrent at a
+// time instead of seeking between all of them. All methods require the client lock.
+type pieceHashScheduler struct {
+	// Torrents that have pieces queued for hashing, with the order they started queueing them.
+	queued  map[*Torrent]uint64
+	nextSeq uint64
+	running int
+	// Running hashes by storage device, for storage that can identify its device.
+	runningByDevice map[string]int
+}
+
+// Notes that a torrent has pieces queued for hashing.
+func (me *pieceHashScheduler) add(t *Torrent) {
+	if _, ok := me.queued[t]; ok {
+		return
+	}
+	if me.queued == nil {
+		me.queued = make(map[*Torrent]uint64)
+	}
+	me.queued[t] = me.nextSeq
+	me.nextSeq++
+}
+
+func (me *pieceHashScheduler) remove(t *Torrent) {
+	delete(me.queued, t)
+}
+
+// Returns the next piece to hash, if any are queued and allowed by the per-device limit.
+func (me *pieceHashScheduler) next(perDevice int) (t *Torrent, piece pieceIndex, ok bool) {
+	var (
+		bestUrgent bool
+		bestSeq    uint64
+	)
+	for candidate, seq := range me.queued {
+		if candidate.closed.IsSet() || candidate.piecesQueuedForHash.IsEmpty() {
+			delete(me.queued, candidate)
+			continue
+		}
+		if candidate.storage == nil {
+			continue
+		}
+		if dev := candidate.hashDevice; dev != "" && perDevice > 0 && me.runningByDevice[dev] >= perDevice {
+			continue
+		}
+		pi, urgent, have := candidate.getPieceToHash()
+		if !have {
+			continue
+		}
+		if ok && (bestUrgent && !urgent || bestUrgent == urgent && seq > bestSeq) {
+			continue
+		}
+		t, piece, ok = candidate, pi, true
+		bestUrgent, bestSeq = urgent, seq
+	}
+	return
+}
+
+// Returns whether a hash of data on the device can start now, within the concurrency limits.
+func (me *pieceHashScheduler) haveRoom(device string, max, perDevice int) bool {
+	if max > 0 && me.running >= max {
+		return false
+	}
+	return device == "" || perDevice <= 0 || me.runningByDevice[device] < perDevice
+}
+
+func (me *pieceHashScheduler) started(device string) {
+	me.running++
+	if device == "" {
+		return
+	}
+	if me.runningByDevice == nil {
+		me.runningByDevice = make(map[string]int)
+	}
+	me.runningByDevice[device]++
+}
+
+func (me *pieceHashScheduler) finished(device string) {
+	me.running--
+	if device == "" {
+		return
+	}
+	me.runningByDevice[device]--
+	if me.runningByDevice[device] == 0 {
+		delete(me.runningByDevice, device)
+	}
+}
+
+func (me *pieceHashScheduler) writeStatus(w io.Writer) {
+	fmt.Fprintf(w, "Piece hashes: %v running, %v torrents queued\n", me.running, len(me.queued))
+	for dev, n := range me.runningByDevice {
+		fmt.Fprintf(w, "  device %v: %v running\n", dev, n)
+	}
+}
+
+// Starts hashing queued pieces until the concurrency limits are reached.
+func (cl *Client) startPieceHashes() {
+	for cl.config.PieceHashers <= 0 || cl.pieceHashes.running < cl.config.PieceHashers {
+		t, piece, ok := cl.pieceHashes.next(cl.config.PieceHashersPerDevice)
+		if !ok {
+			return
+		}
+		t.startPieceHasher(piece)
+	}
+}
+
+// Progress hashing a torrent's pieces, such as when it's being rechecked.
+type PieceHashProgress struct {
+	// Pieces hashed since hashing started after there were none left to hash.
+	PiecesChecked int
+	// Pieces queued or being hashed.
+	PiecesRemaining int
+	// The average rate data was hashed at for the checked pieces.
+	BytesPerSecond float64
+}
+
+type pieceHashProgress struct {
+	started time.Time
+	// When there were last no pieces left to hash, if that's after started.
+	finished time.Time
+	checked  int
+	bytes    int64
+}
+
+// Returns the progress of hashing the torrent's pieces.
+func (t *Torrent) PieceHashProgress() (ret PieceHashProgress) {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	p := &t.hashProgress
+	ret.PiecesChecked = p.checked
+	ret.PiecesRemaining = t.activePieceHashes + int(t.piecesQueuedForHash.Len())
+	end := p.finished
+	if ret.PiecesRemaining != 0 || end.IsZero() {
+		end = time.Now()
+	}
+	if elapsed := end.Sub(p.started); elapsed > 0 {
+		ret.BytesPerSecond = float64(p.bytes) / elapsed.Seconds()
+	}
+	return
+}
+
+func (t *Torrent) hashingIdle() bool {
+	return t.activePieceHashes == 0 && t.piecesQueuedForHash.IsEmpty()
+}
+
+// Updates the storage device used to limit concurrent hashing per device.
+func (t *Torrent) updateHashDevice() {
+	t.hashDevice = ""
+	if t.storage != nil && t.storage.Device != nil {
+		t.hashDevice = t.storage.Device()
+	}
+}
+
+func (t *Torrent) startPieceHasher(pi pieceIndex) {
+	p := t.piece(pi)
+	t.piecesQueuedForHash.Remove(bitmap.BitIndex(pi))
+	p.hashing = true
+	t.publishPieceChange(pi)
+	t.updatePiecePriority(pi, "Torrent.startPieceHasher")
+	t.activePieceHashes++
+	device := t.hashDevice
+	t.cl.pieceHashes.started(device)
+	hash := func() {
+		t.cl.diskIo.submit(diskIoHash, 0, func() {
+			t.pieceHasher(pi, device)
+		})
+	}
+	if l := t.cl.config.PieceHashRateLimiter; l != nil {
+		// Wait for the piece's share of the rate before reading it, so that neither a disk IO
+		// worker nor the storage lock is held while waiting.
+		length := int(t.pieceLength(pi))
+		go func() {
+			waitRateLimiter(l, length)
+			hash()
+		}()
+		return
+	}
+	hash()
+}
+
+// Waits until the limiter allows n bytes. Waits larger than the limiter's burst are split. If the
+// burst is zero, the limiter can't allow anything, so the wait is according to the limit alone.
+func waitRateLimiter(l *rate.Limiter, n int) {
+	for n > 0 {
+		limit, burst := l.Limit(), l.Burst()
+		if limit == rate.Inf {
+			return
+		}
+		if burst <= 0 {
+			if limit > 0 {
+				time.Sleep(time.Duration(float64(n) / float64(limit) * float64(time.Second)))
+			}
+			return
+		}
+		chunk := n
+		if chunk > burst {
+			chunk = burst
+		}
+		if r := l.ReserveN(time.Now(), chunk); r.OK() {
+			time.Sleep(r.Delay())
+		}
+		n -= chunk
+	}
+}
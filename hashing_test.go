@@ -0,0 +1,128 @@
+package torrent
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/missinggo/v2/bitmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+	"github.com/anacrolix/torrent/storage"
+)
+
+func newHashSchedulerTestTorrent(t *testing.T) *Torrent {
+	tt := &Torrent{
+		storageOpener: storage.NewClient(storage.NewFile(t.TempDir())),
+		logger:        log.Default,
+		chunkSize:     defaultChunkSize,
+	}
+	info, err := testutil.GreetingMetaInfo().UnmarshalInfo()
+	require.NoError(t, err)
+	require.NoError(t, tt.setInfo(&info))
+	return tt
+}
+
+func TestPieceHashSchedulerNext(t *testing.T) {
+	var sched pieceHashScheduler
+	t1 := newHashSchedulerTestTorrent(t)
+	t2 := newHashSchedulerTestTorrent(t)
+	t1.piecesQueuedForHash.Add(1)
+	sched.add(t1)
+	t2.piecesQueuedForHash.Add(0)
+	t2.piecesQueuedForHash.Add(2)
+	sched.add(t2)
+	// Torrents are served in the order they queued pieces.
+	tt, piece, ok := sched.next(0)
+	require.True(t, ok)
+	assert.Equal(t, t1, tt)
+	assert.Equal(t, 1, piece)
+	// Pieces readers are waiting on go first.
+	t2._readerNowPieces.Add(bitmap.BitIndex(2))
+	tt, piece, ok = sched.next(0)
+	require.True(t, ok)
+	assert.Equal(t, t2, tt)
+	assert.Equal(t, 2, piece)
+	// The per-device limit applies.
+	t1.hashDevice = "dev"
+	t2.hashDevice = "dev"
+	sched.started("dev")
+	sched.started("dev")
+	_, _, ok = sched.next(2)
+	assert.False(t, ok)
+	sched.finished("dev")
+	_, _, ok = sched.next(2)
+	assert.True(t, ok)
+	// Closed torrents are dropped.
+	t2.closed.Set()
+	tt, _, ok = sched.next(0)
+	require.True(t, ok)
+	assert.Equal(t, t1, tt)
+	assert.NotContains(t, sched.queued, t2)
+}
+
+func TestPieceHashProgress(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	cfg := TestingConfig(t)
+	cfg.DataDir = dir
+	cfg.PieceHashers = 1
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	<-tt.GotInfo()
+	tt.VerifyData()
+	progress := tt.PieceHashProgress()
+	assert.EqualValues(t, 0, progress.PiecesRemaining)
+	assert.GreaterOrEqual(t, progress.PiecesChecked, tt.NumPieces())
+	assert.Greater(t, progress.BytesPerSecond, 0.0)
+	assert.True(t, tt.Complete.Bool())
+}
+
+func TestWaitRateLimiterZeroBurst(t *testing.T) {
+	started := time.Now()
+	waitRateLimiter(rate.NewLimiter(1<<20, 0), 1<<14)
+	// 16 KiB at 1 MiB/s.
+	assert.GreaterOrEqual(t, time.Since(started), 15*time.Millisecond)
+}
+
+func TestWaitRateLimiterSplitsByBurst(t *testing.T) {
+	l := rate.NewLimiter(1<<20, 1<<12)
+	started := time.Now()
+	waitRateLimiter(l, 1<<14)
+	// The first 4 KiB are from the burst, and the rest at 1 MiB/s.
+	assert.GreaterOrEqual(t, time.Since(started), 11*time.Millisecond)
+}
+
+func TestPieceHashRateLimitDoesntHoldStorageLock(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	cfg := TestingConfig(t)
+	cfg.DataDir = dir
+	// Each piece waits about a second for the limiter.
+	cfg.PieceHashRateLimiter = rate.NewLimiter(4, 1)
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	<-tt.GotInfo()
+	require.NotZero(t, tt.PieceHashProgress().PiecesRemaining)
+	locked := make(chan struct{})
+	go func() {
+		tt.storageLock.Lock()
+		tt.storageLock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("storage lock is held while waiting for the rate limiter")
+	}
+}
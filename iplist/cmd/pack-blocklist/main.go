@@ -1,9 +1,12 @@
-// Takes P2P blocklist text format in stdin, and outputs the packed format
-// from the iplist package.
+// Takes blocklists in the P2P, eMule DAT or CIDR text formats, optionally
+// compressed with gzip or in zip archives, and outputs the packed format from
+// the iplist package. Blocklists are read from the file paths and HTTP(S) URLs
+// given as arguments, and merged, or from stdin if there are none.
 package main
 
 import (
 	"bufio"
+	"context"
 	"os"
 
 	"github.com/anacrolix/missinggo/v2"
@@ -13,8 +16,22 @@ import (
 )
 
 func main() {
-	tagflag.Parse(nil)
-	l, err := iplist.NewFromReader(os.Stdin)
+	var flags struct {
+		tagflag.StartPos
+		Sources []string `arity:"*" help:"blocklist file path or URL"`
+	}
+	tagflag.Parse(&flags)
+	var (
+		l   *iplist.IPList
+		err error
+	)
+	if len(flags.Sources) == 0 {
+		var ranges []iplist.Range
+		ranges, err = iplist.ParseRanges(os.Stdin)
+		l = iplist.NewFromUnsorted(ranges)
+	} else {
+		l, err = iplist.LoadSources(context.Background(), flags.Sources, nil)
+	}
 	if err != nil {
 		missinggo.Fatal(err)
 	}
@@ -0,0 +1,199 @@
+package iplist
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Parses an IP with optional leading zeros in IPv4 octets, as used by the eMule DAT format.
+func parseDATIP(b []byte) net.IP {
+	b = bytes.TrimSpace(b)
+	if bytes.IndexByte(b, ':') != -1 {
+		return net.ParseIP(string(b))
+	}
+	fields := bytes.Split(b, []byte("."))
+	if len(fields) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, f := range fields {
+		if len(f) == 0 || len(f) > 3 {
+			return nil
+		}
+		n, err := strconv.ParseUint(string(f), 10, 8)
+		if err != nil {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return ip
+}
+
+// The highest eMule DAT access level that's blocked.
+const datMaxBlockedLevel = 127
+
+// Parse a line of the eMule DAT format (ipfilter.dat), such as
+// "001.002.004.000 - 001.002.004.255 , 000 , description". Returns !ok but no
+// error for lines that don't block a range, such as comment and blank lines,
+// and ranges with an access level above 127, which eMule allows.
+func ParseBlocklistDATLine(l []byte) (r Range, ok bool, err error) {
+	l = bytes.TrimSpace(l)
+	if len(l) == 0 || bytes.HasPrefix(l, []byte("#")) || bytes.HasPrefix(l, []byte("//")) {
+		return
+	}
+	fields := bytes.SplitN(l, []byte(","), 3)
+	if len(fields) < 2 {
+		err = errors.New("missing access level")
+		return
+	}
+	hyphen := bytes.IndexByte(fields[0], '-')
+	if hyphen == -1 {
+		err = errors.New("missing hyphen")
+		return
+	}
+	r.First = parseDATIP(fields[0][:hyphen])
+	r.Last = parseDATIP(fields[0][hyphen+1:])
+	minifyIP(&r.First)
+	minifyIP(&r.Last)
+	if r.First == nil || r.Last == nil || len(r.First) != len(r.Last) {
+		err = errors.New("bad IP range")
+		return
+	}
+	level, err := strconv.Atoi(string(bytes.TrimSpace(fields[1])))
+	if err != nil {
+		err = fmt.Errorf("bad access level: %w", err)
+		return
+	}
+	if len(fields) == 3 {
+		r.Description = string(bytes.TrimSpace(fields[2]))
+	}
+	ok = level <= datMaxBlockedLevel
+	return
+}
+
+// Parse a line containing a CIDR range, such as "1.2.4.0/24", or a single IP.
+// Returns !ok but no error for comment and blank lines.
+func ParseBlocklistCIDRLine(l []byte) (r Range, ok bool, err error) {
+	l = bytes.TrimSpace(l)
+	if len(l) == 0 || bytes.HasPrefix(l, []byte("#")) {
+		return
+	}
+	if bytes.IndexByte(l, '/') == -1 {
+		r.First = net.ParseIP(string(l))
+		if r.First == nil {
+			err = errors.New("bad IP")
+			return
+		}
+		minifyIP(&r.First)
+		r.Last = r.First
+		ok = true
+		return
+	}
+	_, in, err := net.ParseCIDR(string(l))
+	if err != nil {
+		return
+	}
+	r.First = in.IP
+	r.Last = IPNetLast(in)
+	ok = true
+	return
+}
+
+// Parses a line in any of the supported text formats: eMule DAT, CIDR, or P2P.
+func parseBlocklistLine(l []byte) (r Range, ok bool, err error) {
+	if r, ok, err = ParseBlocklistDATLine(l); err == nil {
+		return
+	}
+	if r, ok, err = ParseBlocklistCIDRLine(l); err == nil {
+		return
+	}
+	return ParseBlocklistP2PLine(l)
+}
+
+// Parses ranges from blocklist text where each line can be in the P2P, eMule
+// DAT or CIDR format. Data compressed with gzip, or in a zip archive is
+// decompressed first. All the files in a zip archive are parsed. The returned
+// ranges aren't sorted.
+func ParseRanges(r io.Reader) (ret []Range, err error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte("\x1f\x8b")):
+		var gr *gzip.Reader
+		gr, err = gzip.NewReader(br)
+		if err != nil {
+			return
+		}
+		defer gr.Close()
+		return parseRangesText(gr)
+	case bytes.Equal(magic, []byte("PK\x03\x04")):
+		var b []byte
+		b, err = io.ReadAll(br)
+		if err != nil {
+			return
+		}
+		var zr *zip.Reader
+		zr, err = zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			return
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			var ranges []Range
+			ranges, err = parseZipFile(f)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", f.Name, err)
+				return
+			}
+			ret = append(ret, ranges...)
+		}
+		return
+	default:
+		return parseRangesText(br)
+	}
+}
+
+func parseZipFile(f *zip.File) ([]Range, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return parseRangesText(rc)
+}
+
+func parseRangesText(r io.Reader) (ret []Range, err error) {
+	// There's a lot of similar descriptions, so we maintain a pool and reuse
+	// them to reduce memory overhead.
+	uniqStrs := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	lineNum := 1
+	for scanner.Scan() {
+		r, ok, lineErr := parseBlocklistLine(scanner.Bytes())
+		if lineErr != nil {
+			err = fmt.Errorf("error parsing line %d: %s", lineNum, lineErr)
+			return
+		}
+		lineNum++
+		if !ok {
+			continue
+		}
+		if s, ok := uniqStrs[r.Description]; ok {
+			r.Description = s
+		} else {
+			uniqStrs[r.Description] = r.Description
+		}
+		ret = append(ret, r)
+	}
+	err = scanner.Err()
+	return
+}
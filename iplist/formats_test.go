@@ -0,0 +1,115 @@
+package iplist
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mixedSample = `
+# P2P
+a:1.2.4.0-1.2.4.255
+v6 range:2001:db8::-2001:db8::ffff
+// eMule DAT
+001.002.008.000 - 001.002.008.255 , 000 , dat
+001.002.009.000 - 001.002.009.255 , 200 , allowed by eMule
+10.0.0.0/8
+2400:cb00::/32
+127.0.0.1
+`
+
+func testMixedRanges(t *testing.T, l Ranger) {
+	for _, _case := range []struct {
+		IP   string
+		Hit  bool
+		Desc string
+	}{
+		{"1.2.3.255", false, ""},
+		{"1.2.4.7", true, "a"},
+		{"1.2.8.0", true, "dat"},
+		{"1.2.9.1", false, ""},
+		{"10.200.0.1", true, ""},
+		{"127.0.0.1", true, ""},
+		{"127.0.0.2", false, ""},
+		{"2001:db8::1", true, "v6 range"},
+		{"2001:db8::1:0", false, ""},
+		{"2400:cb00:1::1", true, ""},
+		{"::ffff:1.2.4.1", true, "a"},
+	} {
+		r, ok := l.Lookup(net.ParseIP(_case.IP))
+		assert.Equal(t, _case.Hit, ok, "%v", _case.IP)
+		if ok {
+			assert.Equal(t, _case.Desc, r.Description, "%v", _case.IP)
+		}
+	}
+	assert.Equal(t, 6, l.NumRanges())
+}
+
+func TestParseRangesMixedFormats(t *testing.T) {
+	ranges, err := ParseRanges(strings.NewReader(mixedSample))
+	require.NoError(t, err)
+	l := NewFromUnsorted(ranges)
+	testMixedRanges(t, l)
+	var buf bytes.Buffer
+	require.NoError(t, l.WritePacked(&buf))
+	testMixedRanges(t, NewFromPacked(buf.Bytes()))
+}
+
+func TestParseRangesCompressed(t *testing.T) {
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(mixedSample))
+	require.NoError(t, gw.Close())
+	ranges, err := ParseRanges(&gz)
+	require.NoError(t, err)
+	testMixedRanges(t, NewFromUnsorted(ranges))
+
+	var zb bytes.Buffer
+	zw := zip.NewWriter(&zb)
+	lines := strings.SplitAfter(mixedSample, "// eMule DAT\n")
+	for i, name := range []string{"p2p.txt", "dat.txt"} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write([]byte(lines[i]))
+	}
+	require.NoError(t, zw.Close())
+	ranges, err = ParseRanges(&zb)
+	require.NoError(t, err)
+	testMixedRanges(t, NewFromUnsorted(ranges))
+}
+
+func TestParseRangesError(t *testing.T) {
+	_, err := ParseRanges(strings.NewReader("a:1.2.4.0-1.2.4.255\nnonsense\n"))
+	assert.EqualError(t, err, "error parsing line 2: missing hyphen")
+}
+
+func TestLoadSources(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/list" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("b:1.2.8.0-1.2.8.255\n"))
+	}))
+	defer srv.Close()
+	path := t.TempDir() + "/list.txt"
+	require.NoError(t, os.WriteFile(path, []byte("a:1.2.4.0-1.2.4.255\n"), 0o644))
+	l, err := LoadSources(context.Background(), []string{path, srv.URL + "/list"}, srv.Client())
+	require.NoError(t, err)
+	require.Equal(t, 2, l.NumRanges())
+	r, ok := l.Lookup(net.ParseIP("1.2.8.1"))
+	assert.True(t, ok)
+	assert.Equal(t, "b", r.Description)
+	_, err = LoadSources(context.Background(), []string{srv.URL + "/missing"}, srv.Client())
+	assert.Error(t, err)
+}
@@ -34,14 +34,58 @@ func (r Range) String() string {
 }
 
 // Create a new IP list. The given ranges must already sorted by the lower
-// bound IP in each range. Behaviour is undefined for lists of overlapping
-// ranges.
+// bound IP in each range, with IPv4 addresses ordered as IPv4-mapped IPv6
+// addresses. Behaviour is undefined for lists of overlapping ranges.
 func New(initSorted []Range) *IPList {
 	return &IPList{
 		ranges: initSorted,
 	}
 }
 
+// Creates a new IP list from ranges in any order. The ranges are sorted in
+// place, and ranges that overlap or are adjacent are merged, keeping the
+// description of the first.
+func NewFromUnsorted(ranges []Range) *IPList {
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return compareIPs(ranges[i].First, ranges[j].First) < 0
+	})
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n != 0 {
+			last := &merged[n-1]
+			if next := nextIP(last.Last); next == nil || compareIPs(r.First, next) <= 0 {
+				if compareIPs(r.Last, last.Last) > 0 {
+					last.Last = r.Last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return New(merged)
+}
+
+// Returns the IP after ip, in its 16 byte form, or nil if there isn't one.
+func nextIP(ip net.IP) net.IP {
+	ret := append(net.IP(nil), ip.To16()...)
+	for i := len(ret) - 1; i >= 0; i-- {
+		ret[i]++
+		if ret[i] != 0 {
+			return ret
+		}
+	}
+	return nil
+}
+
+// Compares IPs, using their 16 byte forms if their lengths differ, so that
+// IPv4 and IPv6 addresses can be ordered together.
+func compareIPs(a, b net.IP) int {
+	if len(a) != len(b) {
+		a, b = a.To16(), b.To16()
+	}
+	return bytes.Compare(a, b)
+}
+
 func (ipl *IPList) NumRanges() int {
 	if ipl == nil {
 		return 0
@@ -92,13 +136,13 @@ func lookup(
 		if i+1 >= n {
 			return true
 		}
-		return bytes.Compare(ip, first(i+1)) < 0
+		return compareIPs(ip, first(i+1)) < 0
 	})
 	if i == n {
 		return
 	}
 	r = full(i)
-	ok = bytes.Compare(r.First, ip) <= 0 && bytes.Compare(ip, r.Last) <= 0
+	ok = compareIPs(r.First, ip) <= 0 && compareIPs(ip, r.Last) <= 0
 	return
 }
 
@@ -126,22 +170,36 @@ func ParseBlocklistP2PLine(l []byte) (r Range, ok bool, err error) {
 	if len(l) == 0 || bytes.HasPrefix(l, []byte("#")) {
 		return
 	}
-	// TODO: Check this when IPv6 blocklists are available.
-	colon := bytes.LastIndexAny(l, ":")
-	if colon == -1 {
-		err = errors.New("missing colon")
-		return
-	}
-	hyphen := bytes.IndexByte(l[colon+1:], '-')
+	// IPs don't contain hyphens, but descriptions might.
+	hyphen := bytes.LastIndexByte(l, '-')
 	if hyphen == -1 {
 		err = errors.New("missing hyphen")
 		return
 	}
-	hyphen += colon + 1
+	// Both the description and IPv6 addresses can contain colons. The description ends at the
+	// first colon that's followed by an IP, so a description that ends in something like an
+	// IPv6 address fragment is cut short.
+	colon := -1
+	for i := 0; i < hyphen; i++ {
+		if l[i] != ':' {
+			continue
+		}
+		if colon == -1 {
+			colon = i
+		}
+		if net.ParseIP(string(l[i+1:hyphen])) != nil {
+			colon = i
+			break
+		}
+	}
+	if colon == -1 {
+		err = errors.New("missing colon")
+		return
+	}
 	r.Description = string(l[:colon])
 	r.First = net.ParseIP(string(l[colon+1 : hyphen]))
 	minifyIP(&r.First)
-	r.Last = net.ParseIP(string(l[hyphen+1:]))
+	r.Last = net.ParseIP(string(bytes.TrimSpace(l[hyphen+1:])))
 	minifyIP(&r.Last)
 	if r.First == nil || r.Last == nil || len(r.First) != len(r.Last) {
 		err = errors.New("bad IP range")
@@ -122,3 +122,31 @@ func TestSimple(t *testing.T) {
 	packed := NewFromPacked(packedSample)
 	testLookuperSimple(t, packed)
 }
+
+func TestNewFromUnsortedMergesRanges(t *testing.T) {
+	l := NewFromUnsorted([]Range{
+		{net.ParseIP("1.2.3.0").To4(), net.ParseIP("1.2.3.255").To4(), "inner"},
+		{net.ParseIP("1.0.0.0").To4(), net.ParseIP("1.255.255.255").To4(), "outer"},
+		{net.ParseIP("2.0.0.0").To4(), net.ParseIP("2.0.0.255").To4(), "adjacent"},
+		{net.ParseIP("2.0.2.0").To4(), net.ParseIP("2.0.2.255").To4(), "apart"},
+		{net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::ffff"), "v6"},
+	})
+	assert.Equal(t, 3, l.NumRanges())
+	for _, _case := range []struct {
+		ip   string
+		desc string
+	}{
+		{"1.5.0.0", "outer"},
+		{"1.2.3.4", "outer"},
+		{"2.0.0.7", "outer"},
+		{"2.0.2.7", "apart"},
+		{"2001:db8::1", "v6"},
+	} {
+		r, ok := l.Lookup(net.ParseIP(_case.ip))
+		if assert.True(t, ok, _case.ip) {
+			assert.Equal(t, _case.desc, r.Description, _case.ip)
+		}
+	}
+	_, ok := l.Lookup(net.ParseIP("2.0.1.0"))
+	assert.False(t, ok)
+}
@@ -4,6 +4,7 @@
 package iplist
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -13,18 +14,42 @@ import (
 	"github.com/edsrzf/mmap-go"
 )
 
-// The packed format is an 8 byte integer of the number of ranges. Then 20
-// bytes per range, consisting of 4 byte packed IP being the lower bound IP of
-// the range, then 4 bytes of the upper, inclusive bound, 8 bytes for the
-// offset of the description from the end of the packed ranges, and 4 bytes
-// for the length of the description. After these packed ranges, are the
-// concatenated descriptions.
+// The packed format starts with the 8 byte magic "iplist\x00\x02", then an 8
+// byte integer of the number of ranges. Then 44 bytes per range, consisting of
+// the 16 byte lower bound IP of the range, then 16 bytes of the upper,
+// inclusive bound, 8 bytes for the offset of the description from the end of
+// the packed ranges, and 4 bytes for the length of the description. After
+// these packed ranges, are the concatenated descriptions. IPv4 addresses are
+// stored as IPv4-mapped IPv6 addresses, and the ranges are sorted by their
+// lower bounds, so IPv4 and IPv6 ranges can be mixed. Integers are little
+// endian.
+//
+// Older packed files have no magic, and either the same ranges, or 20 byte
+// ranges with 4 byte IPv4 bounds. They can still be read.
+
+const packedMagic = "iplist\x00\x02"
+
+// The layout of ranges in a packed list.
+type packedLayout struct {
+	// Where the number of ranges is.
+	countOffset int
+	ipLen       int
+}
 
-const (
-	packedRangesOffset = 8
-	packedRangeLen     = 44
+var (
+	packedLayoutCurrent    = packedLayout{len(packedMagic), 16}
+	packedLayoutHeaderless = packedLayout{0, 16}
+	packedLayoutIPv4       = packedLayout{0, 4}
 )
 
+func (me packedLayout) rangesOffset() int {
+	return me.countOffset + 8
+}
+
+func (me packedLayout) rangeLen() int {
+	return 2*me.ipLen + 12
+}
+
 func (ipl *IPList) WritePacked(w io.Writer) (err error) {
 	descOffsets := make(map[string]int64, len(ipl.ranges))
 	descs := make([]string, 0, len(ipl.ranges))
@@ -43,6 +68,7 @@ func (ipl *IPList) WritePacked(w io.Writer) (err error) {
 			panic(n)
 		}
 	}
+	write([]byte(packedMagic), len(packedMagic))
 	var b [8]byte
 	binary.LittleEndian.PutUint64(b[:], uint64(len(ipl.ranges)))
 	write(b[:], 8)
@@ -67,42 +93,104 @@ func (ipl *IPList) WritePacked(w io.Writer) (err error) {
 	return
 }
 
+// Returns the packed list in b, which must be valid. See ParsePacked.
 func NewFromPacked(b []byte) PackedIPList {
-	ret := PackedIPList(b)
-	minLen := packedRangesOffset + ret.len()*packedRangeLen
-	if len(b) < minLen {
-		panic(fmt.Sprintf("packed len %d < %d", len(b), minLen))
+	ret, err := ParsePacked(b)
+	if err != nil {
+		panic(err)
 	}
 	return ret
 }
 
-type PackedIPList []byte
+// Returns the packed list in b, after checking that it's complete. Lists
+// packed without a version header by older versions are also read.
+func ParsePacked(b []byte) (PackedIPList, error) {
+	if bytes.HasPrefix(b, []byte(packedMagic)) {
+		return parsePackedLayout(b, packedLayoutCurrent)
+	}
+	ret, err := parsePackedLayout(b, packedLayoutHeaderless)
+	if err == nil {
+		return ret, nil
+	}
+	if ret, err := parsePackedLayout(b, packedLayoutIPv4); err == nil {
+		return ret, nil
+	}
+	return PackedIPList{}, err
+}
+
+func parsePackedLayout(b []byte, layout packedLayout) (ret PackedIPList, err error) {
+	if len(b) < layout.rangesOffset() {
+		err = fmt.Errorf("packed len %d too short for header", len(b))
+		return
+	}
+	ret = PackedIPList{b, layout}
+	n := binary.LittleEndian.Uint64(b[layout.countOffset:])
+	if n > uint64(len(b)) {
+		err = fmt.Errorf("packed len %d too short for %d ranges", len(b), n)
+		return
+	}
+	descsOffset := layout.rangesOffset() + int(n)*layout.rangeLen()
+	if len(b) < descsOffset {
+		err = fmt.Errorf("packed len %d < %d", len(b), descsOffset)
+		return
+	}
+	descsLen := uint64(len(b) - descsOffset)
+	for i := 0; i < int(n); i++ {
+		_, descOff, descLen := ret.descriptionLocation(i)
+		if descOff > descsLen || descLen > descsLen-descOff {
+			err = fmt.Errorf("range %d description out of bounds", i)
+			return
+		}
+		if i != 0 && compareIPs(ret.getFirst(i-1), ret.getFirst(i)) > 0 {
+			err = fmt.Errorf("range %d not sorted", i)
+			return
+		}
+	}
+	return
+}
+
+type PackedIPList struct {
+	b      []byte
+	layout packedLayout
+}
 
 var _ Ranger = PackedIPList{}
 
 func (pil PackedIPList) len() int {
-	return int(binary.LittleEndian.Uint64(pil[:8]))
+	return int(binary.LittleEndian.Uint64(pil.b[pil.layout.countOffset:]))
 }
 
 func (pil PackedIPList) NumRanges() int {
 	return pil.len()
 }
 
+func (pil PackedIPList) rangeOffset(i int) int {
+	return pil.layout.rangesOffset() + pil.layout.rangeLen()*i
+}
+
 func (pil PackedIPList) getFirst(i int) net.IP {
-	off := packedRangesOffset + packedRangeLen*i
-	return net.IP(pil[off : off+16])
+	off := pil.rangeOffset(i)
+	return net.IP(pil.b[off : off+pil.layout.ipLen])
+}
+
+// Returns where the range is, and where its description is relative to the
+// end of the ranges.
+func (pil PackedIPList) descriptionLocation(i int) (rOff int, descOff, descLen uint64) {
+	rOff = pil.rangeOffset(i)
+	descOff = binary.LittleEndian.Uint64(pil.b[rOff+2*pil.layout.ipLen:])
+	descLen = uint64(binary.LittleEndian.Uint32(pil.b[rOff+2*pil.layout.ipLen+8:]))
+	return
 }
 
 func (pil PackedIPList) getRange(i int) (ret Range) {
-	rOff := packedRangesOffset + packedRangeLen*i
-	last := pil[rOff+16 : rOff+32]
-	descOff := int(binary.LittleEndian.Uint64(pil[rOff+32:]))
-	descLen := int(binary.LittleEndian.Uint32(pil[rOff+40:]))
-	descOff += packedRangesOffset + packedRangeLen*pil.len()
+	rOff, descOff, descLen := pil.descriptionLocation(i)
+	ipLen := pil.layout.ipLen
+	last := pil.b[rOff+ipLen : rOff+2*ipLen]
+	descStart := int(descOff) + pil.rangeOffset(pil.len())
 	ret = Range{
 		pil.getFirst(i),
 		net.IP(last),
-		string(pil[descOff : descOff+descLen]),
+		string(pil.b[descStart : descStart+int(descLen)]),
 	}
 	return
 }
@@ -137,9 +225,14 @@ func MMapPackedFile(filename string) (
 	if err != nil {
 		return
 	}
+	pil, err := ParsePacked(mm)
+	if err != nil {
+		mm.Unmap()
+		return
+	}
 	ret = struct {
 		Ranger
 		io.Closer
-	}{NewFromPacked(mm), closerFunc(mm.Unmap)}
+	}{pil, closerFunc(mm.Unmap)}
 	return
 }
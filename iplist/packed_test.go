@@ -2,9 +2,11 @@ package iplist
 
 import (
 	"bytes"
+	"net"
 	"strings"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,7 +26,7 @@ func TestWritePacked(t *testing.T) {
 	err = l.WritePacked(&buf)
 	require.NoError(t, err)
 	require.Equal(t,
-		"\x05\x00\x00\x00\x00\x00\x00\x00"+
+		packedMagic+"\x05\x00\x00\x00\x00\x00\x00\x00"+
 			"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x01\x02\x04\x00"+"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x01\x02\x04\xff"+"\x00\x00\x00\x00\x00\x00\x00\x00"+"\x01\x00\x00\x00"+
 			"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x01\x02\x08\x00"+"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x01\x02\x08\xff"+"\x01\x00\x00\x00\x00\x00\x00\x00"+"\x01\x00\x00\x00"+
 			"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x01\x02\x08\x02"+"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x01\x02\x08\x02"+"\x02\x00\x00\x00\x00\x00\x00\x00"+"\x03\x00\x00\x00"+
@@ -33,3 +35,30 @@ func TestWritePacked(t *testing.T) {
 			"abeffsomething:more detail",
 		buf.String())
 }
+
+func TestReadOlderPackedLayouts(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, New([]Range{
+		{net.ParseIP("1.2.4.0"), net.ParseIP("1.2.4.255"), "a"},
+		{net.ParseIP("1.2.8.0"), net.ParseIP("1.2.8.255"), "b"},
+	}).WritePacked(&buf))
+	headerless := buf.Bytes()[len(packedMagic):]
+	ipv4 := "\x02\x00\x00\x00\x00\x00\x00\x00" +
+		"\x01\x02\x04\x00" + "\x01\x02\x04\xff" + "\x00\x00\x00\x00\x00\x00\x00\x00" + "\x01\x00\x00\x00" +
+		"\x01\x02\x08\x00" + "\x01\x02\x08\xff" + "\x01\x00\x00\x00\x00\x00\x00\x00" + "\x01\x00\x00\x00" +
+		"ab"
+	for _, b := range [][]byte{buf.Bytes(), headerless, []byte(ipv4)} {
+		l, err := ParsePacked(b)
+		require.NoError(t, err)
+		assert.Equal(t, 2, l.NumRanges())
+		r, ok := l.Lookup(net.ParseIP("1.2.8.7"))
+		assert.True(t, ok)
+		assert.Equal(t, "b", r.Description)
+		_, ok = l.Lookup(net.ParseIP("1.2.5.0"))
+		assert.False(t, ok)
+	}
+	for _, b := range [][]byte{nil, buf.Bytes()[:buf.Len()-1], []byte(ipv4[:30])} {
+		_, err := ParsePacked(b)
+		assert.Error(t, err)
+	}
+}
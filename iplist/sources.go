@@ -0,0 +1,58 @@
+package iplist
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Returns whether the blocklist source is an HTTP(S) URL rather than a file path.
+func isURLSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// Reads the ranges from a blocklist file path or HTTP(S) URL in any of the formats handled by
+// ParseRanges. httpClient is used for URLs, or http.DefaultClient if it's nil.
+func LoadSourceRanges(ctx context.Context, source string, httpClient *http.Client) ([]Range, error) {
+	if !isURLSource(source) {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ParseRanges(f)
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return ParseRanges(resp.Body)
+}
+
+// Loads and merges blocklists from file paths and HTTP(S) URLs.
+func LoadSources(ctx context.Context, sources []string, httpClient *http.Client) (*IPList, error) {
+	var ranges []Range
+	for _, source := range sources {
+		sourceRanges, err := LoadSourceRanges(ctx, source, httpClient)
+		if err != nil {
+			return nil, fmt.Errorf("loading %q: %w", source, err)
+		}
+		ranges = append(ranges, sourceRanges...)
+	}
+	return NewFromUnsorted(ranges), nil
+}
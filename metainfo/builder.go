@@ -0,0 +1,515 @@
+package metainfo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// How a Builder treats symbolic links.
+type SymlinkPolicy int
+
+const (
+	// Links to files are included with the target's data, and links to directories are walked.
+	SymlinkFollow SymlinkPolicy = iota
+	// Links are left out.
+	SymlinkSkip
+	// Links cause the build to fail.
+	SymlinkError
+)
+
+// Progress of hashing the pieces of a Builder.
+type BuildProgress struct {
+	PiecesHashed int
+	TotalPieces  int
+	BytesHashed  int64
+	TotalBytes   int64
+}
+
+// Creates an Info from files on disk. Pieces are hashed in parallel, and the hashing of a large
+// directory can be resumed if it's interrupted. The zero value of the options behaves like
+// Info.BuildFromFilePath, except that the piece length is chosen automatically.
+type Builder struct {
+	// The file or directory the torrent is made from.
+	Root string
+	// If zero, it's chosen from the total length with ChoosePieceLength.
+	PieceLength int64
+	// The number of pieces hashed at once. Defaults to the number of CPUs.
+	Workers int
+	// Glob patterns, as for path.Match, matched against '/' separated paths relative to Root and
+	// against base names. If any are given, only files matching one are included.
+	Include []string
+	// Glob patterns for files and directories to leave out, matched as for Include.
+	Exclude []string
+	// How symbolic links are treated.
+	Symlinks SymlinkPolicy
+	// Leave out files and directories with names starting with '.'.
+	SkipHidden bool
+	Private    *bool
+	Source     string
+	// Called after each piece is hashed, from one goroutine at a time.
+	Progress func(BuildProgress)
+	// If set, hashing progress is saved to this path while building, so that a build interrupted
+	// by an error or cancellation resumes where it stopped, provided the files haven't changed. It's
+	// removed when the build succeeds. The build fails if progress can't be saved.
+	ResumePath string
+	// How often progress is saved to ResumePath. Defaults to 10 seconds.
+	ResumeInterval time.Duration
+}
+
+type builderFile struct {
+	// The OS path of the file, or of the link's target.
+	osPath  string
+	path    []string
+	length  int64
+	modTime time.Time
+	offset  int64
+}
+
+// Returns a piece length that gives a reasonable number of pieces for the total length, a power of
+// two between 16 KiB and 16 MiB.
+func ChoosePieceLength(totalLength int64) int64 {
+	const (
+		minPieceLength = 16 << 10
+		maxPieceLength = 16 << 20
+		targetPieces   = 1500
+	)
+	ret := int64(minPieceLength)
+	for ret < maxPieceLength && totalLength/ret > targetPieces {
+		ret *= 2
+	}
+	return ret
+}
+
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "." && name != ".."
+}
+
+func matchesAny(patterns []string, relPath string) bool {
+	base := path.Base(relPath)
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, relPath); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Builder) checkPatterns() error {
+	for _, p := range append(append([]string(nil), b.Include...), b.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// Finds the files to include, in the order they'll appear in the info.
+func (b *Builder) walk() (files []builderFile, single bool, err error) {
+	rootFi, err := os.Stat(b.Root)
+	if err != nil {
+		return
+	}
+	if !rootFi.IsDir() {
+		return []builderFile{{
+			osPath:  b.Root,
+			length:  rootFi.Size(),
+			modTime: rootFi.ModTime(),
+		}}, true, nil
+	}
+	// Real paths of directories being walked, to avoid following links in a loop.
+	visiting := make(map[string]bool)
+	var walkDir func(osDir string, relDir []string) error
+	walkDir = func(osDir string, relDir []string) error {
+		realDir, err := filepath.EvalSymlinks(osDir)
+		if err != nil {
+			return err
+		}
+		if visiting[realDir] {
+			return fmt.Errorf("symlink loop at %q", osDir)
+		}
+		visiting[realDir] = true
+		defer delete(visiting, realDir)
+		entries, err := os.ReadDir(osDir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name := e.Name()
+			osPath := filepath.Join(osDir, name)
+			rel := append(append([]string(nil), relDir...), name)
+			relSlash := strings.Join(rel, "/")
+			if b.SkipHidden && isHidden(name) || matchesAny(b.Exclude, relSlash) {
+				continue
+			}
+			fi, err := e.Info()
+			if err != nil {
+				return err
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				switch b.Symlinks {
+				case SymlinkSkip:
+					continue
+				case SymlinkError:
+					return fmt.Errorf("%q is a symlink", osPath)
+				}
+				fi, err = os.Stat(osPath)
+				if err != nil {
+					return err
+				}
+			}
+			if fi.IsDir() {
+				if err := walkDir(osPath, rel); err != nil {
+					return err
+				}
+				continue
+			}
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+			if len(b.Include) != 0 && !matchesAny(b.Include, relSlash) {
+				continue
+			}
+			files = append(files, builderFile{
+				osPath:  osPath,
+				path:    rel,
+				length:  fi.Size(),
+				modTime: fi.ModTime(),
+			})
+		}
+		return nil
+	}
+	err = walkDir(b.Root, nil)
+	if err != nil {
+		return
+	}
+	if len(files) == 0 {
+		err = errors.New("no files to include")
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return strings.Join(files[i].path, "/") < strings.Join(files[j].path, "/")
+	})
+	return
+}
+
+// The persisted state of an interrupted build.
+type buildResumeState struct {
+	PieceLength int64             `bencode:"piece length"`
+	Files       []buildResumeFile `bencode:"files"`
+	Pieces      []byte            `bencode:"pieces"`
+	// One byte per piece, non-zero if the piece's hash in Pieces is valid.
+	Hashed []byte `bencode:"hashed"`
+}
+
+type buildResumeFile struct {
+	Path    []string `bencode:"path"`
+	Length  int64    `bencode:"length"`
+	ModTime int64    `bencode:"mtime"`
+}
+
+func resumeFiles(files []builderFile) (ret []buildResumeFile) {
+	for _, f := range files {
+		ret = append(ret, buildResumeFile{
+			Path:    f.path,
+			Length:  f.length,
+			ModTime: f.modTime.UnixNano(),
+		})
+	}
+	return
+}
+
+// Loads the resume state, if there is one matching the current files.
+func (b *Builder) loadResume(want buildResumeState) (ret buildResumeState, ok bool) {
+	if b.ResumePath == "" {
+		return
+	}
+	data, err := os.ReadFile(b.ResumePath)
+	if err != nil {
+		return
+	}
+	if bencode.Unmarshal(data, &ret) != nil {
+		return
+	}
+	if ret.PieceLength != want.PieceLength ||
+		len(ret.Pieces) != len(want.Pieces) || len(ret.Hashed) != len(want.Hashed) {
+		return
+	}
+	wantFiles, err := bencode.Marshal(want.Files)
+	if err != nil {
+		return
+	}
+	haveFiles, err := bencode.Marshal(ret.Files)
+	if err != nil || !bytes.Equal(wantFiles, haveFiles) {
+		return
+	}
+	return ret, true
+}
+
+func (b *Builder) saveResume(state buildResumeState) error {
+	data, err := bencode.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := b.ResumePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.ResumePath)
+}
+
+// Reads torrent data from the files, keeping the last file used open.
+type builderReader struct {
+	files   []builderFile
+	open    *os.File
+	openIdx int
+}
+
+func (r *builderReader) close() {
+	if r.open != nil {
+		r.open.Close()
+		r.open = nil
+	}
+}
+
+func (r *builderReader) readAt(p []byte, off int64) error {
+	i := sort.Search(len(r.files), func(i int) bool {
+		return r.files[i].offset+r.files[i].length > off
+	})
+	for len(p) != 0 {
+		if i >= len(r.files) {
+			return io.ErrUnexpectedEOF
+		}
+		f := r.files[i]
+		n := int64(len(p))
+		if rem := f.offset + f.length - off; n > rem {
+			n = rem
+		}
+		if n != 0 {
+			if r.open == nil || r.openIdx != i {
+				r.close()
+				var err error
+				r.open, err = os.Open(f.osPath)
+				if err != nil {
+					return err
+				}
+				r.openIdx = i
+			}
+			_, err := r.open.ReadAt(p[:n], off-f.offset)
+			if err == io.EOF {
+				err = fmt.Errorf("%q is shorter than expected: %w", f.osPath, io.ErrUnexpectedEOF)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		p = p[n:]
+		off += n
+		i++
+	}
+	return nil
+}
+
+// Walks Root and hashes the included files.
+func (b *Builder) Build(ctx context.Context) (info Info, err error) {
+	if err = b.checkPatterns(); err != nil {
+		return
+	}
+	files, single, err := b.walk()
+	if err != nil {
+		return
+	}
+	var total int64
+	for i := range files {
+		files[i].offset = total
+		total += files[i].length
+	}
+	pieceLength := b.PieceLength
+	if pieceLength == 0 {
+		pieceLength = ChoosePieceLength(total)
+	}
+	numPieces := int((total + pieceLength - 1) / pieceLength)
+	state := buildResumeState{
+		PieceLength: pieceLength,
+		Files:       resumeFiles(files),
+		Pieces:      make([]byte, numPieces*HashSize),
+		Hashed:      make([]byte, numPieces),
+	}
+	if resumed, ok := b.loadResume(state); ok {
+		state = resumed
+	}
+	pieceLen := func(i int) int64 {
+		if i == numPieces-1 {
+			return total - int64(i)*pieceLength
+		}
+		return pieceLength
+	}
+	progress := BuildProgress{
+		TotalPieces: numPieces,
+		TotalBytes:  total,
+	}
+	var todo []int
+	for i := 0; i < numPieces; i++ {
+		if state.Hashed[i] != 0 {
+			progress.PiecesHashed++
+			progress.BytesHashed += pieceLen(i)
+		} else {
+			todo = append(todo, i)
+		}
+	}
+	workers := b.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu      sync.Mutex
+		hashErr error
+	)
+	pieces := make(chan int)
+	hashed := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := builderReader{files: files}
+			defer r.close()
+			buf := make([]byte, pieceLength)
+			for i := range pieces {
+				buf := buf[:pieceLen(i)]
+				if err := r.readAt(buf, int64(i)*pieceLength); err != nil {
+					mu.Lock()
+					if hashErr == nil {
+						hashErr = err
+					}
+					mu.Unlock()
+					cancel()
+					return
+				}
+				sum := sha1.Sum(buf)
+				mu.Lock()
+				copy(state.Pieces[i*HashSize:], sum[:])
+				state.Hashed[i] = 1
+				mu.Unlock()
+				select {
+				case hashed <- i:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(pieces)
+		for _, i := range todo {
+			select {
+			case pieces <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(hashed)
+	}()
+	resumeInterval := b.ResumeInterval
+	if resumeInterval <= 0 {
+		resumeInterval = 10 * time.Second
+	}
+	save := func() error {
+		if b.ResumePath == "" {
+			return nil
+		}
+		mu.Lock()
+		snapshot := buildResumeState{
+			PieceLength: state.PieceLength,
+			Files:       state.Files,
+			Pieces:      append([]byte(nil), state.Pieces...),
+			Hashed:      append([]byte(nil), state.Hashed...),
+		}
+		mu.Unlock()
+		err := b.saveResume(snapshot)
+		if err != nil {
+			err = fmt.Errorf("saving resume state: %w", err)
+		}
+		return err
+	}
+	var saveErr error
+	lastSave := time.Now()
+	for i := range hashed {
+		progress.PiecesHashed++
+		progress.BytesHashed += pieceLen(i)
+		if b.Progress != nil {
+			b.Progress(progress)
+		}
+		if saveErr == nil && time.Since(lastSave) >= resumeInterval {
+			saveErr = save()
+			if saveErr != nil {
+				// The build couldn't be resumed as requested.
+				cancel()
+			}
+			lastSave = time.Now()
+		}
+	}
+	if progress.PiecesHashed != numPieces {
+		err = hashErr
+		if err == nil {
+			err = saveErr
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		if saveErr == nil {
+			if saveErr = save(); saveErr != nil {
+				err = fmt.Errorf("%w (and %v)", err, saveErr)
+			}
+		}
+		return
+	}
+	if b.ResumePath != "" {
+		os.Remove(b.ResumePath)
+	}
+	info.PieceLength = pieceLength
+	info.Pieces = state.Pieces
+	info.Private = b.Private
+	info.Source = b.Source
+	if single {
+		info.Name = filepath.Base(b.Root)
+		info.Length = total
+		return
+	}
+	info.Name = func() string {
+		switch name := filepath.Base(b.Root); name {
+		case ".", "..", string(filepath.Separator):
+			return NoName
+		default:
+			return name
+		}
+	}()
+	for _, f := range files {
+		info.Files = append(info.Files, FileInfo{
+			Path:   f.path,
+			Length: f.length,
+		})
+	}
+	return
+}
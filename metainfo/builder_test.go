@@ -0,0 +1,141 @@
+package metainfo
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeBuilderTestFiles(t *testing.T, root string, files map[string]int) {
+	r := rand.New(rand.NewSource(1))
+	for name, size := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		b := make([]byte, size)
+		r.Read(b)
+		require.NoError(t, os.WriteFile(p, b, 0o644))
+	}
+}
+
+func TestBuilderMatchesBuildFromFilePath(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	writeBuilderTestFiles(t, root, map[string]int{
+		"a":       1000,
+		"b/c":     5000,
+		"b/d":     1,
+		".hidden": 100,
+	})
+	var expected Info
+	expected.PieceLength = 1 << 10
+	require.NoError(t, expected.BuildFromFilePath(root))
+	actual, err := (&Builder{
+		Root:        root,
+		PieceLength: 1 << 10,
+		Workers:     3,
+	}).Build(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestBuilderFilters(t *testing.T) {
+	root := t.TempDir()
+	writeBuilderTestFiles(t, root, map[string]int{
+		"a.mkv":         10,
+		"a.nfo":         10,
+		"sub/b.mkv":     10,
+		"sample/c.mkv":  10,
+		".git/config":   10,
+		"sub/.d.mkv":    10,
+		"linked/target": 10,
+	})
+	require.NoError(t, os.Symlink(filepath.Join(root, "linked", "target"), filepath.Join(root, "e.mkv")))
+	paths := func(b Builder) (ret []string) {
+		b.Root = root
+		info, err := b.Build(context.Background())
+		require.NoError(t, err)
+		for _, f := range info.Files {
+			ret = append(ret, filepath.ToSlash(filepath.Join(f.Path...)))
+		}
+		return
+	}
+	assert.Equal(t,
+		[]string{"a.mkv", "sub/b.mkv"},
+		paths(Builder{
+			Include:    []string{"*.mkv"},
+			Exclude:    []string{"sample"},
+			SkipHidden: true,
+			Symlinks:   SymlinkSkip,
+		}))
+	assert.Equal(t,
+		[]string{"a.mkv", "e.mkv", "sample/c.mkv", "sub/.d.mkv", "sub/b.mkv"},
+		paths(Builder{Include: []string{"*.mkv"}}))
+	_, err := (&Builder{Root: root, Symlinks: SymlinkError}).Build(context.Background())
+	assert.Error(t, err)
+}
+
+func TestBuilderResume(t *testing.T) {
+	root := t.TempDir()
+	writeBuilderTestFiles(t, root, map[string]int{
+		"a": 10 << 10,
+		"b": 6 << 10,
+	})
+	resumePath := filepath.Join(t.TempDir(), "resume")
+	newBuilder := func() *Builder {
+		return &Builder{
+			Root:        root,
+			PieceLength: 1 << 10,
+			Workers:     1,
+			ResumePath:  resumePath,
+		}
+	}
+	expected, err := newBuilder().Build(context.Background())
+	require.NoError(t, err)
+	_, err = os.Stat(resumePath)
+	assert.True(t, os.IsNotExist(err))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := newBuilder()
+	b.Progress = func(p BuildProgress) {
+		if p.PiecesHashed == 5 {
+			cancel()
+		}
+	}
+	_, err = b.Build(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = os.Stat(resumePath)
+	require.NoError(t, err)
+
+	b = newBuilder()
+	var first *BuildProgress
+	b.Progress = func(p BuildProgress) {
+		if first == nil {
+			first = &p
+		}
+	}
+	actual, err := b.Build(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+	require.NotNil(t, first)
+	assert.Greater(t, first.PiecesHashed, 5)
+	assert.Equal(t, 16, first.TotalPieces)
+
+	// The build fails if progress can't be saved.
+	b = newBuilder()
+	b.ResumePath = filepath.Join(t.TempDir(), "missing", "resume")
+	b.ResumeInterval = time.Nanosecond
+	_, err = b.Build(context.Background())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Contains(t, err.Error(), "saving resume state")
+}
+
+func TestChoosePieceLength(t *testing.T) {
+	assert.EqualValues(t, 16<<10, ChoosePieceLength(0))
+	assert.EqualValues(t, 1<<20, ChoosePieceLength(1<<30))
+	assert.EqualValues(t, 16<<20, ChoosePieceLength(50<<40))
+}
@@ -0,0 +1,112 @@
+package metainfo
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Builds an Info from file data read from streams, such as entries of a tar archive or HTTP
+// responses, without needing the files on disk. Files are hashed as they're added, so their data
+// is only read once. To get the same Info as Info.BuildFromFilePath or Builder for the same files,
+// add them in order of their '/' joined paths.
+type StreamBuilder struct {
+	// The info name. For a single-file torrent, it's the file name.
+	Name        string
+	PieceLength int64
+	Private     *bool
+	Source      string
+
+	files  []FileInfo
+	single bool
+	pieces []byte
+	hash   hash.Hash
+	// Bytes hashed into the current piece.
+	pieceFill int64
+	finished  bool
+	// Set if a file's data couldn't be read completely, leaving the pieces unusable.
+	err error
+}
+
+// Reads length bytes from r as the data of the next file. A nil path makes a single-file torrent,
+// and must be the only file added. If reading fails, the builder can't be used any further.
+func (b *StreamBuilder) AddFile(path []string, r io.Reader, length int64) error {
+	if b.PieceLength <= 0 {
+		return errors.New("piece length must be positive")
+	}
+	if b.err != nil {
+		return fmt.Errorf("earlier file failed: %w", b.err)
+	}
+	if b.finished {
+		return errors.New("info already built")
+	}
+	if b.single || len(path) == 0 && len(b.files) != 0 {
+		return errors.New("a single-file torrent can only have one file")
+	}
+	if b.hash == nil {
+		b.hash = sha1.New()
+	}
+	remaining := length
+	for remaining != 0 {
+		n := b.PieceLength - b.pieceFill
+		if n > remaining {
+			n = remaining
+		}
+		written, err := io.CopyN(b.hash, r, n)
+		b.pieceFill += written
+		remaining -= written
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			b.err = fmt.Errorf("reading %q: %w", path, err)
+			return b.err
+		}
+		if b.pieceFill == b.PieceLength {
+			b.finishPiece()
+		}
+	}
+	b.single = len(path) == 0
+	b.files = append(b.files, FileInfo{
+		Path:   append([]string(nil), path...),
+		Length: length,
+	})
+	return nil
+}
+
+func (b *StreamBuilder) finishPiece() {
+	b.pieces = b.hash.Sum(b.pieces)
+	b.hash.Reset()
+	b.pieceFill = 0
+}
+
+// Returns the Info for the files added. No more files can be added after it's called.
+func (b *StreamBuilder) Info() (info Info, err error) {
+	if b.err != nil {
+		err = fmt.Errorf("earlier file failed: %w", b.err)
+		return
+	}
+	if len(b.files) == 0 {
+		err = errors.New("no files added")
+		return
+	}
+	if b.pieceFill != 0 {
+		b.finishPiece()
+	}
+	b.finished = true
+	info = Info{
+		PieceLength: b.PieceLength,
+		Pieces:      b.pieces,
+		Name:        b.Name,
+		Private:     b.Private,
+		Source:      b.Source,
+	}
+	if b.single {
+		info.Length = b.files[0].Length
+	} else {
+		info.Files = b.files
+	}
+	return
+}
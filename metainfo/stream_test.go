@@ -0,0 +1,63 @@
+package metainfo
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamBuilderMatchesBuildFromFilePath(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	writeBuilderTestFiles(t, root, map[string]int{
+		"a":   1000,
+		"b/c": 5000,
+		"b/d": 1,
+		"e":   0,
+	})
+	var expected Info
+	expected.PieceLength = 1 << 10
+	require.NoError(t, expected.BuildFromFilePath(root))
+	b := StreamBuilder{
+		Name:        "root",
+		PieceLength: 1 << 10,
+	}
+	for _, fi := range expected.Files {
+		data, err := os.ReadFile(filepath.Join(root, filepath.Join(fi.Path...)))
+		require.NoError(t, err)
+		require.NoError(t, b.AddFile(fi.Path, bytes.NewReader(data), int64(len(data))))
+	}
+	actual, err := b.Info()
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+	assert.Error(t, b.AddFile([]string{"f"}, strings.NewReader("x"), 1))
+}
+
+func TestStreamBuilderSingleFile(t *testing.T) {
+	b := StreamBuilder{
+		Name:        "file",
+		PieceLength: 2,
+	}
+	require.NoError(t, b.AddFile(nil, strings.NewReader("hello"), 5))
+	assert.Error(t, b.AddFile(nil, strings.NewReader("x"), 1))
+	info, err := b.Info()
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, info.Length)
+	assert.Nil(t, info.Files)
+	assert.Equal(t, 3, info.NumPieces())
+}
+
+func TestStreamBuilderShortReader(t *testing.T) {
+	b := StreamBuilder{PieceLength: 2}
+	assert.Error(t, b.AddFile([]string{"a"}, strings.NewReader("abc"), 4))
+	// The partly hashed file leaves the builder unusable.
+	err := b.AddFile([]string{"b"}, strings.NewReader("d"), 1)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, err = b.Info()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
@@ -34,6 +34,32 @@ func (ms *MMapSpan) Close() (errs []error) {
 	return
 }
 
+// Unmaps the current regions, and then calls f with IO blocked. The regions returned by f are used
+// from then on, such as when the underlying files have been moved. If unmapping fails, f is passed
+// the error, and should only map the files again where they are, so the span isn't left without
+// regions. If f returns an error, the span is left with whatever regions were returned.
+func (ms *MMapSpan) Remap(f func(unmapErr error) ([]mmap.MMap, error)) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var unmapErr error
+	for _, mMap := range ms.mMaps {
+		if err := mMap.Unmap(); err != nil && unmapErr == nil {
+			unmapErr = err
+		}
+	}
+	mMaps, err := f(unmapErr)
+	ms.mMaps = mMaps
+	ms.InitIndex()
+	return err
+}
+
+// Calls f while remapping is blocked, such as when it uses the files that are mapped.
+func (ms *MMapSpan) WithReadLock(f func()) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	f()
+}
+
 func (me *MMapSpan) InitIndex() {
 	i := 0
 	me.segmentLocater = segments.NewIndex(func() (segments.Length, bool) {
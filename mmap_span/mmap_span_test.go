@@ -0,0 +1,27 @@
+package mmap_span
+
+import (
+	"testing"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemapAfterUnmapFails(t *testing.T) {
+	var ms MMapSpan
+	// This wasn't mapped by mmap, so unmapping it fails.
+	ms.Append(make(mmap.MMap, 4))
+	ms.InitIndex()
+	var passedErr error
+	err := ms.Remap(func(unmapErr error) ([]mmap.MMap, error) {
+		passedErr = unmapErr
+		return []mmap.MMap{mmap.MMap("abcd")}, unmapErr
+	})
+	require.Error(t, passedErr)
+	assert.Equal(t, passedErr, err)
+	b := make([]byte, 4)
+	n, err := ms.ReadAt(b, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", string(b[:n]))
+}
@@ -3,6 +3,7 @@ package torrent
 import (
 	"github.com/anacrolix/dht/v2/krpc"
 
+	"github.com/anacrolix/torrent/geoip"
 	"github.com/anacrolix/torrent/peer_protocol"
 )
 
@@ -16,6 +17,9 @@ type PeerInfo struct {
 	peer_protocol.PexPeerFlags
 	// Whether we can ignore poor or bad behaviour from the peer.
 	Trusted bool
+	// The country and autonomous system of the peer's IP, if ClientConfig.GeoIP is set. It's
+	// filled in when the peer is added to a Torrent.
+	Geo geoip.Record
 }
 
 func (me PeerInfo) equal(other PeerInfo) bool {
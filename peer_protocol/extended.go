@@ -28,6 +28,8 @@ type (
 const (
 	// http://www.bittorrent.org/beps/bep_0011.html
 	ExtensionNamePex ExtensionName = "ut_pex"
+	// Retracts a previous have, as implemented by libtorrent. The payload is the 4 byte piece index.
+	ExtensionNameDontHave ExtensionName = "lt_donthave"
 
 	ExtensionDeleteNumber ExtensionNumber = 0
 )
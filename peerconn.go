@@ -3,6 +3,7 @@ package torrent
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -21,6 +22,7 @@ import (
 
 	"github.com/anacrolix/chansync"
 	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/geoip"
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/mse"
 	pp "github.com/anacrolix/torrent/peer_protocol"
@@ -75,6 +77,8 @@ type Peer struct {
 	// Set true after we've added our ConnStats generated during handshake to
 	// other ConnStat instances as determined when the *Torrent became known.
 	reconciledHandshakeStats bool
+	// Aggregate stats for the peer's country, if it's known.
+	countryStats *ConnStats
 
 	lastMessageReceived     time.Time
 	completedHandshake      time.Time
@@ -88,12 +92,16 @@ type Peer struct {
 	cancelledRequests    roaring.Bitmap
 	lastBecameInterested time.Time
 	priorInterest        time.Duration
+	// Sizes the number of outstanding requests from measured latency and throughput.
+	requestWindow requestWindow
 
 	lastStartedExpectingToReceiveChunks time.Time
 	cumulativeExpectedToReceiveChunks   time.Duration
 	_chunksReceivedWhileExpecting       int64
 
-	choking                                bool
+	choking bool
+	// When we last choked the peer. Zero if we never have, since connections start choked.
+	lastChokeSent                          time.Time
 	piecesReceivedSinceLastRequestUpdate   maxRequests
 	maxPiecesReceivedBetweenRequestUpdates maxRequests
 	// Chunks that we might reasonably expect to receive from the peer. Due to
@@ -137,6 +145,11 @@ type PeerConn struct {
 	// See BEP 3 etc.
 	PeerID             PeerID
 	PeerExtensionBytes pp.PeerExtensionBits
+	// The client identified from PeerID, if it follows a known convention. The extended handshake
+	// version is in PeerClientName.
+	PeerIDClient PeerIDClient
+	// The country and autonomous system of the peer's IP, if ClientConfig.GeoIP is set.
+	PeerGeo geoip.Record
 
 	// The actual Conn, used for closing, and setting socket options. Do not use methods on this
 	// while holding any mutexes.
@@ -364,12 +377,13 @@ func (cn *Peer) writeStatus(w io.Writer, t *Torrent) {
 		prioStr += ": " + err.Error()
 	}
 	fmt.Fprintf(w, "    bep40-prio: %v\n", prioStr)
-	fmt.Fprintf(w, "    last msg: %s, connected: %s, last helpful: %s, itime: %s, etime: %s\n",
+	fmt.Fprintf(w, "    last msg: %s, connected: %s, last helpful: %s, itime: %s, etime: %s, min rtt: %s\n",
 		eventAgeString(cn.lastMessageReceived),
 		eventAgeString(cn.completedHandshake),
 		eventAgeString(cn.lastHelpful()),
 		cn.cumInterest(),
 		cn.totalExpectingTime(),
+		cn.requestWindow.minRtt,
 	)
 	fmt.Fprintf(w,
 		"    %s completed, %d pieces touched, good chunks: %v/%v:%v reqq: %d-%v/(%d/%d):%d/%d, flags: %s, dr: %.1f KiB/s\n",
@@ -483,7 +497,11 @@ func (cn *PeerConn) requestedMetadataPiece(index int) bool {
 
 // The actual value to use as the maximum outbound requests.
 func (cn *Peer) nominalMaxRequests() (ret maxRequests) {
-	return maxRequests(clamp(1, int64(cn.PeerMaxRequests), 2048))
+	ret = cn.PeerMaxRequests
+	if queueTime := cn.t.cl.config.RequestQueueTime; queueTime > 0 {
+		ret = minInt(ret, cn.requestWindow.size(queueTime, int(cn.t.chunkSize)))
+	}
+	return maxRequests(clamp(1, int64(ret), 2048))
 }
 
 func (cn *Peer) totalExpectingTime() (ret time.Duration) {
@@ -511,6 +529,7 @@ func (cn *PeerConn) choke(msg messageWriter) (more bool) {
 		return true
 	}
 	cn.choking = true
+	cn.lastChokeSent = time.Now()
 	more = msg(pp.Message{
 		Type: pp.Choke,
 	})
@@ -618,7 +637,11 @@ func (cn *Peer) request(r RequestIndex) (more bool, err error) {
 		cn.validReceiveChunks = make(map[RequestIndex]int)
 	}
 	cn.validReceiveChunks[r]++
+	if cn.t.pendingRequests.Get(r) != 0 {
+		cn.allStats(add(1, func(cs *ConnStats) *Count { return &cs.DuplicateRequestsSent }))
+	}
 	cn.t.pendingRequests.Inc(r)
+	cn.requestWindow.onRequestSent(r, time.Now())
 	cn.updateExpectingChunks()
 	ppReq := cn.t.requestIndexToRequest(r)
 	for _, f := range cn.callbacks.SentRequest {
@@ -684,6 +707,25 @@ func (cn *PeerConn) have(piece pieceIndex) {
 	cn.sentHaves.Add(bitmap.BitIndex(piece))
 }
 
+// Retracts a have we sent for a piece we no longer have, if the peer supports it.
+func (cn *PeerConn) dontHave(piece pieceIndex) {
+	if !cn.sentHaves.Get(bitmap.BitIndex(piece)) {
+		return
+	}
+	id, ok := cn.PeerExtensionIDs[pp.ExtensionNameDontHave]
+	if !ok {
+		return
+	}
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(piece))
+	cn.write(pp.Message{
+		Type:            pp.Extended,
+		ExtendedID:      id,
+		ExtendedPayload: payload,
+	})
+	cn.sentHaves.Remove(bitmap.BitIndex(piece))
+}
+
 func (cn *PeerConn) postBitfield() {
 	if cn.sentHaves.Len() != 0 {
 		panic("bitfield must be first have-related message sent")
@@ -764,6 +806,27 @@ func (cn *PeerConn) peerSentHave(piece pieceIndex) error {
 	return nil
 }
 
+// The peer retracted a have for the piece.
+func (cn *PeerConn) peerSentDontHave(piece pieceIndex) error {
+	if !cn.t.haveInfo() {
+		return nil
+	}
+	if piece >= cn.t.numPieces() || piece < 0 {
+		return errors.New("invalid piece")
+	}
+	if !cn.peerHasPiece(piece) {
+		return nil
+	}
+	if cn.peerSentHaveAll {
+		cn.peerSentHaveAll = false
+		cn._peerPieces.AddRange(0, uint64(cn.t.numPieces()))
+	}
+	cn.t.decPieceAvailability(piece)
+	cn._peerPieces.Remove(uint32(piece))
+	cn.peerPiecesChanged()
+	return nil
+}
+
 func (cn *PeerConn) peerSentBitfield(bf []bool) error {
 	if len(bf)%8 != 0 {
 		panic("expected bitfield length divisible by 8")
@@ -871,6 +934,9 @@ func (cn *Peer) postHandshakeStats(f func(*ConnStats)) {
 	t := cn.t
 	f(&t.stats)
 	f(&t.cl.stats)
+	if cn.countryStats != nil {
+		f(cn.countryStats)
+	}
 }
 
 // All ConnStats that include this connection. Some objects are not known
@@ -930,6 +996,13 @@ func (c *PeerConn) reject(r Request) {
 	delete(c.peerRequests, r)
 }
 
+// How long after we choke a peer its requests might have been sent before it saw the choke.
+const chokedRequestGrace = 10 * time.Second
+
+// Not necessarily the peer's fault: we can drop pieces from storage, and can't tell peers except by
+// reconnecting.
+var errRequestedMissingPiece = errors.New("peer requested piece we don't have")
+
 func (c *PeerConn) onReadRequest(r Request) error {
 	requestedChunkLengths.Add(strconv.FormatUint(r.Length.Uint64(), 10), 1)
 	if _, ok := c.peerRequests[r]; ok {
@@ -942,6 +1015,10 @@ func (c *PeerConn) onReadRequest(r Request) error {
 			torrent.Add("requests rejected while choking", 1)
 			c.reject(r)
 		}
+		// Requests sent before the peer saw our choke aren't its fault.
+		if time.Since(c.lastChokeSent) >= chokedRequestGrace {
+			c.t.cl.onPeerRequestRejected(c.remoteIp())
+		}
 		return nil
 	}
 	// TODO: What if they've already requested this?
@@ -950,6 +1027,7 @@ func (c *PeerConn) onReadRequest(r Request) error {
 		if c.fastEnabled() {
 			c.reject(r)
 		}
+		c.t.cl.onPeerRequestRejected(c.remoteIp())
 		// BEP 6 says we may close here if we choose.
 		return nil
 	}
@@ -958,7 +1036,7 @@ func (c *PeerConn) onReadRequest(r Request) error {
 		// from our storage, and can't communicate this to peers
 		// except by reconnecting.
 		requestsReceivedForMissingPieces.Add(1)
-		return fmt.Errorf("peer requested piece we don't have: %v", r.Index.Int())
+		return fmt.Errorf("%w: %v", errRequestedMissingPiece, r.Index.Int())
 	}
 	// Check this after we know we have the piece, so that the piece length will be known.
 	if r.Begin+r.Length > c.t.pieceLength(pieceIndex(r.Index)) {
@@ -970,7 +1048,9 @@ func (c *PeerConn) onReadRequest(r Request) error {
 	}
 	value := &peerRequestState{}
 	c.peerRequests[r] = value
-	go c.peerRequestDataReader(r, value)
+	c.t.cl.diskIo.submit(diskIoRead, int64(r.Length), func() {
+		c.peerRequestDataReader(r, value)
+	})
 	// c.tickleWriter()
 	return nil
 }
@@ -1041,7 +1121,7 @@ func runSafeExtraneous(f func()) {
 
 func (c *PeerConn) logProtocolBehaviour(level log.Level, format string, arg ...interface{}) {
 	c.logger.WithLevel(level).WithContextText(fmt.Sprintf(
-		"peer id %q, ext v %q", c.PeerID, c.PeerClientName,
+		"peer id %q (%v), ext v %q", c.PeerID, c.PeerIDClient, c.PeerClientName,
 	)).SkipCallers(1).Printf(format, arg...)
 }
 
@@ -1087,6 +1167,7 @@ func (c *PeerConn) mainReadLoop() (err error) {
 		messageTypesReceived.Add(msg.Type.String(), 1)
 		if msg.Type.FastExtension() && !c.fastEnabled() {
 			runSafeExtraneous(func() { torrent.Add("fast messages received when extension is disabled", 1) })
+			cl.onPeerProtocolViolation(c.remoteIp())
 			return fmt.Errorf("received fast extension message (type=%v) but extension is disabled", msg.Type)
 		}
 		switch msg.Type {
@@ -1201,6 +1282,9 @@ func (c *PeerConn) mainReadLoop() (err error) {
 			err = fmt.Errorf("received unknown message type: %#v", msg.Type)
 		}
 		if err != nil {
+			if !errors.Is(err, errPeerClientRejected) && !errors.Is(err, errRequestedMissingPiece) {
+				cl.onPeerProtocolViolation(c.remoteIp())
+			}
 			return err
 		}
 	}
@@ -1229,7 +1313,7 @@ func (c *Peer) decExpectedChunkReceive(r RequestIndex) {
 func (c *PeerConn) onReadExtendedMsg(id pp.ExtensionNumber, payload []byte) (err error) {
 	defer func() {
 		// TODO: Should we still do this?
-		if err != nil {
+		if err != nil && !errors.Is(err, errPeerClientRejected) {
 			// These clients use their own extension IDs for outgoing message
 			// types, which is incorrect.
 			if bytes.HasPrefix(c.PeerID[:], []byte("-SD0100-")) || strings.HasPrefix(string(c.PeerID[:]), "-XL0012-") {
@@ -1254,11 +1338,17 @@ func (c *PeerConn) onReadExtendedMsg(id pp.ExtensionNumber, payload []byte) (err
 			c.PeerMaxRequests = d.Reqq
 		}
 		c.PeerClientName = d.V
+		if cl.rejectPeerClient(c) {
+			return fmt.Errorf("%w: %v, ext v %q", errPeerClientRejected, c.PeerIDClient, c.PeerClientName)
+		}
 		if c.PeerExtensionIDs == nil {
 			c.PeerExtensionIDs = make(map[pp.ExtensionName]pp.ExtensionNumber, len(d.M))
 		}
 		c.PeerListenPort = d.Port
 		c.PeerPrefersEncryption = d.Encryption
+		if len(d.YourIp) != 0 {
+			cl.addExternalIpVote(ExternalIpSourcePeer, c.remoteIp().String(), c.remoteIp(), net.IP(d.YourIp))
+		}
 		for name, id := range d.M {
 			if _, ok := c.PeerExtensionIDs[name]; !ok {
 				peersSupportingExtension.Add(
@@ -1291,6 +1381,11 @@ func (c *PeerConn) onReadExtendedMsg(id pp.ExtensionNumber, payload []byte) (err
 			return nil // or hang-up maybe?
 		}
 		return c.pex.Recv(payload)
+	case dontHaveExtendedId:
+		if len(payload) != 4 {
+			return fmt.Errorf("unexpected lt_donthave payload length %v", len(payload))
+		}
+		return c.peerSentDontHave(pieceIndex(binary.BigEndian.Uint32(payload)))
 	default:
 		return fmt.Errorf("unexpected extended message ID: %v", id)
 	}
@@ -1344,6 +1439,7 @@ func (c *Peer) receiveChunk(msg *pp.Message) error {
 			for _, f := range c.callbacks.ReceivedRequested {
 				f(PeerMessageEvent{c, msg})
 			}
+			c.requestWindow.onChunkReceived(req, len(msg.Piece), time.Now())
 		}
 		// Request has been satisfied.
 		if c.deleteRequest(req) {
@@ -1367,6 +1463,7 @@ func (c *Peer) receiveChunk(msg *pp.Message) error {
 		// panic(fmt.Sprintf("%+v", ppReq))
 		chunksReceived.Add("wasted", 1)
 		c.allStats(add(1, func(cs *ConnStats) *Count { return &cs.ChunksReadWasted }))
+		c.allStats(add(int64(len(msg.Piece)), func(cs *ConnStats) *Count { return &cs.BytesReadWastedData }))
 		return nil
 	}
 
@@ -1390,28 +1487,48 @@ func (c *Peer) receiveChunk(msg *pp.Message) error {
 	// waiting for it to be written to storage.
 	piece.unpendChunkIndex(chunkIndexFromChunkSpec(ppReq.ChunkSpec, t.chunkSize))
 
-	// Cancel pending requests for this chunk from *other* peers.
+	// Cancel pending requests for this chunk from *other* peers. These are duplicates made in
+	// end-game mode.
 	t.iterPeers(func(p *Peer) {
 		if p == c {
 			return
 		}
+		if !p.actualRequestState.Requests.Contains(req) {
+			return
+		}
+		p.allStats(add(1, func(cs *ConnStats) *Count { return &cs.EndGameCancelsSent }))
 		p.cancel(req)
 	})
 
-	err := func() error {
-		cl.unlock()
-		defer cl.lock()
-		concurrentChunkWrites.Add(1)
-		defer concurrentChunkWrites.Add(-1)
-		// Write the chunk out. Note that the upper bound on chunk writing concurrency will be the
-		// number of connections. We write inline with receiving the chunk (with this lock dance),
-		// because we want to handle errors synchronously and I haven't thought of a nice way to
-		// defer any concurrency to the storage and have that notify the client of errors. TODO: Do
-		// that instead.
-		return t.writeChunk(int(msg.Index), int64(msg.Begin), msg.Piece)
-	}()
+	// The chunk buffer belongs to the write now, and is returned to the pool when it's done.
+	data := msg.Piece
+	msg.Piece = nil
+	cl.diskIo.submit(diskIoWrite, int64(len(data)), func() {
+		var err error
+		if !t.closed.IsSet() {
+			concurrentChunkWrites.Add(1)
+			err = t.writeChunk(int(ppReq.Index), int64(ppReq.Begin), data)
+			concurrentChunkWrites.Add(-1)
+		}
+		if len(data) == int(t.chunkSize) {
+			t.chunkPool.Put(&data)
+		}
+		cl.lock()
+		defer cl.unlock()
+		c.onChunkWritten(req, err)
+	})
+	return nil
+}
 
+// Completes receiving a chunk once it's been written to storage.
+func (c *Peer) onChunkWritten(req RequestIndex, err error) {
+	t := c.t
+	ppReq := t.requestIndexToRequest(req)
+	piece := &t.pieces[ppReq.Index]
 	piece.decrementPendingWrites()
+	if t.closed.IsSet() {
+		return
+	}
 
 	if err != nil {
 		c.logger.WithDefaultLevel(log.Error).Printf("writing received chunk %v: %v", req, err)
@@ -1421,7 +1538,7 @@ func (c *Peer) receiveChunk(msg *pp.Message) error {
 		// fresh update after pending the failed request.
 		c.updateRequests("Peer.receiveChunk error writing chunk")
 		t.onWriteChunkErr(err)
-		return nil
+		return
 	}
 
 	c.onDirtiedPiece(pieceIndex(ppReq.Index))
@@ -1435,11 +1552,9 @@ func (c *Peer) receiveChunk(msg *pp.Message) error {
 		// that chunk pieces are pended at an appropriate time later however.
 	}
 
-	cl.event.Broadcast()
+	t.cl.event.Broadcast()
 	// We do this because we've written a chunk, and may change PieceState.Partial.
 	t.publishPieceChange(pieceIndex(ppReq.Index))
-
-	return nil
 }
 
 func (c *Peer) onDirtiedPiece(piece pieceIndex) {
@@ -1542,6 +1657,7 @@ func (c *Peer) deleteRequest(r RequestIndex) bool {
 		return false
 	}
 	c.cancelledRequests.Remove(r)
+	c.requestWindow.onRequestDeleted(r)
 	for _, f := range c.callbacks.DeletedRequest {
 		f(PeerRequestEvent{c, c.t.requestIndexToRequest(r)})
 	}
@@ -1582,6 +1698,9 @@ func (c *PeerConn) setTorrent(t *Torrent) {
 	}
 	c.t = t
 	c.logger.WithDefaultLevel(log.Debug).Printf("set torrent=%v", t)
+	if country := c.PeerGeo.Country; country != "" {
+		c.countryStats = t.cl.countryConnStats(country)
+	}
 	t.reconcileHandshakeStats(c)
 }
 
@@ -1688,3 +1807,11 @@ func (p *Peer) TryAsPeerConn() (*PeerConn, bool) {
 func (pc *PeerConn) isLowOnRequests() bool {
 	return pc.actualRequestState.Requests.IsEmpty()
 }
+
+// The client name for aggregating statistics, without the version.
+func (p *Peer) clientTypeName() string {
+	if pc, ok := p.peerImpl.(*PeerConn); ok {
+		return pc.PeerIDClient.typeName()
+	}
+	return "webseed"
+}
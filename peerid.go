@@ -1,5 +1,11 @@
 package torrent
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 // Peer client ID.
 type PeerID [20]byte
 
@@ -12,3 +18,260 @@ type PeerID [20]byte
 // 	// return hex.EncodeToString(me[:])
 // 	return fmt.Sprintf("%+q", me[:])
 // }
+
+// A client identified by the conventions its peer ID follows. See BEP 20.
+type PeerIDClient struct {
+	// Such as "qBittorrent". Empty if the ID follows a convention, but the client isn't known.
+	Name string
+	// Such as "4.2.5". Empty if it can't be determined.
+	Version string
+	// The client code in the ID, such as "qB" for Azureus-style IDs.
+	Code string
+}
+
+// Such as "qBittorrent 4.2.5". Unknown clients are given by their code, and an unrecognised ID
+// gives the empty string.
+func (me PeerIDClient) String() string {
+	name := me.Name
+	if name == "" {
+		name = me.Code
+	}
+	if me.Version == "" {
+		return name
+	}
+	return name + " " + me.Version
+}
+
+// The client name for aggregating statistics, without the version.
+func (me PeerIDClient) typeName() string {
+	switch {
+	case me.Name != "":
+		return me.Name
+	case me.Code != "":
+		return "unknown " + me.Code
+	default:
+		return "unknown"
+	}
+}
+
+// Azureus-style IDs are '-', a two character client code, four version characters, then '-'.
+var azureusStyleClients = map[string]string{
+	"7T": "aTorrent",
+	"AB": "AnyEvent::BitTorrent",
+	"AG": "Ares",
+	"A~": "Ares",
+	"AR": "Arctic",
+	"AT": "Artemis",
+	"AV": "Avicora",
+	"AX": "BitPump",
+	"AZ": "Vuze",
+	"BB": "BitBuddy",
+	"BC": "BitComet",
+	"BE": "Baretorrent",
+	"BF": "Bitflu",
+	"BG": "BTG",
+	"BI": "BiglyBT",
+	"BL": "BitBlinder",
+	"BP": "BitTorrent Pro",
+	"BR": "BitRocket",
+	"BS": "BTSlave",
+	"BT": "BitTorrent",
+	"BW": "BitWombat",
+	"CD": "Enhanced CTorrent",
+	"CT": "CTorrent",
+	"DE": "Deluge",
+	"DP": "Propagate Data Client",
+	"EB": "EBit",
+	"ES": "Electric Sheep",
+	"FC": "FileCroc",
+	"FD": "Free Download Manager",
+	"FG": "FlashGet",
+	"FT": "FoxTorrent",
+	"FX": "Freebox BitTorrent",
+	"GR": "GetRight",
+	"GS": "GSTorrent",
+	"GT": "anacrolix/torrent",
+	"HK": "Hekate",
+	"HL": "Halite",
+	"HM": "hMule",
+	"HN": "Hydranode",
+	"IL": "iLivid",
+	"JS": "Justseed.it",
+	"JT": "JavaTorrent",
+	"KG": "KGet",
+	"KT": "KTorrent",
+	"LC": "LeechCraft",
+	"LH": "LH-ABC",
+	"LP": "Lphant",
+	"LT": "libtorrent",
+	"lt": "libTorrent (rakshasa)",
+	"LW": "LimeWire",
+	"MK": "Meerkat",
+	"MO": "MonoTorrent",
+	"MP": "MooPolice",
+	"MR": "Miro",
+	"MT": "MoonlightTorrent",
+	"NB": "Net::BitTorrent",
+	"NX": "Net Transport",
+	"OS": "OneSwarm",
+	"OT": "OmegaTorrent",
+	"PB": "Protocol::BitTorrent",
+	"PD": "Pando",
+	"PI": "PicoTorrent",
+	"qB": "qBittorrent",
+	"QD": "QQDownload",
+	"QT": "Qt 4 Torrent example",
+	"RT": "Retriever",
+	"RZ": "RezTorrent",
+	"S~": "Shareaza alpha/beta",
+	"SD": "Thunder",
+	"SM": "SoMud",
+	"SP": "BitSpirit",
+	"SS": "SwarmScope",
+	"ST": "SymTorrent",
+	"st": "sharktorrent",
+	"SZ": "Shareaza",
+	"TB": "Torch",
+	"TE": "terasaur Seed Bank",
+	"TL": "Tribler",
+	"TN": "TorrentDotNET",
+	"TR": "Transmission",
+	"TS": "Torrentstorm",
+	"TT": "TuoTu",
+	"UL": "uLeecher!",
+	"UM": "µTorrent for Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"VG": "Vagaa",
+	"WD": "WebTorrent Desktop",
+	"WT": "BitLet",
+	"WW": "WebTorrent",
+	"WY": "FireTorrent",
+	"XF": "Xfplay",
+	"XL": "Xunlei",
+	"XS": "XSwifter",
+	"XT": "XanTorrent",
+	"XX": "Xtorrent",
+	"ZT": "ZipTorrent",
+}
+
+// Shadow-style IDs are a client character, up to five version characters, then "---".
+var shadowStyleClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow's client",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// Returns the value of a version character, where letters continue from the digits.
+func peerIdVersionDigit(c byte) (int, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0'), true
+	case 'A' <= c && c <= 'Z':
+		return int(c-'A') + 10, true
+	case 'a' <= c && c <= 'z':
+		return int(c-'a') + 36, true
+	case c == '.':
+		return 62, true
+	case c == '-':
+		return 63, true
+	}
+	return 0, false
+}
+
+func isDigits(s string) bool {
+	for _, c := range []byte(s) {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func azureusStyleVersion(code, v string) string {
+	if code == "TR" && isDigits(v[:3]) {
+		// Transmission uses a major version, and a two digit minor version.
+		ret := fmt.Sprintf("%c.%s", v[0], v[1:3])
+		if v[3] == 'Z' || v[3] == 'X' {
+			ret += "+"
+		}
+		return ret
+	}
+	var parts []string
+	for i := 0; i < 3; i++ {
+		d, ok := peerIdVersionDigit(v[i])
+		if !ok || d > 35 {
+			return ""
+		}
+		parts = append(parts, strconv.Itoa(d))
+	}
+	// The last character is often a build number, or a letter for the release type.
+	if v[3] != '0' && isDigits(v[3:]) {
+		parts = append(parts, v[3:])
+	}
+	return strings.Join(parts, ".")
+}
+
+// Identifies the client that made the ID, from the conventions in BEP 20 and some others in use.
+func (me PeerID) Client() (ret PeerIDClient, ok bool) {
+	s := string(me[:])
+	switch {
+	case s[0] == '-' && s[7] == '-':
+		ret.Code = s[1:3]
+		ret.Name = azureusStyleClients[ret.Code]
+		ret.Version = azureusStyleVersion(ret.Code, s[3:7])
+		return ret, true
+	case s[0] == 'M' && mainlineVersion(s[1:8]) != "":
+		return PeerIDClient{Name: "BitTorrent", Version: mainlineVersion(s[1:8]), Code: "M"}, true
+	case strings.HasPrefix(s, "exbc"):
+		return PeerIDClient{Name: "BitComet", Version: fmt.Sprintf("%d.%02d", me[4], me[5]), Code: "exbc"}, true
+	case strings.HasPrefix(s, "XBT") && isDigits(s[3:6]):
+		return PeerIDClient{Name: "XBT Client", Version: strings.Join(strings.Split(s[3:6], ""), "."), Code: "XBT"}, true
+	case strings.HasPrefix(s, "TIX") && isDigits(s[3:7]):
+		major, _ := strconv.Atoi(s[3:5])
+		return PeerIDClient{Name: "Tixati", Version: fmt.Sprintf("%d.%s", major, s[5:7]), Code: "TIX"}, true
+	case strings.HasPrefix(s, "-ML"):
+		if end := strings.IndexByte(s[3:], '-'); end > 0 {
+			return PeerIDClient{Name: "MLDonkey", Version: s[3 : 3+end], Code: "ML"}, true
+		}
+	case strings.HasPrefix(s, "AZ2500BT"):
+		return PeerIDClient{Name: "BitTyrant", Code: "AZ2500BT"}, true
+	case strings.HasPrefix(s, "OP") && isDigits(s[2:6]):
+		return PeerIDClient{Name: "Opera", Version: s[2:6], Code: "OP"}, true
+	}
+	if name, isShadow := shadowStyleClients[s[0]]; isShadow {
+		end := strings.Index(s[1:9], "---")
+		if end < 0 {
+			return
+		}
+		var parts []string
+		for _, c := range []byte(s[1 : 1+end]) {
+			d, ok := peerIdVersionDigit(c)
+			if !ok {
+				return ret, false
+			}
+			parts = append(parts, strconv.Itoa(d))
+		}
+		return PeerIDClient{Name: name, Version: strings.Join(parts, "."), Code: s[:1]}, true
+	}
+	return
+}
+
+// Mainline IDs are 'M', then the major, minor and patch versions separated by '-', padded with '-'
+// to 8 characters, such as "M4-3-6--".
+func mainlineVersion(s string) string {
+	parts := strings.Split(strings.TrimRight(s, "-"), "-")
+	if len(parts) != 3 {
+		return ""
+	}
+	for _, p := range parts {
+		if !isDigits(p) {
+			return ""
+		}
+	}
+	return strings.Join(parts, ".")
+}
@@ -1,5 +1,12 @@
 package torrent
 
+import (
+	"testing"
+
+	"github.com/anacrolix/missinggo/v2"
+	"github.com/stretchr/testify/assert"
+)
+
 // func TestPeerIdString(t *testing.T) {
 // 	for _, _case := range []struct {
 // 		id string
@@ -14,3 +21,34 @@ package torrent
 // 		assert.EqualValues(t, fmt.Sprintf("%q", _case.s), fmt.Sprintf("%q", pi))
 // 	}
 // }
+
+func TestPeerIDClient(t *testing.T) {
+	for _, _case := range []struct {
+		id     string
+		client PeerIDClient
+		ok     bool
+	}{
+		{"-qB4250-abcdefghijkl", PeerIDClient{"qBittorrent", "4.2.5", "qB"}, true},
+		{"-TR2940-abcdefghijkl", PeerIDClient{"Transmission", "2.94", "TR"}, true},
+		{"-UT355W-abcdefghijkl", PeerIDClient{"µTorrent", "3.5.5", "UT"}, true},
+		{"-DE13F0-abcdefghijkl", PeerIDClient{"Deluge", "1.3.15", "DE"}, true},
+		{"-lt0D60-abcdefghijkl", PeerIDClient{"libTorrent (rakshasa)", "0.13.6", "lt"}, true},
+		{"-AZ5750-abcdefghijkl", PeerIDClient{"Vuze", "5.7.5", "AZ"}, true},
+		{"-ZZ1234-abcdefghijkl", PeerIDClient{"", "1.2.3.4", "ZZ"}, true},
+		{"S58B-----abcdefghijk", PeerIDClient{"Shadow's client", "5.8.11", "S"}, true},
+		{"T03I-----abcdefghijk", PeerIDClient{"BitTornado", "0.3.18", "T"}, true},
+		{"M4-3-6--abcdefghijkl", PeerIDClient{"BitTorrent", "4.3.6", "M"}, true},
+		{"XBT054d-abcdefghijkl", PeerIDClient{"XBT Client", "0.5.4", "XBT"}, true},
+		{"-ML2.7.2-kgjjfkd1234", PeerIDClient{"MLDonkey", "2.7.2", "ML"}, true},
+		{"exbc\x00\x38abcdefghijklmn", PeerIDClient{"BitComet", "0.56", "exbc"}, true},
+		{"\x1cNJ}\x9c\xc7\xc4o\x94<\x9b\x8c\xc2!I\x1c\a\xec\x98n", PeerIDClient{}, false},
+	} {
+		var id PeerID
+		missinggo.CopyExact(&id, _case.id)
+		client, ok := id.Client()
+		assert.Equal(t, _case.ok, ok, _case.id)
+		assert.Equal(t, _case.client, client, _case.id)
+	}
+	assert.Equal(t, "qBittorrent 4.2.5", PeerIDClient{"qBittorrent", "4.2.5", "qB"}.String())
+	assert.Equal(t, "ZZ 1.2.3.4", PeerIDClient{"", "1.2.3.4", "ZZ"}.String())
+}
@@ -160,20 +160,24 @@ func (p *Piece) bytesLeft() (ret pp.Integer) {
 func (p *Piece) VerifyData() {
 	p.t.cl.lock()
 	defer p.t.cl.unlock()
+	p.waitVerified(p.queueVerify())
+}
+
+// Queues the piece to be hashed, and returns the number of verifies to wait for.
+func (p *Piece) queueVerify() int64 {
 	target := p.numVerifies + 1
 	if p.hashing {
 		target++
 	}
-	// log.Printf("target: %d", target)
 	p.t.queuePieceCheck(p.index)
-	for {
-		// log.Printf("got %d verifies", p.numVerifies)
-		if p.numVerifies >= target {
-			break
-		}
+	return target
+}
+
+// Waits until the piece has been hashed target times, and the result has been applied.
+func (p *Piece) waitVerified(target int64) {
+	for p.numVerifies < target || p.marking {
 		p.t.cl.event.Wait()
 	}
-	// log.Print("done")
 }
 
 func (p *Piece) queuedForHash() bool {
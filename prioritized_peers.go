@@ -7,11 +7,13 @@ import (
 	"github.com/google/btree"
 )
 
-// Peers are stored with their priority at insertion. Their priority may
-// change if our apparent IP changes, we don't currently handle that.
+// Peers are stored with their priority and dial failures at insertion. Their priority changes if
+// our external IP changes, which is handled by prioritizedPeers.Reprioritize.
 type prioritizedPeersItem struct {
 	prio peerPriority
-	p    PeerInfo
+	// Peers that have failed to connect fewer times are dialed first.
+	dialFailures int
+	p            PeerInfo
 }
 
 var hashSeed = maphash.MakeSeed()
@@ -26,7 +28,8 @@ func (me prioritizedPeersItem) addrHash() int64 {
 func (me prioritizedPeersItem) Less(than btree.Item) bool {
 	other := than.(prioritizedPeersItem)
 	return multiless.New().Bool(
-		me.p.Trusted, other.p.Trusted).Uint32(
+		me.p.Trusted, other.p.Trusted).Int(
+		other.dialFailures, me.dialFailures).Uint32(
 		me.prio, other.prio).Int64(
 		me.addrHash(), other.addrHash(),
 	).Less()
@@ -35,6 +38,16 @@ func (me prioritizedPeersItem) Less(than btree.Item) bool {
 type prioritizedPeers struct {
 	om      *btree.BTree
 	getPrio func(PeerInfo) peerPriority
+	// Optional.
+	getDialFailures func(PeerInfo) int
+}
+
+func (me *prioritizedPeers) item(p PeerInfo) (ret prioritizedPeersItem) {
+	ret = prioritizedPeersItem{prio: me.getPrio(p), p: p}
+	if me.getDialFailures != nil {
+		ret.dialFailures = me.getDialFailures(p)
+	}
+	return
 }
 
 func (me *prioritizedPeers) Each(f func(PeerInfo)) {
@@ -50,12 +63,12 @@ func (me *prioritizedPeers) Len() int {
 
 // Returns true if a peer is replaced.
 func (me *prioritizedPeers) Add(p PeerInfo) bool {
-	return me.om.ReplaceOrInsert(prioritizedPeersItem{me.getPrio(p), p}) != nil
+	return me.om.ReplaceOrInsert(me.item(p)) != nil
 }
 
 // Returns true if a peer is replaced.
 func (me *prioritizedPeers) AddReturningReplacedPeer(p PeerInfo) (ret PeerInfo, ok bool) {
-	item := me.om.ReplaceOrInsert(prioritizedPeersItem{me.getPrio(p), p})
+	item := me.om.ReplaceOrInsert(me.item(p))
 	if item == nil {
 		return
 	}
@@ -74,6 +87,18 @@ func (me *prioritizedPeers) DeleteMin() (ret prioritizedPeersItem, ok bool) {
 	return
 }
 
+// Recomputes the priority of every peer, such as after our external IP changes.
+func (me *prioritizedPeers) Reprioritize() {
+	var ps []PeerInfo
+	me.Each(func(p PeerInfo) {
+		ps = append(ps, p)
+	})
+	me.om.Clear(true)
+	for _, p := range ps {
+		me.om.ReplaceOrInsert(me.item(p))
+	}
+}
+
 func (me *prioritizedPeers) PopMax() PeerInfo {
 	return me.om.DeleteMax().(prioritizedPeersItem).p
 }
@@ -0,0 +1,99 @@
+package torrent
+
+import (
+	"time"
+)
+
+const (
+	// The request window to use before a download rate has been measured.
+	initialRequestWindow = 32
+	// The smallest request window we'll shrink to, so that a peer that's gone quiet can still
+	// demonstrate it's improved.
+	minRequestWindow = 4
+	// How long to accumulate received bytes before taking a download rate sample.
+	requestWindowRateSampleInterval = time.Second
+	// The minimum RTT observed over this period is used as the link latency. Samples include time
+	// spent queued behind other requests at the peer, so the minimum is the best estimate.
+	requestWindowMinRttPeriod = 30 * time.Second
+	// Weight given to each new download rate sample.
+	requestWindowRateAlpha = 0.3
+)
+
+// Measures request round-trip times and download rate for a peer, to size the number of
+// outstanding requests to the bandwidth-delay product of the link. This is similar to libtorrent's
+// request queue time.
+type requestWindow struct {
+	// When each outstanding request was sent.
+	sentTimes map[RequestIndex]time.Time
+
+	minRtt        time.Duration
+	minRttExpires time.Time
+
+	// Bytes received since sampleStart. The sample restarts when there are no outstanding requests,
+	// so idle time doesn't count against the rate.
+	sampleBytes int64
+	sampleStart time.Time
+	// Exponentially weighted download rate in bytes per second. Zero if there's no sample yet.
+	rate float64
+}
+
+func (me *requestWindow) onRequestSent(r RequestIndex, now time.Time) {
+	if me.sentTimes == nil {
+		me.sentTimes = make(map[RequestIndex]time.Time)
+	}
+	me.sentTimes[r] = now
+	if me.sampleStart.IsZero() {
+		me.sampleStart = now
+	}
+}
+
+func (me *requestWindow) onRequestDeleted(r RequestIndex) {
+	delete(me.sentTimes, r)
+	if len(me.sentTimes) == 0 {
+		me.sampleBytes = 0
+		me.sampleStart = time.Time{}
+	}
+}
+
+// Called when a chunk for a request we made arrives. Must be called before the request is deleted.
+func (me *requestWindow) onChunkReceived(r RequestIndex, size int, now time.Time) {
+	if sent, ok := me.sentTimes[r]; ok {
+		me.addRttSample(now.Sub(sent), now)
+	}
+	if me.sampleStart.IsZero() {
+		return
+	}
+	me.sampleBytes += int64(size)
+	elapsed := now.Sub(me.sampleStart)
+	if elapsed < requestWindowRateSampleInterval {
+		return
+	}
+	sample := float64(me.sampleBytes) / elapsed.Seconds()
+	if me.rate == 0 {
+		me.rate = sample
+	} else {
+		me.rate += requestWindowRateAlpha * (sample - me.rate)
+	}
+	me.sampleBytes = 0
+	me.sampleStart = now
+}
+
+func (me *requestWindow) addRttSample(rtt time.Duration, now time.Time) {
+	if me.minRtt == 0 || rtt < me.minRtt || now.After(me.minRttExpires) {
+		me.minRtt = rtt
+		me.minRttExpires = now.Add(requestWindowMinRttPeriod)
+	}
+}
+
+// Returns the number of outstanding requests that would keep the link busy for the RTT plus
+// queueTime, given the measured download rate.
+func (me *requestWindow) size(queueTime time.Duration, chunkSize int) int {
+	if me.rate == 0 {
+		return initialRequestWindow
+	}
+	ret := int(me.rate * (me.minRtt + queueTime).Seconds() / float64(chunkSize))
+	if ret < minRequestWindow {
+		ret = minRequestWindow
+	}
+	return ret
+}
@@ -0,0 +1,33 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRequestWindowSizesToBandwidthDelayProduct(t *testing.T) {
+	c := qt.New(t)
+	var rw requestWindow
+	c.Check(rw.size(time.Second, defaultChunkSize), qt.Equals, initialRequestWindow)
+	start := time.Unix(0, 0)
+	// Keeps the rate sample running.
+	rw.onRequestSent(1000, start)
+	// A 100ms link delivering a chunk every 10ms, for 1 second.
+	for i := 0; i < 100; i++ {
+		now := start.Add(time.Duration(i+1) * 10 * time.Millisecond)
+		rw.onRequestSent(RequestIndex(i), now.Add(-100*time.Millisecond))
+		rw.onChunkReceived(RequestIndex(i), defaultChunkSize, now)
+		rw.onRequestDeleted(RequestIndex(i))
+	}
+	c.Check(rw.minRtt, qt.Equals, 100*time.Millisecond)
+	// 100 chunks per second, over 1.1 seconds.
+	c.Check(rw.size(time.Second, defaultChunkSize), qt.Equals, 110)
+}
+
+func TestRequestWindowMinimum(t *testing.T) {
+	var rw requestWindow
+	rw.rate = 1
+	qt.Assert(t, rw.size(time.Second, defaultChunkSize), qt.Equals, minRequestWindow)
+}
@@ -182,6 +182,9 @@ func (p *Peer) getDesiredRequestState() (desired desiredRequestState) {
 			break
 		}
 	}
+	// Whether there's a wanted chunk that isn't outstanding with any peer. If there isn't, we're in
+	// end-game mode.
+	haveUnrequested := false
 	request_strategy.GetRequestablePieces(
 		input,
 		func(t *request_strategy.Torrent, rsp *request_strategy.Piece, pieceIndex int) {
@@ -189,14 +192,17 @@ func (p *Peer) getDesiredRequestState() (desired desiredRequestState) {
 				return
 			}
 			if !p.peerHasPiece(pieceIndex) {
+				if !haveUnrequested {
+					haveUnrequested = p.t.pieceHasUnrequestedChunks(pieceIndex, rsp)
+				}
 				return
 			}
 			allowedFast := p.peerAllowedFast.ContainsInt(pieceIndex)
 			rsp.IterPendingChunks.Iter(func(ci request_strategy.ChunkIndex) {
 				r := p.t.pieceRequestIndexOffset(pieceIndex) + ci
-				//if p.t.pendingRequests.Get(r) != 0 && !p.actualRequestState.Requests.Contains(r) {
-				//	return
-				//}
+				if p.t.pendingRequests.Get(r) == 0 {
+					haveUnrequested = true
+				}
 				if !allowedFast {
 					// We must signal interest to request this
 					desired.Interested = true
@@ -214,6 +220,7 @@ func (p *Peer) getDesiredRequestState() (desired desiredRequestState) {
 		},
 	)
 	p.t.assertPendingRequests()
+	requestHeap.requestIndexes = p.filterDuplicateRequests(requestHeap.requestIndexes, !haveUnrequested)
 	heap.Init(&requestHeap)
 	for requestHeap.Len() != 0 && len(desired.Requests) < p.nominalMaxRequests() {
 		requestIndex := heap.Pop(&requestHeap).(RequestIndex)
@@ -222,6 +229,57 @@ func (p *Peer) getDesiredRequestState() (desired desiredRequestState) {
 	return
 }
 
+// Removes requests that are already outstanding with other peers. In end-game mode, a bounded
+// number of duplicates are permitted so that the last chunks aren't held up by a single slow peer.
+// The first copy to arrive causes the others to be cancelled in Peer.receiveChunk.
+func (p *Peer) filterDuplicateRequests(rs []RequestIndex, endGame bool) []RequestIndex {
+	maxDuplicates := 0
+	if endGame {
+		maxDuplicates = p.t.cl.config.MaxEndGameDuplicateRequests
+	}
+	filtered := rs[:0]
+	for _, r := range rs {
+		others := p.t.pendingRequests.Get(r)
+		if p.actualRequestState.Requests.Contains(r) {
+			others--
+		}
+		if others > maxDuplicates {
+			continue
+		}
+		filtered = append(filtered, r)
+	}
+	return filtered
+}
+
+// Whether any of the piece's wanted chunks aren't outstanding with any peer.
+func (t *Torrent) pieceHasUnrequestedChunks(piece pieceIndex, rsp *request_strategy.Piece) (ret bool) {
+	rsp.IterPendingChunks.Iter(func(ci request_strategy.ChunkIndex) {
+		if !ret && t.pendingRequests.Get(t.pieceRequestIndexOffset(piece)+ci) == 0 {
+			ret = true
+		}
+	})
+	return
+}
+
+// Returns true if every wanted chunk of the torrent has been requested from at least one peer,
+// which is when duplicate requests may be issued.
+func (t *Torrent) inEndGame() bool {
+	if !t.haveInfo() || t._pendingPieces.IsEmpty() || t.cl.config.MaxEndGameDuplicateRequests <= 0 {
+		return false
+	}
+	ret := true
+	t._pendingPieces.Iterate(func(x uint32) bool {
+		p := t.piece(pieceIndex(x))
+		p.undirtiedChunksIter.Iter(func(ci chunkIndexType) {
+			if t.pendingRequests.Get(p.requestIndexOffset()+ci) == 0 {
+				ret = false
+			}
+		})
+		return ret
+	})
+	return ret
+}
+
 func (p *Peer) maybeUpdateActualRequestState() bool {
 	if p.needRequestUpdate == "" {
 		return true
@@ -256,7 +314,12 @@ func (p *Peer) applyRequestState(next desiredRequestState) bool {
 	if !more {
 		return false
 	}
+	diskBacklogged := p.t.cl.diskIo.backlogged()
 	for _, req := range next.Requests {
+		if diskBacklogged && !current.Requests.Contains(req) {
+			// Storage is behind, so don't request more data until it catches up.
+			continue
+		}
 		if p.cancelledRequests.Contains(req) {
 			// Waiting for a reject or piece message, which will suitably trigger us to update our
 			// requests, so we can skip this one with no additional consideration.
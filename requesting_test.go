@@ -3,8 +3,10 @@ package torrent
 import (
 	"testing"
 
-	pp "github.com/anacrolix/torrent/peer_protocol"
 	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+	pp "github.com/anacrolix/torrent/peer_protocol"
 )
 
 func keysAsSlice(m map[Request]struct{}) (sl []Request) {
@@ -40,3 +42,23 @@ func TestRequestMapOrderAcrossInstances(t *testing.T) {
 	// This shows that different map instances with the same contents can have the same range order.
 	qt.Assert(t, keysAsSlice(makeTypicalRequests()), qt.ContentEquals, keysAsSlice(makeTypicalRequests()))
 }
+
+func TestFilterDuplicateRequestsEndGame(t *testing.T) {
+	c := qt.New(t)
+	var cl Client
+	cl.init(TestingConfig(t))
+	cl.config.MaxEndGameDuplicateRequests = 1
+	tor := cl.newTorrent(metainfo.Hash{}, nil)
+	tor.pendingRequests.Init(4)
+	p := Peer{t: tor}
+	// Request 1 is ours, request 2 is outstanding with one other peer, and request 3 with two.
+	p.actualRequestState.Requests.Add(1)
+	tor.pendingRequests.Inc(1)
+	tor.pendingRequests.Inc(2)
+	tor.pendingRequests.Inc(3)
+	tor.pendingRequests.Inc(3)
+	c.Check(p.filterDuplicateRequests([]RequestIndex{0, 1, 2, 3}, false), qt.DeepEquals, []RequestIndex{0, 1})
+	c.Check(p.filterDuplicateRequests([]RequestIndex{0, 1, 2, 3}, true), qt.DeepEquals, []RequestIndex{0, 1, 2})
+	cl.config.MaxEndGameDuplicateRequests = 0
+	c.Check(p.filterDuplicateRequests([]RequestIndex{0, 1, 2, 3}, true), qt.DeepEquals, []RequestIndex{0, 1})
+}
@@ -0,0 +1,242 @@
+package torrent
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Re-hashes completed pieces in the background, one at a time and at a limited rate, to find data
+// that has been corrupted in storage. Each torrent is scrubbed in passes from the first piece to the
+// last, and its first pass starts an interval after it's first seen. Scrub hashes count against the
+// piece hashing limits, and run on the disk IO workers.
+type scrubber struct {
+	cl       *Client
+	state    scrubState
+	lastSave time.Time
+}
+
+type scrubState struct {
+	// By hex infohash.
+	Torrents map[string]scrubTorrentState `bencode:"torrents"`
+}
+
+type scrubTorrentState struct {
+	// The next piece to check in the current pass.
+	NextPiece int `bencode:"next piece"`
+	// When the last pass finished, in Unix seconds.
+	LastPass int64 `bencode:"last pass"`
+}
+
+const (
+	// How often scrub progress is persisted while a pass is in progress.
+	scrubStateSaveInterval = 30 * time.Second
+	// How long to wait for piece hashing to make room for a scrub hash.
+	scrubHashRoomWait = time.Second
+)
+
+func (me *scrubber) load() {
+	var state scrubState
+	defer func() {
+		if state.Torrents == nil {
+			state.Torrents = make(map[string]scrubTorrentState)
+		}
+		me.cl.lock()
+		me.state = state
+		me.cl.unlock()
+	}()
+	path := me.cl.config.ScrubStatePath
+	if path == "" {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = bencode.Unmarshal(b, &state)
+	}
+	if err != nil {
+		me.cl.logger.Printf("error loading scrub state: %v", err)
+	}
+}
+
+// Discards the progress for a torrent that has been dropped. The client lock must be held.
+func (me *scrubber) forget(infoHash metainfo.Hash) {
+	delete(me.state.Torrents, infoHash.HexString())
+}
+
+// The client lock must be held.
+func (me *scrubber) save() {
+	path := me.cl.config.ScrubStatePath
+	if path == "" {
+		return
+	}
+	me.lastSave = time.Now()
+	b, err := bencode.Marshal(me.state)
+	if err == nil {
+		err = os.WriteFile(path, b, 0o644)
+	}
+	if err != nil {
+		me.cl.logger.Printf("error saving scrub state: %v", err)
+	}
+}
+
+func (me *scrubber) run() {
+	me.load()
+	save := func() {
+		me.cl.lock()
+		defer me.cl.unlock()
+		me.save()
+	}
+	closed := me.cl.closed.Done()
+	for {
+		t, piece, device, wait := me.next()
+		if t == nil {
+			select {
+			case <-closed:
+				save()
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+		length := me.scrubPiece(t, piece, device)
+		if time.Since(me.lastSave) >= scrubStateSaveInterval {
+			save()
+		}
+		var delay time.Duration
+		if rate := me.cl.config.ScrubRate; rate > 0 {
+			delay = time.Duration(length) * time.Second / time.Duration(rate)
+		}
+		select {
+		case <-closed:
+			save()
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Returns the next piece to scrub, or how long to wait before trying again. If a piece is returned,
+// it has been counted as a running piece hash against device.
+func (me *scrubber) next() (t *Torrent, piece pieceIndex, device string, wait time.Duration) {
+	cl := me.cl
+	cl.lock()
+	defer cl.unlock()
+	interval := cl.config.ScrubInterval
+	// Torrents that finished a pass in this call, which might be due again already.
+	finished := make(map[*Torrent]bool)
+	for {
+		now := time.Now()
+		wait = time.Minute
+		if interval < wait {
+			wait = interval
+		}
+		t = nil
+		var tState scrubTorrentState
+		for _, candidate := range cl.torrents {
+			if !candidate.haveInfo() || candidate.storage == nil || candidate.closed.IsSet() || finished[candidate] {
+				continue
+			}
+			key := candidate.infoHash.HexString()
+			s, ok := me.state.Torrents[key]
+			if !ok {
+				s.LastPass = now.Unix()
+				me.state.Torrents[key] = s
+			}
+			if due := time.Unix(s.LastPass, 0).Add(interval); due.After(now) {
+				if due.Sub(now) < wait {
+					wait = due.Sub(now)
+				}
+				continue
+			}
+			if t == nil || s.LastPass < tState.LastPass {
+				t = candidate
+				tState = s
+			}
+		}
+		if t == nil {
+			return
+		}
+		key := t.infoHash.HexString()
+		for piece = tState.NextPiece; piece < t.numPieces(); piece++ {
+			p := t.piece(piece)
+			if t.pieceComplete(piece) && !p.hashing && !p.queuedForHash() && !p.marking {
+				tState.NextPiece = piece
+				me.state.Torrents[key] = tState
+				device = t.hashDevice
+				if !cl.pieceHashes.haveRoom(device, cl.config.PieceHashers, cl.config.PieceHashersPerDevice) {
+					return nil, 0, "", scrubHashRoomWait
+				}
+				cl.pieceHashes.started(device)
+				return
+			}
+		}
+		// The pass is finished.
+		finished[t] = true
+		me.state.Torrents[key] = scrubTorrentState{LastPass: now.Unix()}
+		me.save()
+	}
+}
+
+// Hashes the piece, and marks it not complete if it's corrupt. Returns the length of the piece.
+func (me *scrubber) scrubPiece(t *Torrent, piece pieceIndex, device string) int64 {
+	cl := me.cl
+	var (
+		sum    metainfo.Hash
+		err    error
+		closed bool
+	)
+	hashed := make(chan struct{})
+	cl.diskIo.submit(diskIoHash, 0, func() {
+		defer close(hashed)
+		t.storageLock.RLock()
+		defer t.storageLock.RUnlock()
+		if t.closed.IsSet() {
+			closed = true
+			return
+		}
+		sum, err = t.hashPiece(piece)
+	})
+	<-hashed
+	if err == io.EOF {
+		err = nil
+	}
+	cl.lock()
+	defer cl.unlock()
+	cl.pieceHashes.finished(device)
+	cl.startPieceHashes()
+	if closed {
+		return 0
+	}
+	key := t.infoHash.HexString()
+	if s, ok := me.state.Torrents[key]; ok && s.NextPiece == piece {
+		s.NextPiece++
+		me.state.Torrents[key] = s
+	}
+	p := t.piece(piece)
+	if t.closed.IsSet() || !t.pieceComplete(piece) || p.hashing || p.marking {
+		return int64(t.pieceLength(piece))
+	}
+	piecesScrubbed.Add(1)
+	passed := err == nil && sum == *p.hash
+	if !passed {
+		piecesScrubbedFailed.Add(1)
+		t.logger.Printf("piece %d failed scrub (read error: %v), marking it not complete", piece, err)
+		p.Storage().MarkNotComplete()
+		t.updatePieceCompletion(piece)
+	}
+	for _, f := range cl.config.Callbacks.ScrubbedPiece {
+		f(ScrubbedPieceEvent{
+			Torrent: t,
+			Piece:   piece,
+			Passed:  passed,
+			Err:     err,
+		})
+	}
+	return int64(t.pieceLength(piece))
+}
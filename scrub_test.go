@@ -0,0 +1,139 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/internal/testutil"
+)
+
+func TestScrubberMarksCorruptPiecesIncomplete(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	cfg := TestingConfig(t)
+	cfg.DataDir = dir
+	cfg.ScrubInterval = time.Millisecond
+	cfg.ScrubRate = 0
+	cfg.ScrubStatePath = filepath.Join(t.TempDir(), "scrub")
+	events := make(chan ScrubbedPieceEvent, 100)
+	cfg.Callbacks.ScrubbedPiece = append(cfg.Callbacks.ScrubbedPiece, func(e ScrubbedPieceEvent) {
+		select {
+		case events <- e:
+		default:
+		}
+	})
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	<-tt.GotInfo()
+	numPieces := tt.NumPieces()
+	passed := 0
+	for passed < numPieces {
+		e := <-events
+		require.True(t, e.Passed)
+		passed++
+	}
+	require.NoError(t, os.WriteFile(
+		filepath.Join(dir, testutil.GreetingFileName),
+		[]byte("J"+testutil.GreetingFileContents[1:]),
+		0o644))
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Passed {
+				continue
+			}
+			assert.EqualValues(t, 0, e.Piece)
+			assert.False(t, tt.PieceState(0).Complete)
+			cl.Close()
+			b, err := os.ReadFile(cfg.ScrubStatePath)
+			require.NoError(t, err)
+			var state scrubState
+			require.NoError(t, bencode.Unmarshal(b, &state))
+			assert.Contains(t, state.Torrents, tt.InfoHash().HexString())
+			return
+		case <-timeout:
+			t.Fatal("corrupt piece wasn't found")
+		}
+	}
+}
+
+func TestScrubberWaitsForPieceHashRoom(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	cfg := TestingConfig(t)
+	cfg.DataDir = dir
+	cfg.PieceHashers = 1
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	// Scrub by hand, rather than with the Client's scrubber.
+	cl.config.ScrubInterval = time.Millisecond
+	tt, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	psc := tt.SubscribePieceStateChanges()
+	defer psc.Close()
+	<-tt.GotInfo()
+	// Wait for the initial check to finish, so that it isn't using the hash room.
+	idle := func() bool {
+		cl.lock()
+		defer cl.unlock()
+		for i := 0; i < tt.numPieces(); i++ {
+			p := tt.piece(i)
+			if !tt.pieceComplete(i) || p.hashing || p.queuedForHash() || p.marking {
+				return false
+			}
+		}
+		return cl.pieceHashes.running == 0
+	}
+	for !idle() {
+		<-psc.Values
+	}
+	s := scrubber{cl: cl}
+	s.load()
+	cl.lock()
+	s.state.Torrents[tt.InfoHash().HexString()] = scrubTorrentState{}
+	cl.pieceHashes.started("")
+	cl.unlock()
+	got, _, _, wait := s.next()
+	assert.Nil(t, got)
+	assert.Equal(t, scrubHashRoomWait, wait)
+	cl.lock()
+	cl.pieceHashes.finished("")
+	cl.unlock()
+	got, piece, device, _ := s.next()
+	require.Equal(t, tt, got)
+	s.scrubPiece(got, piece, device)
+	cl.lock()
+	assert.Equal(t, 0, cl.pieceHashes.running)
+	cl.unlock()
+}
+
+func TestScrubberForgetsDroppedTorrents(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	cfg := TestingConfig(t)
+	cfg.DataDir = dir
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	key := tt.InfoHash().HexString()
+	cl.lock()
+	cl.scrubber.state.Torrents = map[string]scrubTorrentState{key: {NextPiece: 1}}
+	cl.unlock()
+	tt.Drop()
+	cl.lock()
+	assert.NotContains(t, cl.scrubber.state.Torrents, key)
+	cl.unlock()
+}
@@ -19,13 +19,21 @@ const (
 	boltDbIncompleteValue = "i"
 )
 
-var completionBucketKey = []byte("completion")
+var (
+	completionBucketKey = []byte("completion")
+	filePathsBucketKey  = []byte("file paths")
+	fileStampsBucketKey = []byte("file stamps")
+)
 
 type boltPieceCompletion struct {
 	db *bbolt.DB
 }
 
-var _ PieceCompletion = (*boltPieceCompletion)(nil)
+var (
+	_ PieceCompletion = (*boltPieceCompletion)(nil)
+	_ FilePathStore   = (*boltPieceCompletion)(nil)
+	_ FileStampStore  = (*boltPieceCompletion)(nil)
+)
 
 func NewBoltPieceCompletion(dir string) (ret PieceCompletion, err error) {
 	os.MkdirAll(dir, 0o750)
@@ -92,6 +100,86 @@ func (me boltPieceCompletion) Set(pk metainfo.PieceKey, b bool) error {
 	})
 }
 
+func (me boltPieceCompletion) GetFilePaths(ih metainfo.Hash) (ret map[int]string, err error) {
+	ret = make(map[int]string)
+	err = me.db.View(func(tx *bbolt.Tx) error {
+		fpb := tx.Bucket(filePathsBucketKey)
+		if fpb == nil {
+			return nil
+		}
+		ihb := fpb.Bucket(ih[:])
+		if ihb == nil {
+			return nil
+		}
+		return ihb.ForEach(func(k, v []byte) error {
+			ret[int(binary.BigEndian.Uint32(k))] = string(v)
+			return nil
+		})
+	})
+	return
+}
+
+func (me boltPieceCompletion) SetFilePath(ih metainfo.Hash, fileIndex int, path string) error {
+	return me.db.Update(func(tx *bbolt.Tx) error {
+		fpb, err := tx.CreateBucketIfNotExists(filePathsBucketKey)
+		if err != nil {
+			return err
+		}
+		ihb, err := fpb.CreateBucketIfNotExists(ih[:])
+		if err != nil {
+			return err
+		}
+		var key [4]byte
+		binary.BigEndian.PutUint32(key[:], uint32(fileIndex))
+		return ihb.Put(key[:], []byte(path))
+	})
+}
+
+// Stamps are stored as the big-endian size followed by the modification time in Unix nanoseconds.
+func (me boltPieceCompletion) GetFileStamps(ih metainfo.Hash) (ret map[int]FileStamp, err error) {
+	ret = make(map[int]FileStamp)
+	err = me.db.View(func(tx *bbolt.Tx) error {
+		fsb := tx.Bucket(fileStampsBucketKey)
+		if fsb == nil {
+			return nil
+		}
+		ihb := fsb.Bucket(ih[:])
+		if ihb == nil {
+			return nil
+		}
+		return ihb.ForEach(func(k, v []byte) error {
+			if len(v) != 16 {
+				return nil
+			}
+			ret[int(binary.BigEndian.Uint32(k))] = FileStamp{
+				Size:    int64(binary.BigEndian.Uint64(v[:8])),
+				ModTime: time.Unix(0, int64(binary.BigEndian.Uint64(v[8:]))),
+			}
+			return nil
+		})
+	})
+	return
+}
+
+func (me boltPieceCompletion) SetFileStamp(ih metainfo.Hash, fileIndex int, stamp FileStamp) error {
+	return me.db.Update(func(tx *bbolt.Tx) error {
+		fsb, err := tx.CreateBucketIfNotExists(fileStampsBucketKey)
+		if err != nil {
+			return err
+		}
+		ihb, err := fsb.CreateBucketIfNotExists(ih[:])
+		if err != nil {
+			return err
+		}
+		var key [4]byte
+		binary.BigEndian.PutUint32(key[:], uint32(fileIndex))
+		var value [16]byte
+		binary.BigEndian.PutUint64(value[:8], uint64(stamp.Size))
+		binary.BigEndian.PutUint64(value[8:], uint64(stamp.ModTime.UnixNano()))
+		return ihb.Put(key[:], value[:])
+	})
+}
+
 func (me *boltPieceCompletion) Close() error {
 	return me.db.Close()
 }
@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"io"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/anacrolix/missinggo/v2"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+type CacheOpts struct {
+	// The most piece data to hold in memory, across all torrents. Pieces are evicted least recently
+	// used first. Dirty pieces are written to the backing storage when they're evicted.
+	Capacity int64
+}
+
+// Wraps storage with an in-memory cache of piece data. Chunk writes are held in memory and written
+// to the backing storage as whole pieces when they're marked complete, and pieces are hashed from
+// memory where possible. Complete pieces that are read are loaded entirely, so they can be served
+// to many peers without going to the backing storage again.
+func NewCache(backing ClientImpl, opts CacheOpts) ClientImplCloser {
+	return &cacheClientImpl{
+		backing: backing,
+		cache: &pieceCache{
+			capacity: opts.Capacity,
+			lru:      list.New(),
+		},
+	}
+}
+
+type cacheClientImpl struct {
+	backing ClientImpl
+	cache   *pieceCache
+}
+
+func (me *cacheClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
+	backing, err := me.backing.OpenTorrent(info, infoHash)
+	if err != nil {
+		return TorrentImpl{}, err
+	}
+	t := &cacheTorrent{
+		cache:   me.cache,
+		backing: backing,
+		entries: make([]cacheEntry, info.NumPieces()),
+	}
+	for i := range t.entries {
+		t.entries[i].t = t
+	}
+	ret := backing
+	ret.Piece = t.Piece
+	ret.Close = t.Close
+	return ret, nil
+}
+
+// Closes the backing storage if it supports it.
+func (me *cacheClientImpl) Close() error {
+	if c, ok := me.backing.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// A byte-bounded LRU of piece data shared by all torrents in a cache.
+type pieceCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List
+}
+
+// Marks the entry as recently used, adding it to the cache if it was evicted. Returns entries that
+// must be evicted to stay within capacity. The caller must hold the entry's lock, and must not hold
+// it while evicting.
+func (me *pieceCache) touch(e *cacheEntry) (evict []*cacheEntry) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if e.elem == nil {
+		e.elem = me.lru.PushFront(e)
+		me.size += int64(len(e.data))
+	} else {
+		me.lru.MoveToFront(e.elem)
+	}
+	for me.size > me.capacity {
+		back := me.lru.Back()
+		if back == e.elem {
+			break
+		}
+		victim := me.lru.Remove(back).(*cacheEntry)
+		victim.elem = nil
+		me.size -= int64(len(victim.data))
+		evict = append(evict, victim)
+	}
+	return
+}
+
+// Removes the entry from the LRU. The caller must hold the entry's lock.
+func (me *pieceCache) remove(e *cacheEntry) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if e.elem == nil {
+		return
+	}
+	me.lru.Remove(e.elem)
+	e.elem = nil
+	me.size -= int64(len(e.data))
+}
+
+func evictCacheEntries(es []*cacheEntry) {
+	for _, e := range es {
+		e.evict()
+	}
+}
+
+type cacheTorrent struct {
+	cache   *pieceCache
+	backing TorrentImpl
+	entries []cacheEntry
+}
+
+func (t *cacheTorrent) Piece(p metainfo.Piece) PieceImpl {
+	return &cachePiece{
+		e:       &t.entries[p.Index()],
+		p:       p,
+		backing: t.backing.Piece(p),
+	}
+}
+
+// Writes out all dirty pieces, and releases the cached data before closing the backing storage.
+func (t *cacheTorrent) Close() error {
+	for i := range t.entries {
+		e := &t.entries[i]
+		e.mu.Lock()
+		if e.data != nil {
+			t.cache.remove(e)
+			if err := e.flush(t.backing.Piece(e.piece)); err != nil {
+				log.Printf("error flushing cached piece %v: %v", e.piece.Index(), err)
+			}
+			e.drop()
+		}
+		e.mu.Unlock()
+	}
+	if t.backing.Close != nil {
+		return t.backing.Close()
+	}
+	return nil
+}
+
+type cacheExtent struct {
+	begin, end int64
+}
+
+// Cached data for a piece. The entry exists for the lifetime of the torrent, and data is nil when
+// the piece isn't in the cache.
+type cacheEntry struct {
+	t     *cacheTorrent
+	mu    sync.Mutex
+	piece metainfo.Piece
+	data  []byte
+	// The sorted, non-overlapping regions of data that are valid.
+	valid []cacheExtent
+	// Whether any valid data hasn't been written to the backing storage.
+	dirty bool
+	// The entry's position in the LRU. Nil when it's not in the cache, or is being evicted.
+	elem *list.Element
+}
+
+func (e *cacheEntry) full() bool {
+	return len(e.valid) == 1 && e.valid[0] == cacheExtent{0, int64(len(e.data))}
+}
+
+// Returns whether the extent is entirely valid.
+func (e *cacheEntry) covers(x cacheExtent) bool {
+	for _, v := range e.valid {
+		if v.begin <= x.begin && v.end >= x.end {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *cacheEntry) addValid(x cacheExtent) {
+	valid := append(e.valid, x)
+	sort.Slice(valid, func(i, j int) bool {
+		return valid[i].begin < valid[j].begin
+	})
+	merged := valid[:1]
+	for _, v := range valid[1:] {
+		last := &merged[len(merged)-1]
+		if v.begin <= last.end {
+			if v.end > last.end {
+				last.end = v.end
+			}
+		} else {
+			merged = append(merged, v)
+		}
+	}
+	e.valid = merged
+}
+
+// Writes the valid regions to the backing storage if they're dirty. Contiguous regions are written
+// together, so a complete piece is written all at once.
+func (e *cacheEntry) flush(backing PieceImpl) error {
+	if !e.dirty {
+		return nil
+	}
+	for _, v := range e.valid {
+		_, err := backing.WriteAt(e.data[v.begin:v.end], v.begin)
+		if err != nil {
+			return err
+		}
+	}
+	e.dirty = false
+	return nil
+}
+
+// Called once the entry has been removed from the LRU.
+func (e *cacheEntry) evict() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.elem != nil {
+		// It was used again after being chosen for eviction.
+		return
+	}
+	if err := e.flush(e.t.backing.Piece(e.piece)); err != nil {
+		log.Printf("error flushing evicted piece %v: %v", e.piece.Index(), err)
+	}
+	e.drop()
+}
+
+// Discards the cached data. The entry must not be in the LRU.
+func (e *cacheEntry) drop() {
+	e.data = nil
+	e.valid = nil
+	e.dirty = false
+}
+
+type cachePiece struct {
+	e       *cacheEntry
+	p       metainfo.Piece
+	backing PieceImpl
+}
+
+var (
+	_ PieceImpl   = (*cachePiece)(nil)
+	_ SelfHashing = (*cachePiece)(nil)
+)
+
+// Must be called with the entry locked. Allocates the entry's data if necessary, and returns the
+// entries to evict once the lock is released.
+func (me *cachePiece) use() []*cacheEntry {
+	e := me.e
+	if e.data == nil {
+		e.piece = me.p
+		e.data = make([]byte, me.p.Length())
+	}
+	return e.t.cache.touch(e)
+}
+
+func (me *cachePiece) WriteAt(b []byte, off int64) (n int, err error) {
+	e := me.e
+	e.mu.Lock()
+	evict := me.use()
+	n = copy(e.data[off:], b)
+	e.addValid(cacheExtent{off, off + int64(n)})
+	e.dirty = true
+	e.mu.Unlock()
+	evictCacheEntries(evict)
+	if n < len(b) {
+		err = io.ErrShortWrite
+	}
+	return
+}
+
+func (me *cachePiece) ReadAt(b []byte, off int64) (n int, err error) {
+	if off >= me.p.Length() {
+		return 0, io.EOF
+	}
+	x := cacheExtent{off, off + int64(len(b))}
+	if x.end > me.p.Length() {
+		x.end = me.p.Length()
+	}
+	e := me.e
+	e.mu.Lock()
+	evict, ok, err := me.load(x)
+	if ok {
+		n = copy(b, e.data[off:])
+		if n < len(b) {
+			err = io.EOF
+		}
+	}
+	e.mu.Unlock()
+	evictCacheEntries(evict)
+	if ok || err != nil {
+		return
+	}
+	return me.backing.ReadAt(b, off)
+}
+
+// Ensures the extent is in the cache if it's worth doing. Complete pieces are loaded entirely from
+// the backing storage. Otherwise dirty data is flushed so the caller can read from the backing
+// storage. Must be called with the entry locked.
+func (me *cachePiece) load(x cacheExtent) (evict []*cacheEntry, ok bool, err error) {
+	e := me.e
+	if e.data != nil && e.covers(x) {
+		return me.use(), true, nil
+	}
+	if !me.backing.Completion().Complete {
+		return nil, false, e.flush(me.backing)
+	}
+	if err = e.flush(me.backing); err != nil {
+		return
+	}
+	evict = me.use()
+	n, err := me.backing.ReadAt(e.data, 0)
+	if int64(n) == me.p.Length() {
+		err = nil
+	}
+	if err != nil {
+		e.t.cache.remove(e)
+		e.drop()
+		return
+	}
+	e.valid = []cacheExtent{{0, int64(n)}}
+	return evict, true, nil
+}
+
+// Hashes the piece from memory if it's entirely cached.
+func (me *cachePiece) SelfHash() (ret metainfo.Hash, err error) {
+	e := me.e
+	e.mu.Lock()
+	if e.data != nil && e.full() {
+		sum := sha1.Sum(e.data)
+		e.mu.Unlock()
+		missinggo.CopyExact(&ret, sum)
+		return
+	}
+	err = e.flush(me.backing)
+	e.mu.Unlock()
+	if err != nil {
+		return
+	}
+	return hashPieceImpl(me.backing, me.p.Length())
+}
+
+func (me *cachePiece) MarkComplete() error {
+	e := me.e
+	e.mu.Lock()
+	err := e.flush(me.backing)
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return me.backing.MarkComplete()
+}
+
+// Discards any cached data, since it's assumed to be bad.
+func (me *cachePiece) MarkNotComplete() error {
+	e := me.e
+	e.mu.Lock()
+	e.t.cache.remove(e)
+	e.drop()
+	e.mu.Unlock()
+	return me.backing.MarkNotComplete()
+}
+
+func (me *cachePiece) Completion() Completion {
+	return me.backing.Completion()
+}
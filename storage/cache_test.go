@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func newCacheTestTorrent(c *qt.C, capacity int64) (dir string, info *metainfo.Info, ts TorrentImpl) {
+	dir = c.TempDir()
+	ci := NewCache(NewFileOpts(NewFileClientOpts{
+		ClientBaseDir:   dir,
+		PieceCompletion: NewMapPieceCompletion(),
+	}), CacheOpts{Capacity: capacity})
+	c.Cleanup(func() { ci.Close() })
+	info = &metainfo.Info{
+		Name:        "a",
+		PieceLength: 4,
+		Length:      8,
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+	}
+	ts, err := ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	return
+}
+
+func TestCacheCoalescesWrites(t *testing.T) {
+	c := qt.New(t)
+	dir, info, ts := newCacheTestTorrent(c, 8)
+	p := ts.Piece(info.Piece(0))
+	_, err := p.WriteAt([]byte("cd"), 2)
+	c.Assert(err, qt.IsNil)
+	_, err = p.WriteAt([]byte("ab"), 0)
+	c.Assert(err, qt.IsNil)
+	_, err = os.Stat(filepath.Join(dir, "a"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+	sum, err := p.(SelfHashing).SelfHash()
+	c.Assert(err, qt.IsNil)
+	c.Check(sum, qt.Equals, metainfo.Hash(sha1.Sum([]byte("abcd"))))
+	c.Assert(p.MarkComplete(), qt.IsNil)
+	b, err := os.ReadFile(filepath.Join(dir, "a"))
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "abcd")
+}
+
+func TestCacheEvictsDirtyPieces(t *testing.T) {
+	c := qt.New(t)
+	dir, info, ts := newCacheTestTorrent(c, 4)
+	_, err := ts.Piece(info.Piece(0)).WriteAt([]byte("ab"), 0)
+	c.Assert(err, qt.IsNil)
+	_, err = ts.Piece(info.Piece(1)).WriteAt([]byte("ef"), 0)
+	c.Assert(err, qt.IsNil)
+	b, err := os.ReadFile(filepath.Join(dir, "a"))
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "ab")
+	c.Assert(ts.Close(), qt.IsNil)
+	b, err = os.ReadFile(filepath.Join(dir, "a"))
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "ab\x00\x00ef")
+}
+
+func TestCacheServesCompletePiecesFromMemory(t *testing.T) {
+	c := qt.New(t)
+	dir, info, ts := newCacheTestTorrent(c, 8)
+	p := ts.Piece(info.Piece(1))
+	_, err := p.WriteAt([]byte("efgh"), 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.MarkComplete(), qt.IsNil)
+	buf := make([]byte, 2)
+	_, err = p.ReadAt(buf, 2)
+	c.Assert(err, qt.IsNil)
+	c.Check(string(buf), qt.Equals, "gh")
+	n, err := p.ReadAt(buf, 4)
+	c.Check(n, qt.Equals, 0)
+	c.Check(err, qt.Equals, io.EOF)
+	// Changes behind the cache's back aren't seen.
+	c.Assert(os.WriteFile(filepath.Join(dir, "a"), make([]byte, 8), 0o666), qt.IsNil)
+	_, err = p.ReadAt(buf, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(string(buf), qt.Equals, "ef")
+	// Discarded data is read from the backing storage again.
+	c.Assert(p.MarkNotComplete(), qt.IsNil)
+	_, err = p.ReadAt(buf, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(buf, qt.DeepEquals, []byte{0, 0})
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/anacrolix/torrent/common"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/segments"
+)
+
+// Implemented by torrent storage that can give up the data of complete pieces.
+type pieceEvicter interface {
+	// Discards the piece's data and marks it not complete.
+	evictPiece(piece int)
+}
+
+type lruPieceKey struct {
+	t     pieceEvicter
+	piece int
+}
+
+type lruPiece struct {
+	lruPieceKey
+	length int64
+}
+
+// Bounds the space used by complete pieces across all torrents sharing a storage. When completing a
+// piece takes the total over capacity, the least recently accessed pieces are evicted.
+type pieceLru struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+	lru      *list.List
+	elems    map[lruPieceKey]*list.Element
+	// Given to torrents as their TorrentImpl.Capacity, so that the client only requests what fits.
+	capacityFunc func() (int64, bool)
+}
+
+func newPieceLru(capacity int64) *pieceLru {
+	ret := &pieceLru{
+		capacity: capacity,
+		lru:      list.New(),
+		elems:    make(map[lruPieceKey]*list.Element),
+	}
+	ret.capacityFunc = func() (int64, bool) {
+		return ret.capacity, true
+	}
+	return ret
+}
+
+func (me *pieceLru) torrentCapacity() TorrentCapacity {
+	return &me.capacityFunc
+}
+
+// Marks a complete piece as recently accessed.
+func (me *pieceLru) touch(t pieceEvicter, piece int) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if e, ok := me.elems[lruPieceKey{t, piece}]; ok {
+		me.lru.MoveToFront(e)
+	}
+}
+
+// Adds a piece that was completed previously. It's treated as the least recently accessed, and
+// nothing is evicted.
+func (me *pieceLru) addExisting(t pieceEvicter, piece int, length int64) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	key := lruPieceKey{t, piece}
+	if _, ok := me.elems[key]; ok {
+		return
+	}
+	me.elems[key] = me.lru.PushBack(lruPiece{key, length})
+	me.used += length
+}
+
+// Adds a newly completed piece as the most recently accessed, and evicts the least recently
+// accessed pieces until the total is within capacity.
+func (me *pieceLru) complete(t pieceEvicter, piece int, length int64) {
+	var victims []lruPiece
+	me.mu.Lock()
+	key := lruPieceKey{t, piece}
+	if e, ok := me.elems[key]; ok {
+		me.lru.MoveToFront(e)
+	} else {
+		me.elems[key] = me.lru.PushFront(lruPiece{key, length})
+		me.used += length
+	}
+	for me.used > me.capacity {
+		back := me.lru.Back()
+		if back == me.elems[key] {
+			break
+		}
+		victim := me.lru.Remove(back).(lruPiece)
+		delete(me.elems, victim.lruPieceKey)
+		me.used -= victim.length
+		victims = append(victims, victim)
+	}
+	me.mu.Unlock()
+	for _, v := range victims {
+		v.t.evictPiece(v.piece)
+	}
+}
+
+func (me *pieceLru) remove(t pieceEvicter, piece int) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	key := lruPieceKey{t, piece}
+	e, ok := me.elems[key]
+	if !ok {
+		return
+	}
+	me.lru.Remove(e)
+	delete(me.elems, key)
+	me.used -= e.Value.(lruPiece).length
+}
+
+// Stops tracking a torrent's pieces, such as when it's closed.
+func (me *pieceLru) removeTorrent(t pieceEvicter) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for key, e := range me.elems {
+		if key.t != t {
+			continue
+		}
+		me.lru.Remove(e)
+		delete(me.elems, key)
+		me.used -= e.Value.(lruPiece).length
+	}
+}
+
+// Adds the torrent's complete pieces.
+func (me *pieceLru) addTorrent(t pieceEvicter, info *metainfo.Info, infoHash metainfo.Hash, pc PieceCompletionGetSetter) {
+	for i := 0; i < info.NumPieces(); i++ {
+		c, err := pc.Get(metainfo.PieceKey{InfoHash: infoHash, Index: i})
+		if err != nil || !c.Ok || !c.Complete {
+			continue
+		}
+		me.addExisting(t, i, info.Piece(i).Length())
+	}
+}
+
+// Functions registered by the client to learn of piece completion changes made by the storage.
+type pieceCompletionSubscribers struct {
+	mu sync.Mutex
+	fs []func(piece int)
+}
+
+func (me *pieceCompletionSubscribers) Subscribe(f func(piece int)) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.fs = append(me.fs, f)
+}
+
+func (me *pieceCompletionSubscribers) notify(piece int) {
+	me.mu.Lock()
+	fs := me.fs
+	me.mu.Unlock()
+	for _, f := range fs {
+		f(piece)
+	}
+}
+
+var errPunchHoleUnsupported = errors.New("punching holes is not supported")
+
+// Frees the space used by a piece in each of the files it overlaps. skip is called for files that
+// shouldn't be touched. Returns the indexes of files that holes couldn't be punched in.
+func punchPieceHoles(
+	info *metainfo.Info, locater segments.Index, piece int, path func(file int) string, skip func(file int) bool,
+) (unsupported []int) {
+	p := info.Piece(piece)
+	locater.Locate(segments.Extent{Start: p.Offset(), Length: p.Length()}, func(i int, e segments.Extent) bool {
+		if e.Length == 0 || (skip != nil && skip(i)) {
+			return true
+		}
+		err := punchFileHole(path(i), e.Start, e.Length)
+		if errors.Is(err, errPunchHoleUnsupported) {
+			unsupported = append(unsupported, i)
+		} else if err != nil && !os.IsNotExist(err) {
+			log.Printf("error punching hole in %q: %v", path(i), err)
+		}
+		return true
+	})
+	return
+}
+
+func punchFileHole(name string, off, length int64) error {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = punchHole(f, off, length)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func newFileSegmentsIndex(info *metainfo.Info) segments.Index {
+	return segments.NewIndex(common.LengthIterFromUpvertedFiles(info.UpvertedFiles()))
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const capacityTestPieceLength = 1 << 14
+
+func testCapacityEviction(t *testing.T, ci ClientImplCloser) {
+	c := qt.New(t)
+	defer ci.Close()
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: capacityTestPieceLength,
+		Pieces:      make([]byte, 4*metainfo.HashSize),
+		Length:      4 * capacityTestPieceLength,
+	}
+	ts, err := ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	defer ts.Close()
+	c.Assert(ts.Capacity, qt.Not(qt.IsNil))
+	capacity, capped := (*ts.Capacity)()
+	c.Check(capped, qt.IsTrue)
+	c.Check(capacity, qt.Equals, int64(2*capacityTestPieceLength))
+	evicted := make(chan int, 4)
+	ts.SubscribePieceCompletion(func(piece int) {
+		evicted <- piece
+	})
+	data := bytes.Repeat([]byte{0xff}, capacityTestPieceLength)
+	complete := func(i int) {
+		p := ts.Piece(info.Piece(i))
+		_, err := p.WriteAt(data, 0)
+		c.Assert(err, qt.IsNil)
+		c.Assert(p.MarkComplete(), qt.IsNil)
+	}
+	complete(0)
+	complete(1)
+	c.Assert(len(evicted), qt.Equals, 0)
+	// Piece 0 becomes the most recently accessed.
+	_, err = ts.Piece(info.Piece(0)).ReadAt(make([]byte, 1), 0)
+	c.Assert(err, qt.IsNil)
+	complete(2)
+	c.Assert(len(evicted), qt.Equals, 1)
+	c.Check(<-evicted, qt.Equals, 1)
+	c.Check(ts.Piece(info.Piece(1)).Completion().Complete, qt.IsFalse)
+	c.Check(ts.Piece(info.Piece(0)).Completion().Complete, qt.IsTrue)
+	c.Check(ts.Piece(info.Piece(2)).Completion().Complete, qt.IsTrue)
+	// Pieces marked not complete no longer count.
+	c.Assert(ts.Piece(info.Piece(0)).MarkNotComplete(), qt.IsNil)
+	complete(3)
+	c.Check(len(evicted), qt.Equals, 0)
+}
+
+func TestFileCapacityEviction(t *testing.T) {
+	testCapacityEviction(t, NewFileOpts(NewFileClientOpts{
+		ClientBaseDir:   t.TempDir(),
+		PieceCompletion: NewMapPieceCompletion(),
+		Capacity:        2 * capacityTestPieceLength,
+	}))
+}
+
+func TestMMapCapacityEviction(t *testing.T) {
+	testCapacityEviction(t, NewMMapOpts(NewMMapClientOpts{
+		BaseDir:         t.TempDir(),
+		PieceCompletion: NewMapPieceCompletion(),
+		Capacity:        2 * capacityTestPieceLength,
+	}))
+}
+
+// Evicting a piece from a file with no other complete pieces frees its space, whether or not holes
+// can be punched.
+func TestFileCapacityEvictionFreesData(t *testing.T) {
+	c := qt.New(t)
+	ci := NewFileOpts(NewFileClientOpts{
+		ClientBaseDir:   t.TempDir(),
+		PieceCompletion: NewMapPieceCompletion(),
+		Capacity:        capacityTestPieceLength,
+	})
+	defer ci.Close()
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: capacityTestPieceLength,
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: capacityTestPieceLength},
+			{Path: []string{"b"}, Length: capacityTestPieceLength},
+		},
+	}
+	ts, err := ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	defer ts.Close()
+	data := bytes.Repeat([]byte{0xff}, capacityTestPieceLength)
+	for i := 0; i < 2; i++ {
+		p := ts.Piece(info.Piece(i))
+		_, err := p.WriteAt(data, 0)
+		c.Assert(err, qt.IsNil)
+		c.Assert(p.MarkComplete(), qt.IsNil)
+	}
+	b := make([]byte, capacityTestPieceLength)
+	n, _ := ts.Piece(info.Piece(0)).ReadAt(b, 0)
+	c.Check(bytes.Count(b[:n], []byte{0xff}), qt.Equals, 0)
+	c.Check(ts.Piece(info.Piece(1)).Completion().Complete, qt.IsTrue)
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+type EncryptedOpts struct {
+	// The key that each torrent's keys are derived from. It must be at least 16 bytes, and should be
+	// random.
+	MasterKey []byte
+}
+
+// Wraps storage so that piece data is encrypted before it reaches the backing storage. Each torrent
+// gets its own keys, derived from the master key and the infohash. Every 16 byte block of a piece is
+// encrypted with AES in XEX mode, with a tweak from the piece index and the block's offset, so data
+// can be read and written at any offset, and the stored size is unchanged. A partial block at the
+// end of a piece is encrypted with a keystream instead. Pieces are hashed from the decrypted data,
+// so the backing storage's own hashing isn't used.
+func NewEncrypted(backing ClientImpl, opts EncryptedOpts) (ClientImplCloser, error) {
+	if len(opts.MasterKey) < 16 {
+		return nil, errors.New("master key must be at least 16 bytes")
+	}
+	return &encryptedClientImpl{
+		backing:   backing,
+		masterKey: append([]byte(nil), opts.MasterKey...),
+	}, nil
+}
+
+type encryptedClientImpl struct {
+	backing   ClientImpl
+	masterKey []byte
+}
+
+func (me *encryptedClientImpl) deriveKey(label string, infoHash metainfo.Hash) []byte {
+	h := hmac.New(sha256.New, me.masterKey)
+	h.Write([]byte(label))
+	h.Write(infoHash[:])
+	return h.Sum(nil)
+}
+
+func (me *encryptedClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
+	data, err := aes.NewCipher(me.deriveKey("data", infoHash))
+	if err != nil {
+		return TorrentImpl{}, err
+	}
+	tweak, err := aes.NewCipher(me.deriveKey("tweak", infoHash))
+	if err != nil {
+		return TorrentImpl{}, err
+	}
+	backing, err := me.backing.OpenTorrent(info, infoHash)
+	if err != nil {
+		return TorrentImpl{}, err
+	}
+	t := &encryptedTorrent{
+		backing: backing,
+		data:    data,
+		tweak:   tweak,
+	}
+	ret := backing
+	ret.Piece = t.Piece
+	return ret, nil
+}
+
+// Closes the backing storage if it supports it.
+func (me *encryptedClientImpl) Close() error {
+	if c, ok := me.backing.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type encryptedTorrent struct {
+	backing TorrentImpl
+	data    cipher.Block
+	tweak   cipher.Block
+}
+
+func (t *encryptedTorrent) Piece(p metainfo.Piece) PieceImpl {
+	return &encryptedPiece{
+		t:       t,
+		p:       p,
+		backing: t.backing.Piece(p),
+	}
+}
+
+// Returns the tweak for the block at the given offset into a piece, which must be block aligned.
+func (t *encryptedTorrent) blockTweak(piece int, off int64) (ret [aes.BlockSize]byte) {
+	binary.BigEndian.PutUint64(ret[:8], uint64(piece))
+	binary.BigEndian.PutUint64(ret[8:], uint64(off/aes.BlockSize))
+	t.tweak.Encrypt(ret[:], ret[:])
+	return
+}
+
+// Encrypts or decrypts b in place. b starts at the block aligned offset into the piece, and only its
+// last block can be partial.
+func (t *encryptedTorrent) crypt(b []byte, piece int, off int64, encrypt bool) {
+	for len(b) != 0 {
+		tw := t.blockTweak(piece, off)
+		if len(b) < aes.BlockSize {
+			// There's no full block to encrypt, so use the encrypted tweak as a keystream.
+			t.data.Encrypt(tw[:], tw[:])
+			for i := range b {
+				b[i] ^= tw[i]
+			}
+			return
+		}
+		block := b[:aes.BlockSize]
+		for i := range block {
+			block[i] ^= tw[i]
+		}
+		if encrypt {
+			t.data.Encrypt(block, block)
+		} else {
+			t.data.Decrypt(block, block)
+		}
+		for i := range block {
+			block[i] ^= tw[i]
+		}
+		b = b[aes.BlockSize:]
+		off += aes.BlockSize
+	}
+}
+
+type encryptedPiece struct {
+	t       *encryptedTorrent
+	p       metainfo.Piece
+	backing PieceImpl
+}
+
+var _ PieceImpl = (*encryptedPiece)(nil)
+
+// Returns the block aligned extent of the piece that covers the given extent.
+func (me *encryptedPiece) alignedExtent(off, length int64) (begin, end int64) {
+	begin = off / aes.BlockSize * aes.BlockSize
+	end = (off + length + aes.BlockSize - 1) / aes.BlockSize * aes.BlockSize
+	if end > me.p.Length() {
+		end = me.p.Length()
+	}
+	return
+}
+
+func (me *encryptedPiece) ReadAt(b []byte, off int64) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	begin, end := me.alignedExtent(off, int64(len(b)))
+	if end <= off {
+		return 0, io.EOF
+	}
+	buf := make([]byte, end-begin)
+	bn, err := me.backing.ReadAt(buf, begin)
+	// Only whole blocks can be decrypted, except at the end of the piece.
+	usable := int64(bn)
+	if begin+usable < end {
+		usable = usable / aes.BlockSize * aes.BlockSize
+	}
+	me.t.crypt(buf[:usable], me.p.Index(), begin, false)
+	if usable > off-begin {
+		n = copy(b, buf[off-begin:usable])
+	}
+	if n < len(b) && err == nil {
+		err = io.EOF
+	}
+	if n == len(b) {
+		err = nil
+	}
+	return
+}
+
+// Blocks that are only partly written are read and decrypted first, so that they're encrypted
+// whole again.
+func (me *encryptedPiece) WriteAt(b []byte, off int64) (n int, err error) {
+	begin, end := me.alignedExtent(off, int64(len(b)))
+	buf := make([]byte, end-begin)
+	if begin != off || end != off+int64(len(b)) {
+		// The rest of the blocks is kept as it decrypts. Where nothing has been written, that's
+		// garbage, or zeroes past the end of the backing data, until that data is written too.
+		me.ReadAt(buf, begin)
+	}
+	n = copy(buf[off-begin:], b)
+	me.t.crypt(buf, me.p.Index(), begin, true)
+	_, err = me.backing.WriteAt(buf, begin)
+	if err != nil {
+		return 0, err
+	}
+	if n < len(b) {
+		err = io.ErrShortWrite
+	}
+	return
+}
+
+func (me *encryptedPiece) MarkComplete() error {
+	return me.backing.MarkComplete()
+}
+
+func (me *encryptedPiece) MarkNotComplete() error {
+	return me.backing.MarkNotComplete()
+}
+
+func (me *encryptedPiece) Completion() Completion {
+	return me.backing.Completion()
+}
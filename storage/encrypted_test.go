@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	ci, err := NewEncrypted(NewFile(dir), EncryptedOpts{MasterKey: []byte("0123456789abcdef")})
+	c.Assert(err, qt.IsNil)
+	defer ci.Close()
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 64,
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+		Length:      64 + 37,
+	}
+	ts, err := ci.OpenTorrent(info, metainfo.Hash{1})
+	c.Assert(err, qt.IsNil)
+	defer ts.Close()
+	data := make([]byte, info.Length)
+	rand.New(rand.NewSource(1)).Read(data)
+	// Writes at offsets that don't line up with blocks.
+	for _, x := range []struct{ off, end int64 }{{0, 20}, {20, 64}, {64, 64 + 5}, {64 + 5, 64 + 37}} {
+		p := info.Piece(int(x.off / info.PieceLength))
+		n, err := ts.Piece(p).WriteAt(data[x.off:x.end], x.off-p.Offset())
+		c.Assert(err, qt.IsNil)
+		c.Assert(n, qt.Equals, int(x.end-x.off))
+	}
+	stored, err := os.ReadFile(filepath.Join(dir, "t"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(stored, qt.HasLen, len(data))
+	c.Check(bytes.Equal(stored, data), qt.IsFalse)
+	for i := 0; i < info.NumPieces(); i++ {
+		p := info.Piece(i)
+		b, err := io.ReadAll(io.NewSectionReader(ts.Piece(p), 0, p.Length()))
+		c.Assert(err, qt.IsNil)
+		c.Check(b, qt.DeepEquals, data[p.Offset():p.Offset()+p.Length()])
+	}
+	b := make([]byte, 10)
+	n, err := ts.Piece(info.Piece(1)).ReadAt(b, 30)
+	c.Check(n, qt.Equals, 7)
+	c.Check(err, qt.Equals, io.EOF)
+	c.Check(b[:n], qt.DeepEquals, data[64+30:])
+
+	// Torrents get different keys.
+	ts2, err := ci.OpenTorrent(&metainfo.Info{
+		Name:        "u",
+		PieceLength: 64,
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+		Length:      64 + 37,
+	}, metainfo.Hash{2})
+	c.Assert(err, qt.IsNil)
+	defer ts2.Close()
+	_, err = ts2.Piece(info.Piece(0)).WriteAt(data[:64], 0)
+	c.Assert(err, qt.IsNil)
+	stored2, err := os.ReadFile(filepath.Join(dir, "u"))
+	c.Assert(err, qt.IsNil)
+	c.Check(bytes.Equal(stored[:64], stored2[:64]), qt.IsFalse)
+}
+
+func TestEncryptedRequiresKey(t *testing.T) {
+	_, err := NewEncrypted(NewMMap(t.TempDir()), EncryptedOpts{MasterKey: []byte("short")})
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
@@ -0,0 +1,55 @@
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+func freeDiskSpace(dir string) (free int64, ok bool, err error) {
+	_, free, ok, err = diskSpace(dir)
+	return
+}
+
+// Returns the size of the filesystem containing dir, and the space available to us on it.
+func diskSpace(dir string) (total, free int64, ok bool, err error) {
+	var stat unix.Statfs_t
+	err = unix.Statfs(dir, &stat)
+	if err != nil {
+		return
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), int64(stat.Bavail) * int64(stat.Bsize), true, nil
+}
+
+// Reserves blocks for the file up to length, falling back to extending the file if the filesystem
+// doesn't support fallocate.
+func allocateFull(f *os.File, size, length int64) error {
+	err := unix.Fallocate(int(f.Fd()), 0, size, length-size)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return f.Truncate(length)
+	}
+	return err
+}
+
+// Frees the blocks backing the region, keeping the file size.
+func punchHole(f *os.File, off, length int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, length)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return errPunchHoleUnsupported
+	}
+	return err
+}
+
+// Returns an identifier for the device containing path.
+func deviceId(path string) (string, bool) {
+	var stat unix.Stat_t
+	if unix.Stat(path, &stat) != nil {
+		return "", false
+	}
+	return strconv.FormatUint(uint64(stat.Dev), 10), true
+}
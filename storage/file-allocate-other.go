@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import (
+	"os"
+)
+
+// Free disk space isn't determined on this platform.
+func freeDiskSpace(dir string) (free int64, ok bool, err error) {
+	return
+}
+
+func diskSpace(dir string) (total, free int64, ok bool, err error) {
+	return
+}
+
+func allocateFull(f *os.File, size, length int64) error {
+	return f.Truncate(length)
+}
+
+func punchHole(f *os.File, off, length int64) error {
+	return errPunchHoleUnsupported
+}
+
+// Devices aren't identified on this platform.
+func deviceId(path string) (string, bool) {
+	return "", false
+}
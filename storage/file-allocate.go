@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Determines how file storage allocates space for files before data is written to them.
+type PreallocationMode int
+
+const (
+	// Files are created and extended as data is written to them.
+	PreallocateNone PreallocationMode = iota
+	// Files are truncated to their full size. On most filesystems this doesn't reserve any blocks.
+	PreallocateSparse
+	// Blocks are reserved for the full size of the file, using fallocate where it's available.
+	PreallocateFull
+)
+
+// Allocates space for a file, per the configured preallocation mode. Fails if there isn't enough
+// free space for the remainder of the file. Unwanted files are left alone, and allocated when they
+// become wanted.
+func (fs *fileTorrentImpl) AllocateFile(index int) error {
+	if fs.preallocation == PreallocateNone {
+		return nil
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.allocateFileLocked(index)
+}
+
+// fs.mu must be held. Allocations for the torrent are serialized, so that each sees the free space
+// left by the others.
+func (fs *fileTorrentImpl) allocateFileLocked(index int) (err error) {
+	if fs.preallocation == PreallocateNone || fs.unwanted != nil && fs.unwanted[index] {
+		return nil
+	}
+	fs.allocateMu.Lock()
+	defer fs.allocateMu.Unlock()
+	file := fs.files[index]
+	if file.length == 0 {
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(file.path), 0o777)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(file.path, os.O_WRONLY|os.O_CREATE, 0o666)
+	if err != nil {
+		return
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size() >= file.length {
+		return nil
+	}
+	need := file.length - fi.Size()
+	free, ok, err := freeDiskSpace(filepath.Dir(file.path))
+	if err != nil {
+		return fmt.Errorf("getting free disk space: %w", err)
+	}
+	if ok && free < need {
+		return fmt.Errorf(
+			"insufficient disk space for %q: need %v more bytes, have %v", file.path, need, free)
+	}
+	switch fs.preallocation {
+	case PreallocateSparse:
+		err = f.Truncate(file.length)
+	case PreallocateFull:
+		err = allocateFull(f, fi.Size(), file.length)
+	default:
+		return fmt.Errorf("unknown preallocation mode %v", fs.preallocation)
+	}
+	if err == nil {
+		fs.fileGrew(index, file.length)
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func testPreallocation(t *testing.T, mode PreallocationMode) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	cs := NewFileOpts(NewFileClientOpts{
+		ClientBaseDir:   dir,
+		PieceCompletion: NewMapPieceCompletion(),
+		Preallocation:   mode,
+	})
+	defer cs.Close()
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 1 << 20,
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 1 << 20},
+			{Path: []string{"b"}, Length: 1<<20 - 1},
+		},
+	}
+	ts, err := cs.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ts.AllocateFile(1), qt.IsNil)
+	fi, err := os.Stat(filepath.Join(dir, "t", "b"))
+	c.Assert(err, qt.IsNil)
+	c.Check(fi.Size(), qt.Equals, info.Files[1].Length)
+	_, err = os.Stat(filepath.Join(dir, "t", "a"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+	// Unwanted files are allocated once they're wanted.
+	c.Assert(ts.SetFileWanted(0, false), qt.IsNil)
+	c.Assert(ts.AllocateFile(0), qt.IsNil)
+	_, err = os.Stat(filepath.Join(dir, "t", "a"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+	c.Assert(ts.SetFileWanted(0, true), qt.IsNil)
+	fi, err = os.Stat(filepath.Join(dir, "t", "a"))
+	c.Assert(err, qt.IsNil)
+	c.Check(fi.Size(), qt.Equals, info.Files[0].Length)
+}
+
+func TestPreallocateSparse(t *testing.T) {
+	testPreallocation(t, PreallocateSparse)
+}
+
+func TestPreallocateFull(t *testing.T) {
+	testPreallocation(t, PreallocateFull)
+}
+
+func TestPreallocateNone(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	cs := NewFileOpts(NewFileClientOpts{
+		ClientBaseDir:   dir,
+		PieceCompletion: NewMapPieceCompletion(),
+	})
+	defer cs.Close()
+	info := &metainfo.Info{
+		Name:        "a",
+		PieceLength: 1,
+		Length:      1,
+		Pieces:      make([]byte, metainfo.HashSize),
+	}
+	ts, err := cs.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ts.AllocateFile(0), qt.IsNil)
+	_, err = os.Stat(filepath.Join(dir, "a"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+}
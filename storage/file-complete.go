@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/segments"
+)
+
+// Returns the range of pieces that overlap the file at the given torrent offset.
+func filePieceRange(info *metainfo.Info, offset, length int64) (begin, end int) {
+	if length == 0 {
+		return
+	}
+	begin = int(offset / info.PieceLength)
+	end = int((offset + length + info.PieceLength - 1) / info.PieceLength)
+	return
+}
+
+// Loads the completion of every piece, so we know when files are ready to be moved, and moves any
+// that were completed previously but haven't been moved yet.
+func (fs *fileTorrentImpl) initPieceCompletion() error {
+	fs.pieceComplete = make([]bool, fs.info.NumPieces())
+	for i := range fs.pieceComplete {
+		c, err := fs.completion.Get(metainfo.PieceKey{InfoHash: fs.infoHash, Index: i})
+		if err != nil {
+			return fmt.Errorf("getting completion for piece %v: %w", i, err)
+		}
+		fs.pieceComplete[i] = c.Ok && c.Complete
+	}
+	for i := range fs.files {
+		f := &fs.files[i]
+		for p := f.beginPiece; p < f.endPiece; p++ {
+			if !fs.pieceComplete[p] {
+				f.incompletePieces++
+			}
+		}
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.moveCompleteFilesLocked(); err != nil {
+		log.Printf("error moving complete files: %v", err)
+	}
+	return nil
+}
+
+// Updates the tracked completion of a piece, and moves any files that have become complete.
+func (fs *fileTorrentImpl) updatePieceCompletion(piece int, complete bool) error {
+	if fs.pieceComplete == nil {
+		return nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.pieceComplete[piece] == complete {
+		return nil
+	}
+	fs.pieceComplete[piece] = complete
+	delta := 1
+	if complete {
+		delta = -1
+	}
+	p := fs.info.Piece(piece)
+	fs.segmentLocater.Locate(segments.Extent{Start: p.Offset(), Length: p.Length()}, func(i int, _ segments.Extent) bool {
+		fs.files[i].incompletePieces += delta
+		return true
+	})
+	if !complete {
+		return nil
+	}
+	return fs.moveCompleteFilesLocked()
+}
+
+func (fs *fileTorrentImpl) moveCompleteFilesLocked() error {
+	var moves []fileMove
+	var moved []int
+	for i, f := range fs.files {
+		if f.incompletePieces != 0 {
+			if fs.unwanted != nil && fs.unwanted[i] {
+				// Unwanted files don't hold back the torrent. They stay where they are until
+				// they're complete.
+				continue
+			}
+			if fs.moveTorrentOnComplete {
+				return nil
+			}
+			continue
+		}
+		if f.path != f.completePath {
+			moves = append(moves, fileMove{f.path, f.completePath})
+			moved = append(moved, i)
+		}
+	}
+	if err := moveFiles(moves); err != nil {
+		return err
+	}
+	for _, i := range moved {
+		fs.files[i].path = fs.files[i].completePath
+	}
+	removeEmptyParentDirs(fs.incompleteDir, moves)
+	return nil
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func testMoveOnComplete(t *testing.T, moveTorrent bool) {
+	c := qt.New(t)
+	baseDir := t.TempDir()
+	incompleteDir := t.TempDir()
+	cs := NewFileOpts(NewFileClientOpts{
+		ClientBaseDir:         baseDir,
+		IncompleteDir:         incompleteDir,
+		IncompleteSuffix:      ".part",
+		MoveTorrentOnComplete: moveTorrent,
+		PieceCompletion:       NewMapPieceCompletion(),
+	})
+	defer cs.Close()
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 1,
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 1},
+			{Path: []string{"b"}, Length: 1},
+		},
+	}
+	ts, err := NewClient(cs).OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	exists := func(path ...string) bool {
+		_, err := os.Stat(filepath.Join(path...))
+		return err == nil
+	}
+	for i := 0; i < 2; i++ {
+		p := ts.Piece(info.Piece(i))
+		_, err = p.WriteAt([]byte{'a' + byte(i)}, 0)
+		c.Assert(err, qt.IsNil)
+		c.Assert(exists(incompleteDir, "t", string('a'+byte(i))+".part"), qt.IsTrue)
+		c.Assert(p.MarkComplete(), qt.IsNil)
+		c.Check(p.Completion().Complete, qt.IsTrue)
+	}
+	c.Check(exists(baseDir, "t", "a"), qt.IsTrue)
+	c.Check(exists(baseDir, "t", "b"), qt.IsTrue)
+	c.Check(exists(incompleteDir, "t"), qt.IsFalse)
+	b := make([]byte, 1)
+	_, err = ts.Piece(info.Piece(1)).ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "b")
+}
+
+func TestMoveFilesOnComplete(t *testing.T) {
+	testMoveOnComplete(t, false)
+}
+
+func TestMoveTorrentOnComplete(t *testing.T) {
+	testMoveOnComplete(t, true)
+}
+
+func TestMoveOnCompleteEachFile(t *testing.T) {
+	c := qt.New(t)
+	baseDir := t.TempDir()
+	completion := NewMapPieceCompletion()
+	cs := NewFileOpts(NewFileClientOpts{
+		ClientBaseDir:    baseDir,
+		IncompleteSuffix: ".part",
+		PieceCompletion:  completion,
+	})
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 2,
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 1},
+			{Path: []string{"b"}, Length: 2},
+		},
+	}
+	ts, err := NewClient(cs).OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	p := ts.Piece(info.Piece(0))
+	_, err = p.WriteAt([]byte("ab"), 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.MarkComplete(), qt.IsNil)
+	// The second file still has an incomplete piece.
+	_, err = os.Stat(filepath.Join(baseDir, "t", "a"))
+	c.Check(err, qt.IsNil)
+	_, err = os.Stat(filepath.Join(baseDir, "t", "b.part"))
+	c.Check(err, qt.IsNil)
+	// Completion from a previous session is picked up when the torrent is opened again.
+	c.Assert(completion.Set(metainfo.PieceKey{Index: 1}, true), qt.IsNil)
+	_, err = NewClient(cs).OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	_, err = os.Stat(filepath.Join(baseDir, "t", "b"))
+	c.Check(err, qt.IsNil)
+}
+
+func TestMoveTorrentOnCompleteIgnoresUnwantedFiles(t *testing.T) {
+	c := qt.New(t)
+	baseDir := t.TempDir()
+	incompleteDir := t.TempDir()
+	cs := NewFileOpts(NewFileClientOpts{
+		ClientBaseDir:         baseDir,
+		IncompleteDir:         incompleteDir,
+		MoveTorrentOnComplete: true,
+		PieceCompletion:       NewMapPieceCompletion(),
+	})
+	defer cs.Close()
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 1,
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 1},
+			{Path: []string{"b"}, Length: 1},
+		},
+	}
+	ts, err := NewClient(cs).OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	p := ts.Piece(info.Piece(0))
+	_, err = p.WriteAt([]byte("a"), 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.MarkComplete(), qt.IsNil)
+	_, err = os.Stat(filepath.Join(baseDir, "t", "a"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+	// Once the incomplete file isn't wanted, the wanted files are moved.
+	c.Assert(ts.SetFileWanted(1, false), qt.IsNil)
+	_, err = os.Stat(filepath.Join(baseDir, "t", "a"))
+	c.Check(err, qt.IsNil)
+}
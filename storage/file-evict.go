@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Marks the piece not complete and frees its space. Files that holes can't be punched in are
+// removed once none of their pieces are complete.
+func (fs *fileTorrentImpl) evictPiece(piece int) {
+	err := fs.completion.Set(metainfo.PieceKey{InfoHash: fs.infoHash, Index: piece}, false)
+	if err != nil {
+		log.Printf("error marking evicted piece %v not complete: %v", piece, err)
+		return
+	}
+	fs.pieceVerified(piece)
+	fs.updatePieceCompletion(piece, false)
+	fs.mu.Lock()
+	unsupported := punchPieceHoles(fs.info, fs.segmentLocater, piece, func(i int) string {
+		return fs.files[i].path
+	}, func(i int) bool {
+		return fs.partHolds(piece, i)
+	})
+	for _, i := range unsupported {
+		if !fs.fileHasCompletePieces(i) && os.Remove(fs.files[i].path) == nil {
+			atomic.StoreInt64(&fs.fileSizes[i], 0)
+		}
+	}
+	fs.mu.Unlock()
+	fs.completionSubscribers.notify(piece)
+}
+
+func (fs *fileTorrentImpl) fileHasCompletePieces(index int) bool {
+	f := fs.files[index]
+	begin, end := filePieceRange(fs.info, f.offset, f.length)
+	for p := begin; p < end; p++ {
+		c, err := fs.completion.Get(metainfo.PieceKey{InfoHash: fs.infoHash, Index: p})
+		if err != nil {
+			// Keep the file if we can't tell.
+			return true
+		}
+		if c.Ok && c.Complete {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// A file to be relocated.
+type fileMove struct {
+	from, to string
+}
+
+// Moves the files, undoing any that were completed if one fails. Files that don't exist are
+// skipped, as storage creates them lazily.
+func moveFiles(moves []fileMove) (err error) {
+	var done []fileMove
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(done) - 1; i >= 0; i-- {
+			// Best effort, since we already have an error to return.
+			moveFile(done[i].to, done[i].from)
+		}
+	}()
+	for _, m := range moves {
+		if m.from == m.to {
+			continue
+		}
+		var moved bool
+		moved, err = moveFile(m.from, m.to)
+		if err != nil {
+			return fmt.Errorf("moving %q to %q: %w", m.from, m.to, err)
+		}
+		if moved {
+			done = append(done, m)
+		}
+	}
+	return nil
+}
+
+// Moves a single file, creating any directories needed at the destination. If the destination is
+// on another filesystem the file is copied, and only renamed into place once the copy is complete.
+// Returns false if there was no file to move.
+func moveFile(from, to string) (moved bool, err error) {
+	fi, err := os.Stat(from)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+	if _, err = os.Stat(to); err == nil {
+		return false, fmt.Errorf("%q already exists", to)
+	}
+	err = os.MkdirAll(filepath.Dir(to), 0o777)
+	if err != nil {
+		return
+	}
+	err = os.Rename(from, to)
+	if errors.Is(err, syscall.EXDEV) {
+		err = copyFileAcrossDevices(from, to, fi.Mode())
+		if err == nil {
+			err = os.Remove(from)
+		}
+	}
+	return err == nil, err
+}
+
+func copyFileAcrossDevices(from, to string, mode os.FileMode) (err error) {
+	src, err := os.Open(from)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(to), "."+filepath.Base(to)+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = io.Copy(tmp, src); err != nil {
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), to)
+}
+
+// Removes the now empty directories that contained files that were moved, stopping at base.
+func removeEmptyParentDirs(base string, moves []fileMove) {
+	for _, m := range moves {
+		for dir := filepath.Dir(m.from); dir != base && isSubFilepath(base, dir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/segments"
+)
+
+// Holds data for files that aren't wanted, from pieces that are shared with wanted files, so that the
+// unwanted files don't need to be created. Data is stored in piece-sized slots, and an index of
+// which pieces and files are held in which slots is kept alongside.
+type partFile struct {
+	// The size of the part file on disk. Accessed atomically.
+	size        int64
+	mu          sync.Mutex
+	pieceLength int64
+	// Per piece index.
+	slots     map[int]*partSlot
+	freeSlots []int
+	numSlots  int
+}
+
+type partSlot struct {
+	Piece int `bencode:"piece"`
+	Slot  int `bencode:"slot"`
+	// The files that have their data in this slot, rather than in the file itself.
+	Files []int `bencode:"files"`
+}
+
+func (me *partSlot) holds(file int) bool {
+	for _, f := range me.Files {
+		if f == file {
+			return true
+		}
+	}
+	return false
+}
+
+func (me *partSlot) release(file int) {
+	for i, f := range me.Files {
+		if f == file {
+			me.Files = append(me.Files[:i], me.Files[i+1:]...)
+			return
+		}
+	}
+}
+
+type partFileIndex struct {
+	Slots    []partSlot `bencode:"slots"`
+	NumSlots int        `bencode:"num slots"`
+}
+
+func partFilePath(dir string, infoHash metainfo.Hash) string {
+	return filepath.Join(dir, "."+infoHash.HexString()+".parts")
+}
+
+func partFileIndexPath(dir string, infoHash metainfo.Hash) string {
+	return partFilePath(dir, infoHash) + ".index"
+}
+
+func loadPartFile(dir string, infoHash metainfo.Hash, pieceLength int64) (*partFile, error) {
+	ret := &partFile{
+		pieceLength: pieceLength,
+		slots:       make(map[int]*partSlot),
+	}
+	b, err := os.ReadFile(partFileIndexPath(dir, infoHash))
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var index partFileIndex
+	err = bencode.Unmarshal(b, &index)
+	if err != nil {
+		return nil, fmt.Errorf("decoding part file index: %w", err)
+	}
+	ret.numSlots = index.NumSlots
+	used := make(map[int]bool)
+	for i := range index.Slots {
+		s := index.Slots[i]
+		ret.slots[s.Piece] = &s
+		used[s.Slot] = true
+	}
+	for i := 0; i < ret.numSlots; i++ {
+		if !used[i] {
+			ret.freeSlots = append(ret.freeSlots, i)
+		}
+	}
+	return ret, nil
+}
+
+// Must be called with the lock held.
+func (me *partFile) saveIndex(dir string, infoHash metainfo.Hash) error {
+	var index partFileIndex
+	index.NumSlots = me.numSlots
+	for _, s := range me.slots {
+		index.Slots = append(index.Slots, *s)
+	}
+	b, err := bencode.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(partFileIndexPath(dir, infoHash), b, 0o666)
+}
+
+// Returns the slot holding the file's data in the piece, if any. Must be called with the lock held.
+func (me *partFile) slotFor(piece, file int) *partSlot {
+	s := me.slots[piece]
+	if s == nil || !s.holds(file) {
+		return nil
+	}
+	return s
+}
+
+func (me *partFile) slotOffset(s *partSlot) int64 {
+	return int64(s.Slot) * me.pieceLength
+}
+
+func (me *partFile) readAt(dir string, infoHash metainfo.Hash, b []byte, off int64) (n int, err error) {
+	f, err := os.Open(partFilePath(dir, infoHash))
+	if os.IsNotExist(err) {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return f.ReadAt(b, off)
+}
+
+func (me *partFile) writeAt(dir string, infoHash metainfo.Hash, b []byte, off int64) (n int, err error) {
+	f, err := os.OpenFile(partFilePath(dir, infoHash), os.O_WRONLY|os.O_CREATE, 0o666)
+	if err != nil {
+		return
+	}
+	n, err = f.WriteAt(b, off)
+	growSize(&me.size, off+int64(n))
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// Returns whether the piece overlaps both wanted and unwanted files, so that the unwanted files'
+// data belongs in the part file. Must be called with fs.mu held.
+func (fs *fileTorrentImpl) isBoundaryPiece(piece int) (ret bool) {
+	var wanted, unwanted bool
+	p := fs.info.Piece(piece)
+	fs.segmentLocater.Locate(segments.Extent{Start: p.Offset(), Length: p.Length()}, func(i int, _ segments.Extent) bool {
+		if fs.unwanted[i] {
+			unwanted = true
+		} else {
+			wanted = true
+		}
+		return !(wanted && unwanted)
+	})
+	return wanted && unwanted
+}
+
+// Returns the part file slot to use for a file's data in a piece, creating one if the data belongs
+// there. When a slot is created, data the unwanted files already have in the piece is copied into
+// it, so that each file's data for the piece is in one place. Must be called with fs.mu held.
+func (fs *fileTorrentImpl) partSlotFor(piece, file int, create bool) (*partSlot, error) {
+	pf := fs.part
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if s := pf.slots[piece]; s != nil || !create {
+		return pf.slotFor(piece, file), nil
+	}
+	if fs.unwanted == nil || !fs.unwanted[file] || !fs.isBoundaryPiece(piece) {
+		return nil, nil
+	}
+	s := &partSlot{Piece: piece}
+	if len(pf.freeSlots) != 0 {
+		s.Slot = pf.freeSlots[len(pf.freeSlots)-1]
+		pf.freeSlots = pf.freeSlots[:len(pf.freeSlots)-1]
+	} else {
+		s.Slot = pf.numSlots
+		pf.numSlots++
+	}
+	p := fs.info.Piece(piece)
+	var err error
+	fs.segmentLocater.Locate(segments.Extent{Start: p.Offset(), Length: p.Length()}, func(i int, e segments.Extent) bool {
+		if !fs.unwanted[i] {
+			return true
+		}
+		s.Files = append(s.Files, i)
+		b := make([]byte, e.Length)
+		n, _ := (&fileTorrentImplIO{fs}).readFileAt(fs.files[i], b, e.Start)
+		if n == 0 {
+			return true
+		}
+		_, err = pf.writeAt(fs.dir, fs.infoHash, b[:n], pf.slotOffset(s)+fs.files[i].offset+e.Start-p.Offset())
+		return err == nil
+	})
+	if err != nil {
+		pf.freeSlots = append(pf.freeSlots, s.Slot)
+		return nil, err
+	}
+	pf.slots[piece] = s
+	return s, pf.saveIndex(fs.dir, fs.infoHash)
+}
+
+func (fs *fileTorrentImpl) partHolds(piece, file int) bool {
+	fs.part.mu.Lock()
+	defer fs.part.mu.Unlock()
+	return fs.part.slotFor(piece, file) != nil
+}
+
+// Reads or writes a file's data in a piece, if it's held in the part file. Must be called with
+// fs.mu held.
+func (fs *fileTorrentImpl) partIo(
+	piece, file int, b []byte, fileOff int64, write bool,
+) (n int, handled bool, err error) {
+	s, err := fs.partSlotFor(piece, file, write)
+	if s == nil || err != nil {
+		return 0, err != nil, err
+	}
+	off := fs.part.slotOffset(s) + fs.files[file].offset + fileOff - fs.info.Piece(piece).Offset()
+	if write {
+		n, err = fs.part.writeAt(fs.dir, fs.infoHash, b, off)
+	} else {
+		n, err = fs.part.readAt(fs.dir, fs.infoHash, b, off)
+	}
+	return n, true, err
+}
+
+// Sets whether a file is wanted. Data for a newly wanted file is moved out of the part file, into
+// the file itself, and then the file is allocated.
+func (fs *fileTorrentImpl) SetFileWanted(index int, wanted bool) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !wanted {
+		if fs.unwanted == nil {
+			fs.unwanted = make([]bool, len(fs.files))
+		}
+		fs.unwanted[index] = true
+		if fs.pieceComplete == nil {
+			return nil
+		}
+		// The remaining files might be complete now.
+		return fs.moveCompleteFilesLocked()
+	}
+	if fs.unwanted != nil && fs.unwanted[index] {
+		fs.unwanted[index] = false
+		// Allocation was skipped while the file was unwanted.
+		defer func() {
+			if err == nil {
+				err = fs.allocateFileLocked(index)
+			}
+		}()
+	}
+	pf := fs.part
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	f := fs.files[index]
+	var changed bool
+	for piece, s := range pf.slots {
+		if !s.holds(index) {
+			continue
+		}
+		p := fs.info.Piece(piece)
+		// The part of the piece that overlaps the file.
+		begin := p.Offset()
+		if f.offset > begin {
+			begin = f.offset
+		}
+		end := p.Offset() + p.Length()
+		if f.offset+f.length < end {
+			end = f.offset + f.length
+		}
+		b := make([]byte, end-begin)
+		n, err := pf.readAt(fs.dir, fs.infoHash, b, pf.slotOffset(s)+begin-p.Offset())
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if n != 0 {
+			err = writeFileAt(f.path, b[:n], begin-f.offset)
+			if err != nil {
+				return err
+			}
+			fs.fileGrew(index, begin-f.offset+int64(n))
+		}
+		s.release(index)
+		if len(s.Files) == 0 {
+			delete(pf.slots, piece)
+			pf.freeSlots = append(pf.freeSlots, s.Slot)
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	if len(pf.slots) == 0 {
+		// Nothing is held anymore, so clean up.
+		pf.freeSlots = nil
+		pf.numSlots = 0
+		os.Remove(partFilePath(fs.dir, fs.infoHash))
+		os.Remove(partFileIndexPath(fs.dir, fs.infoHash))
+		atomic.StoreInt64(&pf.size, 0)
+		return nil
+	}
+	return pf.saveIndex(fs.dir, fs.infoHash)
+}
+
+func writeFileAt(name string, b []byte, off int64) error {
+	os.MkdirAll(filepath.Dir(name), 0o777)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0o666)
+	if err != nil {
+		return err
+	}
+	n, err := f.WriteAt(b, off)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil && n != len(b) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
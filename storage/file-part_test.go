@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestPartFileHoldsUnwantedFileData(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	ci := NewFileOpts(NewFileClientOpts{
+		ClientBaseDir:   dir,
+		PieceCompletion: NewMapPieceCompletion(),
+	})
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 4,
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 3},
+			{Path: []string{"b"}, Length: 2},
+			{Path: []string{"c"}, Length: 3},
+		},
+	}
+	ts, err := ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ts.SetFileWanted(1, false), qt.IsNil)
+	p := ts.Piece(info.Piece(0))
+	_, err = p.WriteAt([]byte("abcd"), 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.MarkComplete(), qt.IsNil)
+	_, err = os.Stat(filepath.Join(dir, "t", "b"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+	c.Check(p.Completion().Complete, qt.IsTrue)
+	readPiece := func(ts TorrentImpl) string {
+		b := make([]byte, 4)
+		_, err := ts.Piece(info.Piece(0)).ReadAt(b, 0)
+		c.Assert(err, qt.IsNil)
+		return string(b)
+	}
+	c.Check(readPiece(ts), qt.Equals, "abcd")
+	// The part file index survives reopening the torrent.
+	ts, err = ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	c.Check(readPiece(ts), qt.Equals, "abcd")
+	// Selecting the file moves its data into place.
+	c.Assert(ts.SetFileWanted(1, true), qt.IsNil)
+	b, err := os.ReadFile(filepath.Join(dir, "t", "b"))
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "d")
+	_, err = os.Stat(partFilePath(dir, metainfo.Hash{}))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+	c.Check(readPiece(ts), qt.Equals, "abcd")
+}
+
+func TestPartFileTakesExistingData(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	ci := NewFileOpts(NewFileClientOpts{
+		ClientBaseDir:   dir,
+		PieceCompletion: NewMapPieceCompletion(),
+	})
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 4,
+		Pieces:      make([]byte, metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 2},
+			{Path: []string{"b"}, Length: 2},
+		},
+	}
+	ts, err := ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	p := ts.Piece(info.Piece(0))
+	_, err = p.WriteAt([]byte("cd"), 2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ts.SetFileWanted(1, false), qt.IsNil)
+	_, err = p.WriteAt([]byte("ab"), 0)
+	c.Assert(err, qt.IsNil)
+	b := make([]byte, 4)
+	_, err = p.ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "abcd")
+}
@@ -22,6 +22,9 @@ func (me *filePieceImpl) pieceKey() metainfo.PieceKey {
 }
 
 func (fs *filePieceImpl) Completion() Completion {
+	if fs.pieceUnverified(fs.p.Index()) {
+		return Completion{}
+	}
 	c, err := fs.completion.Get(fs.pieceKey())
 	if err != nil {
 		log.Printf("error getting piece completion: %s", err)
@@ -30,25 +33,72 @@ func (fs *filePieceImpl) Completion() Completion {
 	}
 	if c.Complete {
 		// If it's allegedly complete, check that its constituent files have the necessary length.
+		fs.mu.RLock()
 		for _, fi := range extentCompleteRequiredLengths(fs.p.Info, fs.p.Offset(), fs.p.Length()) {
+			if fs.partHolds(fs.p.Index(), fi.fileIndex) {
+				continue
+			}
 			s, err := os.Stat(fs.files[fi.fileIndex].path)
 			if err != nil || s.Size() < fi.length {
 				c.Complete = false
 				break
 			}
 		}
+		fs.mu.RUnlock()
 	}
 	if !c.Complete {
 		// The completion was wrong, fix it.
 		fs.completion.Set(fs.pieceKey(), false)
+		fs.updatePieceCompletion(fs.p.Index(), false)
+		if fs.lru != nil {
+			fs.lru.remove(fs.fileTorrentImpl, fs.p.Index())
+		}
 	}
 	return c
 }
 
 func (fs *filePieceImpl) MarkComplete() error {
-	return fs.completion.Set(fs.pieceKey(), true)
+	err := fs.completion.Set(fs.pieceKey(), true)
+	if err != nil {
+		return err
+	}
+	fs.pieceVerified(fs.p.Index())
+	err = fs.updatePieceCompletion(fs.p.Index(), true)
+	if fs.lru != nil {
+		fs.lru.complete(fs.fileTorrentImpl, fs.p.Index(), fs.p.Length())
+	}
+	if err != nil {
+		return err
+	}
+	return fs.saveFileStampsOverlapping(fs.p.Index(), fs.p.Index()+1)
 }
 
 func (fs *filePieceImpl) MarkNotComplete() error {
-	return fs.completion.Set(fs.pieceKey(), false)
+	err := fs.completion.Set(fs.pieceKey(), false)
+	if err != nil {
+		return err
+	}
+	fs.pieceVerified(fs.p.Index())
+	if fs.lru != nil {
+		fs.lru.remove(fs.fileTorrentImpl, fs.p.Index())
+	}
+	err = fs.updatePieceCompletion(fs.p.Index(), false)
+	if err != nil {
+		return err
+	}
+	return fs.saveFileStampsOverlapping(fs.p.Index(), fs.p.Index()+1)
+}
+
+func (fs *filePieceImpl) ReadAt(b []byte, off int64) (int, error) {
+	if fs.lru != nil {
+		fs.lru.touch(fs.fileTorrentImpl, fs.p.Index())
+	}
+	return fs.ReaderAt.ReadAt(b, off)
+}
+
+func (fs *filePieceImpl) WriteAt(b []byte, off int64) (int, error) {
+	if fs.lru != nil {
+		fs.lru.touch(fs.fileTorrentImpl, fs.p.Index())
+	}
+	return fs.WriterAt.WriteAt(b, off)
 }
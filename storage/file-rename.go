@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Optionally implemented by a PieceCompletion to persist file paths set at runtime, so that they
+// survive the torrent being reopened.
+type FilePathStore interface {
+	// Returns the paths set for files in the torrent, by file index.
+	GetFilePaths(infoHash metainfo.Hash) (map[int]string, error)
+	SetFilePath(infoHash metainfo.Hash, fileIndex int, path string) error
+}
+
+// Resolves a path given to TorrentImpl.SetFilePath. Absolute paths are used as is. Relative paths
+// use '/' separators, and must stay within dir.
+func resolveFilePath(dir, path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path), nil
+	}
+	ret := filepath.Join(dir, filepath.FromSlash(path))
+	if ret == filepath.Clean(dir) || !isSubFilepath(dir, ret) {
+		return "", fmt.Errorf("path %q is not sub path of %q", path, dir)
+	}
+	return ret, nil
+}
+
+// Loads the file paths persisted for a torrent, if the piece completion supports it.
+func loadFilePaths(pc PieceCompletionGetSetter, infoHash metainfo.Hash) (map[int]string, error) {
+	fps, ok := pc.(FilePathStore)
+	if !ok {
+		return nil, nil
+	}
+	return fps.GetFilePaths(infoHash)
+}
+
+func storeFilePath(pc PieceCompletionGetSetter, infoHash metainfo.Hash, fileIndex int, path string) error {
+	fps, ok := pc.(FilePathStore)
+	if !ok {
+		return nil
+	}
+	return fps.SetFilePath(infoHash, fileIndex, path)
+}
+
+// Returns a path to persist for a file at osPath that restores it there, for when setting a new path
+// fails. previous is the path that was set before, if any.
+func restoreFilePath(dir, osPath string, previous map[int]string, fileIndex int) string {
+	if path, ok := previous[fileIndex]; ok {
+		return path
+	}
+	if rel, err := filepath.Rel(dir, osPath); err == nil && isSubFilepath(dir, osPath) {
+		return filepath.ToSlash(rel)
+	}
+	return osPath
+}
+
+func copyFilePaths(m map[int]string) map[int]string {
+	ret := make(map[int]string, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
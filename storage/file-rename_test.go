@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func testSetFilePath(t *testing.T, ci func(dir string, pc PieceCompletion) ClientImpl) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	pc := NewMapPieceCompletion()
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 2,
+		Pieces:      make([]byte, metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 1},
+			{Path: []string{"bad name"}, Length: 1},
+		},
+	}
+	ts, err := NewClient(ci(dir, pc)).OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	p := ts.Piece(info.Piece(0))
+	_, err = p.WriteAt([]byte("ab"), 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ts.SetFilePath(1, "t/good/b"), qt.IsNil)
+	c.Check(ts.SetFilePath(1, "../escape"), qt.IsNotNil)
+	b, err := os.ReadFile(filepath.Join(dir, "t", "good", "b"))
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "b")
+	_, err = os.Stat(filepath.Join(dir, "t", "bad name"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+	buf := make([]byte, 2)
+	_, err = p.ReadAt(buf, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(string(buf), qt.Equals, "ab")
+	c.Assert(ts.Close(), qt.IsNil)
+	// The path is restored when the torrent is opened again.
+	ts, err = NewClient(ci(dir, pc)).OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	defer ts.Close()
+	c.Check(ts.FilePaths(), qt.DeepEquals, map[int]string{1: "t/good/b"})
+	_, err = ts.Piece(info.Piece(0)).ReadAt(buf, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(string(buf), qt.Equals, "ab")
+}
+
+func TestSetFilePathFile(t *testing.T) {
+	testSetFilePath(t, func(dir string, pc PieceCompletion) ClientImpl {
+		return NewFileOpts(NewFileClientOpts{
+			ClientBaseDir:   dir,
+			PieceCompletion: pc,
+		})
+	})
+}
+
+func TestSetFilePathMMap(t *testing.T) {
+	testSetFilePath(t, func(dir string, pc PieceCompletion) ClientImpl {
+		return NewMMapWithCompletion(dir, pc)
+	})
+}
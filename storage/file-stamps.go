@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"os"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// The size and modification time of a file when its torrent was last closed. If a file still has
+// the same stamp when the torrent is opened again, the recorded completion of its pieces is trusted.
+type FileStamp struct {
+	Size    int64
+	ModTime time.Time
+}
+
+func fileStampFromInfo(fi os.FileInfo) FileStamp {
+	return FileStamp{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+}
+
+func (me FileStamp) Equal(other FileStamp) bool {
+	return me.Size == other.Size && me.ModTime.Equal(other.ModTime)
+}
+
+// Optionally implemented by a PieceCompletion to persist file stamps, so only pieces in files that
+// have changed since the torrent was last closed need to be checked when it's opened again.
+type FileStampStore interface {
+	// Returns the stamps recorded for files in the torrent, by file index.
+	GetFileStamps(infoHash metainfo.Hash) (map[int]FileStamp, error)
+	SetFileStamp(infoHash metainfo.Hash, fileIndex int, stamp FileStamp) error
+}
+
+func loadFileStamps(pc PieceCompletionGetSetter, infoHash metainfo.Hash) (map[int]FileStamp, error) {
+	fss, ok := pc.(FileStampStore)
+	if !ok {
+		return nil, nil
+	}
+	return fss.GetFileStamps(infoHash)
+}
+
+// Marks pieces as unverified if they're recorded as complete, but overlap files that have changed
+// since their stamps were recorded. Files without a stamp are trusted, as they were before stamps
+// were recorded. If force is set, every piece is unverified.
+func (fs *fileTorrentImpl) initUnverifiedPieces(stamps map[int]FileStamp, force bool) error {
+	fs.unverified = make([]bool, fs.info.NumPieces())
+	if force {
+		return fs.DiscardFileStamps()
+	}
+	for i, f := range fs.files {
+		stamp, ok := stamps[i]
+		if !ok || f.length == 0 {
+			continue
+		}
+		if fi, err := os.Stat(f.path); err == nil && fileStampFromInfo(fi).Equal(stamp) {
+			continue
+		}
+		begin, end := filePieceRange(fs.info, f.offset, f.length)
+		for p := begin; p < end && p < len(fs.unverified); p++ {
+			c, err := fs.completion.Get(metainfo.PieceKey{InfoHash: fs.infoHash, Index: p})
+			if err != nil {
+				return err
+			}
+			if c.Ok && c.Complete {
+				fs.unverified[p] = true
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *fileTorrentImpl) pieceUnverified(piece int) bool {
+	fs.unverifiedMu.Lock()
+	defer fs.unverifiedMu.Unlock()
+	return piece < len(fs.unverified) && fs.unverified[piece]
+}
+
+// Called when the client has checked the piece and recorded its completion.
+func (fs *fileTorrentImpl) pieceVerified(piece int) {
+	fs.unverifiedMu.Lock()
+	defer fs.unverifiedMu.Unlock()
+	if piece < len(fs.unverified) {
+		fs.unverified[piece] = false
+	}
+}
+
+// Marks every piece unverified, and records stamps that no file matches, so that all pieces are
+// checked before their completion is trusted, even if the torrent is closed first.
+func (fs *fileTorrentImpl) DiscardFileStamps() error {
+	fs.unverifiedMu.Lock()
+	for i := range fs.unverified {
+		fs.unverified[i] = true
+	}
+	fs.unverifiedMu.Unlock()
+	fss, ok := fs.completion.(FileStampStore)
+	if !ok {
+		return nil
+	}
+	for i, f := range fs.files {
+		if f.length == 0 {
+			continue
+		}
+		err := fss.SetFileStamp(fs.infoHash, i, FileStamp{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Records the stamps of files that don't overlap any unverified pieces, so that their pieces'
+// completion can be trusted next time.
+func (fs *fileTorrentImpl) saveFileStamps() error {
+	return fs.saveFileStampsOverlapping(0, fs.info.NumPieces())
+}
+
+// Records the stamps of the files overlapping the range of pieces, if they don't overlap any
+// unverified pieces.
+func (fs *fileTorrentImpl) saveFileStampsOverlapping(beginPiece, endPiece int) error {
+	fss, ok := fs.completion.(FileStampStore)
+	if !ok {
+		return nil
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	fs.unverifiedMu.Lock()
+	defer fs.unverifiedMu.Unlock()
+files:
+	for i, f := range fs.files {
+		if f.length == 0 {
+			continue
+		}
+		begin, end := filePieceRange(fs.info, f.offset, f.length)
+		if begin >= endPiece || end <= beginPiece {
+			continue
+		}
+		for p := begin; p < end && p < len(fs.unverified); p++ {
+			if fs.unverified[p] {
+				continue files
+			}
+		}
+		fi, err := os.Stat(f.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = fss.SetFileStamp(fs.infoHash, i, fileStampFromInfo(fi))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func testFileStamps(t *testing.T, newPieceCompletion func(dir string) PieceCompletion) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	pc := newPieceCompletion(dir)
+	defer pc.Close()
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 2,
+		Pieces:      make([]byte, 3*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 3},
+			{Path: []string{"b"}, Length: 3},
+		},
+	}
+	open := func(force bool) TorrentImpl {
+		ts, err := NewFileOpts(NewFileClientOpts{
+			ClientBaseDir:   dir,
+			PieceCompletion: pc,
+			ForceFullCheck:  force,
+		}).OpenTorrent(info, metainfo.Hash{})
+		c.Assert(err, qt.IsNil)
+		return ts
+	}
+	completions := func(ts TorrentImpl) (ret []Completion) {
+		for i := 0; i < info.NumPieces(); i++ {
+			ret = append(ret, ts.Piece(info.Piece(i)).Completion())
+		}
+		return
+	}
+	complete := Completion{Complete: true, Ok: true}
+	ts := open(false)
+	for i := 0; i < info.NumPieces(); i++ {
+		p := ts.Piece(info.Piece(i))
+		_, err := p.WriteAt([]byte("xy"), 0)
+		c.Assert(err, qt.IsNil)
+		c.Assert(p.MarkComplete(), qt.IsNil)
+	}
+	c.Assert(ts.Close(), qt.IsNil)
+
+	ts = open(false)
+	c.Check(completions(ts), qt.DeepEquals, []Completion{complete, complete, complete})
+	c.Assert(ts.Close(), qt.IsNil)
+
+	// Pieces overlapping the changed file must be checked.
+	bPath := filepath.Join(dir, "t", "b")
+	c.Assert(os.Chtimes(bPath, time.Now(), time.Now().Add(time.Hour)), qt.IsNil)
+	ts = open(false)
+	c.Check(completions(ts), qt.DeepEquals, []Completion{complete, {}, {}})
+	c.Assert(ts.Piece(info.Piece(1)).MarkComplete(), qt.IsNil)
+	c.Check(completions(ts), qt.DeepEquals, []Completion{complete, complete, {}})
+	// The file still has an unchecked piece, so its stamp isn't updated.
+	c.Assert(ts.Close(), qt.IsNil)
+	ts = open(false)
+	c.Check(completions(ts), qt.DeepEquals, []Completion{complete, {}, {}})
+	c.Assert(ts.Piece(info.Piece(1)).MarkComplete(), qt.IsNil)
+	c.Assert(ts.Piece(info.Piece(2)).MarkComplete(), qt.IsNil)
+	c.Assert(ts.Close(), qt.IsNil)
+	ts = open(false)
+	c.Check(completions(ts), qt.DeepEquals, []Completion{complete, complete, complete})
+	c.Assert(ts.Close(), qt.IsNil)
+
+	ts = open(true)
+	c.Check(completions(ts), qt.DeepEquals, []Completion{{}, {}, {}})
+	c.Assert(ts.Close(), qt.IsNil)
+	// The forced check wasn't done, so it's still needed.
+	ts = open(false)
+	c.Check(completions(ts), qt.DeepEquals, []Completion{{}, {}, {}})
+	// Stamps are saved as pieces are checked, without waiting for the torrent to close.
+	for i := 0; i < info.NumPieces(); i++ {
+		c.Assert(ts.Piece(info.Piece(i)).MarkComplete(), qt.IsNil)
+	}
+	reopened := open(false)
+	c.Check(completions(reopened), qt.DeepEquals, []Completion{complete, complete, complete})
+	c.Assert(reopened.Close(), qt.IsNil)
+
+	c.Assert(ts.DiscardFileStamps(), qt.IsNil)
+	c.Check(completions(ts), qt.DeepEquals, []Completion{{}, {}, {}})
+	c.Assert(ts.Close(), qt.IsNil)
+	ts = open(false)
+	c.Check(completions(ts), qt.DeepEquals, []Completion{{}, {}, {}})
+	c.Assert(ts.Close(), qt.IsNil)
+}
+
+func TestFileStampsMapPieceCompletion(t *testing.T) {
+	testFileStamps(t, func(string) PieceCompletion {
+		return NewMapPieceCompletion()
+	})
+}
+
+func TestFileStampsDefaultPieceCompletion(t *testing.T) {
+	testFileStamps(t, pieceCompletionForDir)
+}
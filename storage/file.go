@@ -3,8 +3,11 @@ package storage
 import (
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 
 	"github.com/anacrolix/missinggo/v2"
 	"github.com/anacrolix/torrent/common"
@@ -16,6 +19,11 @@ import (
 // File-based storage for torrents, that isn't yet bound to a particular torrent.
 type fileClientImpl struct {
 	opts NewFileClientOpts
+	// Tracks complete pieces across torrents if there's a capacity. Otherwise nil.
+	lru *pieceLru
+	// If set, returns a different base directory for a file, or the empty string to use
+	// ClientBaseDir.
+	fileBaseDir func(infoHash metainfo.Hash, fileIndex int) string
 }
 
 // All Torrent data stored in this baseDir. The info names of each torrent are used as directories.
@@ -29,6 +37,24 @@ type NewFileClientOpts struct {
 	FilePathMaker   FilePathMaker
 	TorrentDirMaker TorrentDirFilePathMaker
 	PieceCompletion PieceCompletion
+	// If set, files are written under this directory until they're complete, and then moved to
+	// the torrent directory under ClientBaseDir. TorrentDirMaker is applied to it too.
+	IncompleteDir string
+	// Appended to the names of files that aren't yet complete, such as ".part".
+	IncompleteSuffix string
+	// Wait for the whole torrent to complete before moving any files to their final location,
+	// rather than moving each file as soon as its pieces are complete. Only wanted files are waited
+	// for: unwanted files that aren't complete are left in IncompleteDir.
+	MoveTorrentOnComplete bool
+	// How space is allocated for files when they become wanted.
+	Preallocation PreallocationMode
+	// If positive, the most space complete pieces can use across all torrents. When it's exceeded,
+	// the least recently accessed pieces are evicted, by punching holes in their files where
+	// possible, or removing files that have no complete pieces left, and marked not complete.
+	Capacity int64
+	// Report every piece's completion as unknown when a torrent is opened, so they're all checked,
+	// instead of only those in files whose size or modification time changed since it was closed.
+	ForceFullCheck bool
 }
 
 // NewFileOpts creates a new ClientImplCloser that stores files using the OS native filesystem.
@@ -48,29 +74,80 @@ func NewFileOpts(opts NewFileClientOpts) ClientImplCloser {
 	if opts.PieceCompletion == nil {
 		opts.PieceCompletion = pieceCompletionForDir(opts.ClientBaseDir)
 	}
-	return fileClientImpl{opts}
+	ret := fileClientImpl{opts: opts}
+	if opts.Capacity > 0 {
+		ret.lru = newPieceLru(opts.Capacity)
+	}
+	return ret
 }
 
 func (me fileClientImpl) Close() error {
 	return me.opts.PieceCompletion.Close()
 }
 
-func (fs fileClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (_ TorrentImpl, err error) {
+func (fs fileClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
+	_, ret, err := fs.openTorrent(info, infoHash)
+	return ret, err
+}
+
+func (fs fileClientImpl) openTorrent(info *metainfo.Info, infoHash metainfo.Hash) (t *fileTorrentImpl, _ TorrentImpl, err error) {
 	dir := fs.opts.TorrentDirMaker(fs.opts.ClientBaseDir, info, infoHash)
+	incompleteDir := dir
+	if fs.opts.IncompleteDir != "" {
+		incompleteDir = fs.opts.TorrentDirMaker(fs.opts.IncompleteDir, info, infoHash)
+	}
+	moveOnComplete := incompleteDir != dir || fs.opts.IncompleteSuffix != ""
+	filePaths, err := loadFilePaths(fs.opts.PieceCompletion, infoHash)
+	if err != nil {
+		err = fmt.Errorf("loading file paths: %w", err)
+		return
+	}
+	stamps, err := loadFileStamps(fs.opts.PieceCompletion, infoHash)
+	if err != nil {
+		err = fmt.Errorf("loading file stamps: %w", err)
+		return
+	}
 	upvertedFiles := info.UpvertedFiles()
 	files := make([]file, 0, len(upvertedFiles))
+	var offset int64
 	for i, fileInfo := range upvertedFiles {
-		filePath := filepath.Join(dir, fs.opts.FilePathMaker(FilePathMakerOpts{
+		relPath := fs.opts.FilePathMaker(FilePathMakerOpts{
 			Info: info,
 			File: &fileInfo,
-		}))
-		if !isSubFilepath(dir, filePath) {
-			err = fmt.Errorf("file %v: path %q is not sub path of %q", i, filePath, dir)
+		})
+		fileDir := dir
+		if fs.fileBaseDir != nil {
+			if baseDir := fs.fileBaseDir(infoHash, i); baseDir != "" {
+				fileDir = fs.opts.TorrentDirMaker(baseDir, info, infoHash)
+			}
+		}
+		filePath := filepath.Join(fileDir, relPath)
+		if !isSubFilepath(fileDir, filePath) {
+			err = fmt.Errorf("file %v: path %q is not sub path of %q", i, filePath, fileDir)
 			return
 		}
+		if custom, ok := filePaths[i]; ok {
+			filePath, err = resolveFilePath(dir, custom)
+			if err != nil {
+				err = fmt.Errorf("file %v: %w", i, err)
+				return
+			}
+		}
 		f := file{
-			path:   filePath,
-			length: fileInfo.Length,
+			path:         filePath,
+			completePath: filePath,
+			offset:       offset,
+			length:       fileInfo.Length,
+		}
+		if moveOnComplete {
+			f.beginPiece, f.endPiece = filePieceRange(info, offset, f.length)
+			if _, err := os.Stat(filePath); err != nil {
+				f.path = filepath.Join(incompleteDir, relPath) + fs.opts.IncompleteSuffix
+				if !isSubFilepath(incompleteDir, f.path) {
+					return nil, TorrentImpl{}, fmt.Errorf(
+						"file %v: path %q is not sub path of %q", i, f.path, incompleteDir)
+				}
+			}
 		}
 		if f.length == 0 {
 			err = CreateNativeZeroLengthFile(f.path)
@@ -80,30 +157,106 @@ func (fs fileClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash
 			}
 		}
 		files = append(files, f)
+		offset += fileInfo.Length
+	}
+	t = &fileTorrentImpl{
+		files:                 files,
+		segmentLocater:        segments.NewIndex(common.LengthIterFromUpvertedFiles(upvertedFiles)),
+		infoHash:              infoHash,
+		completion:            fs.opts.PieceCompletion,
+		info:                  info,
+		dir:                   dir,
+		incompleteDir:         incompleteDir,
+		dirMaker:              fs.opts.TorrentDirMaker,
+		moveTorrentOnComplete: fs.opts.MoveTorrentOnComplete,
+		preallocation:         fs.opts.Preallocation,
+		filePaths:             filePaths,
+		lru:                   fs.lru,
+	}
+	t.part, err = loadPartFile(dir, infoHash, info.PieceLength)
+	if err != nil {
+		err = fmt.Errorf("loading part file: %w", err)
+		return
 	}
-	t := &fileTorrentImpl{
-		files,
-		segments.NewIndex(common.LengthIterFromUpvertedFiles(upvertedFiles)),
-		infoHash,
-		fs.opts.PieceCompletion,
+	t.initSizes()
+	err = t.initUnverifiedPieces(stamps, fs.opts.ForceFullCheck)
+	if err != nil {
+		err = fmt.Errorf("checking file stamps: %w", err)
+		return
 	}
-	return TorrentImpl{
-		Piece: t.Piece,
-		Close: t.Close,
-	}, nil
+	if moveOnComplete {
+		err = t.initPieceCompletion()
+		if err != nil {
+			return
+		}
+	}
+	ret := TorrentImpl{
+		Piece:             t.Piece,
+		Close:             t.Close,
+		Move:              t.Move,
+		AllocateFile:      t.AllocateFile,
+		SetFilePath:       t.SetFilePath,
+		FilePaths:         t.FilePaths,
+		SetFileWanted:     t.SetFileWanted,
+		Device:            t.Device,
+		DiscardFileStamps: t.DiscardFileStamps,
+	}
+	if t.lru != nil {
+		t.lru.addTorrent(t, info, infoHash, t.completion)
+		ret.Capacity = t.lru.torrentCapacity()
+		ret.SubscribePieceCompletion = t.completionSubscribers.Subscribe
+	}
+	return t, ret, nil
 }
 
 type file struct {
 	// The safe, OS-local file path.
-	path   string
+	path string
+	// Where the file belongs once it's complete. This is the same as path when the file is in its
+	// final location.
+	completePath string
+	// The file's offset into the torrent data.
+	offset int64
 	length int64
+	// The range of pieces that overlap the file, and how many of those aren't complete. Only
+	// maintained when files are moved on completion.
+	beginPiece, endPiece int
+	incompletePieces     int
 }
 
 type fileTorrentImpl struct {
+	// Write-locked while the file paths are being changed. Read-locked for IO.
+	mu             sync.RWMutex
 	files          []file
 	segmentLocater segments.Index
 	infoHash       metainfo.Hash
 	completion     PieceCompletion
+	info           *metainfo.Info
+	// The torrent's directory, that file paths are relative to.
+	dir string
+	// Where files are kept until they're complete. The same as dir if files are completed in place.
+	incompleteDir string
+	dirMaker      TorrentDirFilePathMaker
+	// Tracks which pieces are complete, if files are moved on completion. Otherwise nil.
+	pieceComplete         []bool
+	moveTorrentOnComplete bool
+	preallocation         PreallocationMode
+	allocateMu            sync.Mutex
+	// Paths set at runtime, by file index.
+	filePaths map[int]string
+	// Files that have been set as unwanted. Nil if all files are wanted.
+	unwanted []bool
+	// Holds data for unwanted files in pieces shared with wanted files.
+	part *partFile
+	// Shared by the client's torrents if there's a capacity. Otherwise nil.
+	lru                   *pieceLru
+	completionSubscribers pieceCompletionSubscribers
+	// The size of each file on disk, as of when the torrent was opened and grown by writes since.
+	// Accessed atomically, so that heldBytes doesn't have to stat the files.
+	fileSizes    []int64
+	unverifiedMu sync.Mutex
+	// Pieces recorded as complete that must be checked before that's trusted, by piece index.
+	unverified []bool
 }
 
 func (fts *fileTorrentImpl) Piece(p metainfo.Piece) PieceImpl {
@@ -119,9 +272,146 @@ func (fts *fileTorrentImpl) Piece(p metainfo.Piece) PieceImpl {
 }
 
 func (fs *fileTorrentImpl) Close() error {
+	if fs.lru != nil {
+		fs.lru.removeTorrent(fs)
+	}
+	return fs.saveFileStamps()
+}
+
+// Moves the torrent's files to the torrent directory for the new base directory, keeping their
+// paths relative to it. Files that aren't complete yet stay where they are.
+func (fs *fileTorrentImpl) Move(newBaseDir string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	newDir := fs.dirMaker(newBaseDir, fs.info, fs.infoHash)
+	moves := make([]fileMove, 0, len(fs.files))
+	completePaths := make([]string, 0, len(fs.files))
+	for _, f := range fs.files {
+		if !isSubFilepath(fs.dir, f.completePath) {
+			// The file was given a location outside the torrent directory.
+			completePaths = append(completePaths, f.completePath)
+			continue
+		}
+		rel, err := filepath.Rel(fs.dir, f.completePath)
+		if err != nil {
+			return err
+		}
+		completePath := filepath.Join(newDir, rel)
+		completePaths = append(completePaths, completePath)
+		if f.path == f.completePath {
+			moves = append(moves, fileMove{f.path, completePath})
+		}
+	}
+	partMoves := []fileMove{
+		{partFilePath(fs.dir, fs.infoHash), partFilePath(newDir, fs.infoHash)},
+		{partFileIndexPath(fs.dir, fs.infoHash), partFileIndexPath(newDir, fs.infoHash)},
+	}
+	if err := moveFiles(append(moves, partMoves...)); err != nil {
+		return err
+	}
+	for i := range fs.files {
+		f := &fs.files[i]
+		if f.path == f.completePath {
+			f.path = completePaths[i]
+		}
+		f.completePath = completePaths[i]
+	}
+	removeEmptyParentDirs(fs.dir, moves)
+	fs.dir = newDir
 	return nil
 }
 
+// Moves a file to a new path. Files that aren't complete yet are moved when they complete instead.
+func (fs *fileTorrentImpl) SetFilePath(index int, path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	newPath, err := resolveFilePath(fs.dir, path)
+	if err != nil {
+		return err
+	}
+	f := &fs.files[index]
+	// Persist the path before moving the file, so that a failure leaves nothing to undo.
+	restore := restoreFilePath(fs.dir, f.completePath, fs.filePaths, index)
+	err = storeFilePath(fs.completion, fs.infoHash, index, path)
+	if err != nil {
+		return err
+	}
+	if f.path == f.completePath {
+		err = moveFiles([]fileMove{{f.path, newPath}})
+		if err != nil {
+			if restoreErr := storeFilePath(fs.completion, fs.infoHash, index, restore); restoreErr != nil {
+				log.Printf("error restoring path of file %v: %v", index, restoreErr)
+			}
+			return err
+		}
+		removeEmptyParentDirs(fs.dir, []fileMove{{f.path, newPath}})
+		f.path = newPath
+	}
+	f.completePath = newPath
+	if fs.filePaths == nil {
+		fs.filePaths = make(map[int]string)
+	}
+	fs.filePaths[index] = path
+	return nil
+}
+
+// The size of the torrent's data on disk, including data held for unwanted files.
+func (fs *fileTorrentImpl) heldBytes() (ret int64) {
+	for i := range fs.fileSizes {
+		ret += atomic.LoadInt64(&fs.fileSizes[i])
+	}
+	return ret + atomic.LoadInt64(&fs.part.size)
+}
+
+func (fs *fileTorrentImpl) initSizes() {
+	fs.fileSizes = make([]int64, len(fs.files))
+	for i, f := range fs.files {
+		if fi, err := os.Stat(f.path); err == nil {
+			fs.fileSizes[i] = fi.Size()
+		}
+	}
+	if fi, err := os.Stat(partFilePath(fs.dir, fs.infoHash)); err == nil {
+		fs.part.size = fi.Size()
+	}
+}
+
+// Records that a file is at least size bytes long on disk.
+func (fs *fileTorrentImpl) fileGrew(index int, size int64) {
+	growSize(&fs.fileSizes[index], size)
+}
+
+func growSize(p *int64, size int64) {
+	for {
+		old := atomic.LoadInt64(p)
+		if size <= old || atomic.CompareAndSwapInt64(p, old, size) {
+			return
+		}
+	}
+}
+
+// Identifies the device of the torrent's directory, or of its nearest existing parent.
+func (fs *fileTorrentImpl) Device() string {
+	fs.mu.RLock()
+	dir := fs.dir
+	fs.mu.RUnlock()
+	for {
+		if id, ok := deviceId(dir); ok {
+			return id
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func (fs *fileTorrentImpl) FilePaths() map[int]string {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return copyFilePaths(fs.filePaths)
+}
+
 // A helper to create zero-length files which won't appear for file-orientated storage since no
 // writes will ever occur to them (no torrent data is associated with a zero-length file). The
 // caller should make sure the file name provided is safe/sanitized.
@@ -171,8 +461,15 @@ func (fst *fileTorrentImplIO) readFileAt(file file, b []byte, off int64) (n int,
 
 // Only returns EOF at the end of the torrent. Premature EOF is ErrUnexpectedEOF.
 func (fst fileTorrentImplIO) ReadAt(b []byte, off int64) (n int, err error) {
+	fst.fts.mu.RLock()
+	defer fst.fts.mu.RUnlock()
+	// Reads are within a piece.
+	piece := int(off / fst.fts.info.PieceLength)
 	fst.fts.segmentLocater.Locate(segments.Extent{off, int64(len(b))}, func(i int, e segments.Extent) bool {
-		n1, err1 := fst.readFileAt(fst.fts.files[i], b[:e.Length], e.Start)
+		n1, handled, err1 := fst.fts.partIo(piece, i, b[:e.Length], e.Start, false)
+		if !handled {
+			n1, err1 = fst.readFileAt(fst.fts.files[i], b[:e.Length], e.Start)
+		}
 		n += n1
 		b = b[n1:]
 		err = err1
@@ -185,8 +482,23 @@ func (fst fileTorrentImplIO) ReadAt(b []byte, off int64) (n int, err error) {
 }
 
 func (fst fileTorrentImplIO) WriteAt(p []byte, off int64) (n int, err error) {
+	fst.fts.mu.RLock()
+	defer fst.fts.mu.RUnlock()
+	// Writes are within a piece.
+	piece := int(off / fst.fts.info.PieceLength)
 	// log.Printf("write at %v: %v bytes", off, len(p))
 	fst.fts.segmentLocater.Locate(segments.Extent{off, int64(len(p))}, func(i int, e segments.Extent) bool {
+		var n1 int
+		var handled bool
+		n1, handled, err = fst.fts.partIo(piece, i, p[:e.Length], e.Start, true)
+		if handled {
+			n += n1
+			p = p[n1:]
+			if err == nil && int64(n1) != e.Length {
+				err = io.ErrShortWrite
+			}
+			return err == nil
+		}
 		name := fst.fts.files[i].path
 		os.MkdirAll(filepath.Dir(name), 0o777)
 		var f *os.File
@@ -194,9 +506,9 @@ func (fst fileTorrentImplIO) WriteAt(p []byte, off int64) (n int, err error) {
 		if err != nil {
 			return false
 		}
-		var n1 int
 		n1, err = f.WriteAt(p[:e.Length], e.Start)
 		// log.Printf("%v %v wrote %v: %v", i, e, n1, err)
+		fst.fts.fileGrew(i, e.Start+int64(n1))
 		closeErr := f.Close()
 		n += n1
 		p = p[n1:]
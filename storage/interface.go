@@ -26,6 +26,34 @@ type TorrentImpl struct {
 	// to determine the storage for torrents sharing the same function pointer, and mutated in
 	// place.
 	Capacity TorrentCapacity
+	// Optional. Relocates the torrent's data under a new base directory while the torrent remains
+	// open. Implementations should block IO while moving, and retain piece completion so that no
+	// recheck is needed.
+	Move func(newBaseDir string) error
+	// Optional. Called for files overlapping a piece that becomes wanted, so that space can be
+	// allocated ahead of writes. Files set unwanted with SetFileWanted should be skipped, and
+	// allocated when they're wanted again. The index is into the info's upverted files. An error
+	// fails the torrent.
+	AllocateFile func(fileIndex int) error
+	// Optional. Renames or relocates a single file, moving any existing data. Absolute paths are used
+	// as is, and relative paths are '/' separated and relative to the torrent's directory. The path
+	// is persisted with the piece completion where supported.
+	SetFilePath func(fileIndex int, path string) error
+	// Optional. Returns the paths set with SetFilePath, including those persisted by earlier
+	// sessions, by file index.
+	FilePaths func() map[int]string
+	// Optional. Sets whether a file is wanted, such as when its priority changes. Storage can avoid
+	// creating files that aren't wanted, for data in pieces they share with wanted files.
+	SetFileWanted func(fileIndex int, wanted bool) error
+	// Optional. Registers a function for the storage to call when it changes the completion of a
+	// piece itself, such as when evicting data to stay within its capacity.
+	SubscribePieceCompletion func(func(pieceIndex int))
+	// Optional. Identifies the device holding the torrent's data, so that concurrent hashing can be
+	// limited per device. Torrents on the same device should return the same string.
+	Device func() string
+	// Optional. Stops trusting recorded piece completion until each piece has been checked again,
+	// including in later sessions if the torrent is closed first.
+	DiscardFileStamps func() error
 }
 
 // Interacts with torrent piece data. Optional interfaces to implement include:
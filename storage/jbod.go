@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+type JBODDir struct {
+	Path string
+	// The share of new data the directory gets, relative to the others, scaled by its free space.
+	// Zero is treated as 1.
+	Weight float64
+}
+
+type NewJBODClientOpts struct {
+	// The data directories, such as one for each disk.
+	Dirs []JBODDir
+	// Place each file separately, rather than all of a torrent's files in one directory.
+	PerFile bool
+	// Where placements are persisted. Defaults to the first data directory.
+	StateDir string
+	// Options for storing files in each directory. ClientBaseDir is ignored, and PieceCompletion
+	// defaults to one in StateDir.
+	File NewFileClientOpts
+}
+
+// Stores torrents across several independent data directories. Torrents, or their files, are placed
+// in the directory with the most free space after weighting, and the placement is remembered. If a
+// directory becomes unavailable, only the torrents placed in it fail to open.
+func NewJBOD(opts NewJBODClientOpts) (ClientImplCloser, error) {
+	if len(opts.Dirs) == 0 {
+		return nil, errors.New("no data directories")
+	}
+	if opts.StateDir == "" {
+		opts.StateDir = opts.Dirs[0].Path
+	}
+	if opts.File.PieceCompletion == nil {
+		opts.File.PieceCompletion = pieceCompletionForDir(opts.StateDir)
+	}
+	opts.File.ClientBaseDir = opts.StateDir
+	ret := &jbodClientImpl{
+		opts:       opts,
+		file:       NewFileOpts(opts.File).(fileClientImpl),
+		placements: make(map[string]jbodPlacement),
+		open:       make(map[*fileTorrentImpl]struct{}),
+	}
+	ret.capacityFunc = ret.capacity
+	b, err := os.ReadFile(ret.placementsPath())
+	if err == nil {
+		err = bencode.Unmarshal(b, &ret.placements)
+		if err != nil {
+			return nil, fmt.Errorf("decoding placements: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading placements: %w", err)
+	}
+	return ret, nil
+}
+
+type jbodClientImpl struct {
+	opts NewJBODClientOpts
+	file fileClientImpl
+	mu   sync.Mutex
+	// By hex infohash.
+	placements map[string]jbodPlacement
+	// Torrents that are open, for the data they hold.
+	open         map[*fileTorrentImpl]struct{}
+	capacityFunc func() (int64, bool)
+	// The free space last found by freeSpace, and when.
+	free       int64
+	freeCapped bool
+	freeAt     time.Time
+}
+
+// How long the free space of the data directories is reused for. Capacity is checked whenever
+// requests are updated, which is too often to stat every directory each time.
+const jbodFreeSpaceTtl = 5 * time.Second
+
+type jbodPlacement struct {
+	// The data directory holding the torrent, or the torrent directory for files placed
+	// separately.
+	Dir string `bencode:"dir"`
+	// The data directory for each file, if files are placed separately.
+	Files []string `bencode:"files,omitempty"`
+}
+
+func (me *jbodClientImpl) placementsPath() string {
+	return filepath.Join(me.opts.StateDir, ".torrent.jbod")
+}
+
+// Must be called with the lock held.
+func (me *jbodClientImpl) savePlacements() error {
+	b, err := bencode.Marshal(me.placements)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(me.placementsPath(), b, 0o666)
+}
+
+func dirAvailable(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir()
+}
+
+// The space in a data directory that new data can use, scaled by its weight.
+type jbodDirSpace struct {
+	path   string
+	weight float64
+	free   int64
+}
+
+func (me *jbodDirSpace) score() float64 {
+	return float64(me.free) * me.weight
+}
+
+// Returns the available data directories and their free space.
+func (me *jbodClientImpl) dirSpaces() (ret []*jbodDirSpace) {
+	for _, d := range me.opts.Dirs {
+		if !dirAvailable(d.Path) {
+			continue
+		}
+		s := &jbodDirSpace{path: d.Path, weight: d.Weight}
+		if s.weight == 0 {
+			s.weight = 1
+		}
+		free, ok, err := freeDiskSpace(d.Path)
+		if ok && err == nil {
+			s.free = free
+		} else {
+			// Without knowing free space, placement is by weight alone.
+			s.free = 1
+		}
+		ret = append(ret, s)
+	}
+	return
+}
+
+func bestJBODDir(spaces []*jbodDirSpace) *jbodDirSpace {
+	var best *jbodDirSpace
+	for _, s := range spaces {
+		if best == nil || s.score() > best.score() {
+			best = s
+		}
+	}
+	return best
+}
+
+// Chooses where a new torrent's data goes. Files are placed largest first, accounting for the
+// space taken by those placed before them.
+func (me *jbodClientImpl) place(info *metainfo.Info) (ret jbodPlacement, err error) {
+	spaces := me.dirSpaces()
+	if len(spaces) == 0 {
+		err = errors.New("no data directories are available")
+		return
+	}
+	if !me.opts.PerFile {
+		ret.Dir = bestJBODDir(spaces).path
+		return
+	}
+	files := info.UpvertedFiles()
+	order := make([]int, len(files))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return files[order[i]].Length > files[order[j]].Length
+	})
+	ret.Files = make([]string, len(files))
+	for _, i := range order {
+		best := bestJBODDir(spaces)
+		ret.Files[i] = best.path
+		best.free -= files[i].Length
+	}
+	ret.Dir = ret.Files[order[0]]
+	return
+}
+
+func (me *jbodClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
+	me.mu.Lock()
+	placement, ok := me.placements[infoHash.HexString()]
+	if !ok {
+		var err error
+		placement, err = me.place(info)
+		if err != nil {
+			me.mu.Unlock()
+			return TorrentImpl{}, err
+		}
+		me.placements[infoHash.HexString()] = placement
+		err = me.savePlacements()
+		if err != nil {
+			me.mu.Unlock()
+			return TorrentImpl{}, fmt.Errorf("saving placements: %w", err)
+		}
+	}
+	me.mu.Unlock()
+	for _, dir := range append([]string{placement.Dir}, placement.Files...) {
+		if !dirAvailable(dir) {
+			return TorrentImpl{}, fmt.Errorf("data directory %q is unavailable", dir)
+		}
+	}
+	fc := me.file
+	fc.opts.ClientBaseDir = placement.Dir
+	if placement.Files != nil {
+		fc.fileBaseDir = func(_ metainfo.Hash, fileIndex int) string {
+			return placement.Files[fileIndex]
+		}
+	}
+	t, ret, err := fc.openTorrent(info, infoHash)
+	if err != nil {
+		return ret, err
+	}
+	if ret.Capacity == nil {
+		ret.Capacity = &me.capacityFunc
+	}
+	me.mu.Lock()
+	me.open[t] = struct{}{}
+	me.mu.Unlock()
+	ret.Close = func() error {
+		me.mu.Lock()
+		delete(me.open, t)
+		me.mu.Unlock()
+		return t.Close()
+	}
+	return ret, nil
+}
+
+// The free space on the available data directories' filesystems, plus the data that open torrents
+// already hold.
+func (me *jbodClientImpl) capacity() (total int64, capped bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if now := time.Now(); now.Sub(me.freeAt) >= jbodFreeSpaceTtl {
+		me.free, me.freeCapped = me.freeSpace()
+		me.freeAt = now
+	}
+	if !me.freeCapped {
+		return
+	}
+	total = me.free
+	for t := range me.open {
+		total += t.heldBytes()
+	}
+	return total, true
+}
+
+// Returns the free space on the available data directories' filesystems, each counted once.
+func (me *jbodClientImpl) freeSpace() (total int64, capped bool) {
+	devices := make(map[string]struct{})
+	for _, d := range me.opts.Dirs {
+		_, free, ok, err := diskSpace(d.Path)
+		if !ok || err != nil {
+			continue
+		}
+		device, ok := deviceId(d.Path)
+		if !ok {
+			device = d.Path
+		}
+		if _, ok := devices[device]; ok {
+			continue
+		}
+		devices[device] = struct{}{}
+		total += free
+		capped = true
+	}
+	return
+}
+
+func (me *jbodClientImpl) Close() error {
+	return me.file.Close()
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func jbodTestInfo(name string) *metainfo.Info {
+	return &metainfo.Info{
+		Name:        name,
+		PieceLength: 1 << 10,
+		Pieces:      make([]byte, 3*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"big"}, Length: 2 << 10},
+			{Path: []string{"small"}, Length: 1 << 10},
+		},
+	}
+}
+
+func writeJBODTestTorrent(c *qt.C, ci ClientImpl, info *metainfo.Info, ih metainfo.Hash) {
+	ts, err := ci.OpenTorrent(info, ih)
+	c.Assert(err, qt.IsNil)
+	defer ts.Close()
+	for i := 0; i < info.NumPieces(); i++ {
+		_, err := ts.Piece(info.Piece(i)).WriteAt([]byte("x"), 0)
+		c.Assert(err, qt.IsNil)
+	}
+}
+
+func TestJBODPlacesTorrentsByWeight(t *testing.T) {
+	c := qt.New(t)
+	a, b := t.TempDir(), t.TempDir()
+	opts := NewJBODClientOpts{
+		Dirs: []JBODDir{{Path: a, Weight: 1}, {Path: b, Weight: 1000}},
+		File: NewFileClientOpts{PieceCompletion: NewMapPieceCompletion()},
+	}
+	ci, err := NewJBOD(opts)
+	c.Assert(err, qt.IsNil)
+	info := jbodTestInfo("t")
+	writeJBODTestTorrent(c, ci, info, metainfo.Hash{1})
+	_, err = os.Stat(filepath.Join(b, "t", "big"))
+	c.Check(err, qt.IsNil)
+	_, err = os.Stat(filepath.Join(a, "t"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+	ts, err := ci.OpenTorrent(info, metainfo.Hash{1})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ts.Capacity, qt.Not(qt.IsNil))
+	ts.Close()
+
+	// The placement is remembered, even though the weights have changed.
+	opts.Dirs[0].Weight, opts.Dirs[1].Weight = 1000, 1
+	ci, err = NewJBOD(opts)
+	c.Assert(err, qt.IsNil)
+	writeJBODTestTorrent(c, ci, jbodTestInfo("u"), metainfo.Hash{2})
+	_, err = os.Stat(filepath.Join(a, "u", "big"))
+	c.Check(err, qt.IsNil)
+	writeJBODTestTorrent(c, ci, info, metainfo.Hash{1})
+	_, err = os.Stat(filepath.Join(a, "t"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+
+	// Only the torrents in an unavailable directory fail.
+	c.Assert(os.RemoveAll(b), qt.IsNil)
+	_, err = ci.OpenTorrent(info, metainfo.Hash{1})
+	c.Check(err, qt.ErrorMatches, `data directory .* is unavailable`)
+	_, err = ci.OpenTorrent(jbodTestInfo("u"), metainfo.Hash{2})
+	c.Check(err, qt.IsNil)
+}
+
+func TestJBODPlacesFilesSeparately(t *testing.T) {
+	c := qt.New(t)
+	a, b := t.TempDir(), t.TempDir()
+	ci, err := NewJBOD(NewJBODClientOpts{
+		Dirs:    []JBODDir{{Path: a}, {Path: b}},
+		PerFile: true,
+		File:    NewFileClientOpts{PieceCompletion: NewMapPieceCompletion()},
+	})
+	c.Assert(err, qt.IsNil)
+	writeJBODTestTorrent(c, ci, jbodTestInfo("t"), metainfo.Hash{1})
+	// The largest file goes first, and takes space from its directory.
+	_, err = os.Stat(filepath.Join(a, "t", "big"))
+	c.Check(err, qt.IsNil)
+	_, err = os.Stat(filepath.Join(b, "t", "small"))
+	c.Check(err, qt.IsNil)
+}
+
+func TestJBODCapacityCountsDevicesOnceAndHeldData(t *testing.T) {
+	c := qt.New(t)
+	a, b := t.TempDir(), t.TempDir()
+	_, free, ok, err := diskSpace(a)
+	if !ok || err != nil {
+		c.Skip("free space unknown")
+	}
+	ci, err := NewJBOD(NewJBODClientOpts{
+		Dirs: []JBODDir{{Path: a}, {Path: b}},
+		File: NewFileClientOpts{PieceCompletion: NewMapPieceCompletion()},
+	})
+	c.Assert(err, qt.IsNil)
+	info := jbodTestInfo("t")
+	ts, err := ci.OpenTorrent(info, metainfo.Hash{1})
+	c.Assert(err, qt.IsNil)
+	defer ts.Close()
+	_, err = ts.Piece(info.Piece(1)).WriteAt([]byte("x"), 0)
+	c.Assert(err, qt.IsNil)
+	capacity, capped := (*ts.Capacity)()
+	c.Assert(capped, qt.IsTrue)
+	// The directories share a filesystem, so its free space is only counted once. The written
+	// data is counted even though it's no longer free. Allow for other use of the filesystem.
+	held := capacity - free
+	c.Check(held > -1<<20 && held < 1<<20, qt.IsTrue, qt.Commentf("capacity %v, free %v", capacity, free))
+	jbod := ci.(*jbodClientImpl)
+	c.Assert(jbod.open, qt.HasLen, 1)
+	for t := range jbod.open {
+		c.Check(t.heldBytes(), qt.Equals, int64(1<<10+1))
+	}
+	// Free space is reused for a while, and held data is tracked from writes.
+	_, err = ts.Piece(info.Piece(1)).WriteAt([]byte("y"), 9)
+	c.Assert(err, qt.IsNil)
+	capacity2, _ := (*ts.Capacity)()
+	c.Check(capacity2-capacity, qt.Equals, int64(9))
+	c.Assert(ts.Close(), qt.IsNil)
+	c.Check(jbod.open, qt.HasLen, 0)
+}
@@ -9,9 +9,17 @@ import (
 type mapPieceCompletion struct {
 	// TODO: Generics
 	m sync.Map
+
+	filePathsMu sync.Mutex
+	filePaths   map[metainfo.Hash]map[int]string
+	fileStamps  map[metainfo.Hash]map[int]FileStamp
 }
 
-var _ PieceCompletion = (*mapPieceCompletion)(nil)
+var (
+	_ PieceCompletion = (*mapPieceCompletion)(nil)
+	_ FilePathStore   = (*mapPieceCompletion)(nil)
+	_ FileStampStore  = (*mapPieceCompletion)(nil)
+)
 
 func NewMapPieceCompletion() PieceCompletion {
 	return &mapPieceCompletion{}
@@ -32,3 +40,45 @@ func (me *mapPieceCompletion) Set(pk metainfo.PieceKey, b bool) error {
 	me.m.Store(pk, b)
 	return nil
 }
+
+func (me *mapPieceCompletion) GetFilePaths(ih metainfo.Hash) (map[int]string, error) {
+	me.filePathsMu.Lock()
+	defer me.filePathsMu.Unlock()
+	return copyFilePaths(me.filePaths[ih]), nil
+}
+
+func (me *mapPieceCompletion) SetFilePath(ih metainfo.Hash, fileIndex int, path string) error {
+	me.filePathsMu.Lock()
+	defer me.filePathsMu.Unlock()
+	if me.filePaths == nil {
+		me.filePaths = make(map[metainfo.Hash]map[int]string)
+	}
+	if me.filePaths[ih] == nil {
+		me.filePaths[ih] = make(map[int]string)
+	}
+	me.filePaths[ih][fileIndex] = path
+	return nil
+}
+
+func (me *mapPieceCompletion) GetFileStamps(ih metainfo.Hash) (map[int]FileStamp, error) {
+	me.filePathsMu.Lock()
+	defer me.filePathsMu.Unlock()
+	ret := make(map[int]FileStamp, len(me.fileStamps[ih]))
+	for k, v := range me.fileStamps[ih] {
+		ret[k] = v
+	}
+	return ret, nil
+}
+
+func (me *mapPieceCompletion) SetFileStamp(ih metainfo.Hash, fileIndex int, stamp FileStamp) error {
+	me.filePathsMu.Lock()
+	defer me.filePathsMu.Unlock()
+	if me.fileStamps == nil {
+		me.fileStamps = make(map[metainfo.Hash]map[int]FileStamp)
+	}
+	if me.fileStamps[ih] == nil {
+		me.fileStamps[ih] = make(map[int]FileStamp)
+	}
+	me.fileStamps[ih][fileIndex] = stamp
+	return nil
+}
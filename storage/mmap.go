@@ -7,19 +7,24 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/anacrolix/missinggo/v2"
 	"github.com/edsrzf/mmap-go"
 
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/mmap_span"
+	"github.com/anacrolix/torrent/segments"
 )
 
 type mmapClientImpl struct {
 	baseDir string
 	pc      PieceCompletion
+	// Tracks complete pieces across torrents if there's a capacity. Otherwise nil.
+	lru *pieceLru
 }
 
 // TODO: Support all the same native filepath configuration that NewFileOpts provides.
@@ -28,20 +33,70 @@ func NewMMap(baseDir string) ClientImplCloser {
 }
 
 func NewMMapWithCompletion(baseDir string, completion PieceCompletion) *mmapClientImpl {
-	return &mmapClientImpl{
-		baseDir: baseDir,
-		pc:      completion,
+	return NewMMapOpts(NewMMapClientOpts{
+		BaseDir:         baseDir,
+		PieceCompletion: completion,
+	})
+}
+
+type NewMMapClientOpts struct {
+	BaseDir         string
+	PieceCompletion PieceCompletion
+	// If positive, the most space complete pieces can use across all torrents. When it's exceeded,
+	// the least recently accessed pieces are marked not complete, and holes are punched in their
+	// files where possible.
+	Capacity int64
+}
+
+func NewMMapOpts(opts NewMMapClientOpts) *mmapClientImpl {
+	if opts.PieceCompletion == nil {
+		opts.PieceCompletion = pieceCompletionForDir(opts.BaseDir)
+	}
+	ret := &mmapClientImpl{
+		baseDir: opts.BaseDir,
+		pc:      opts.PieceCompletion,
 	}
+	if opts.Capacity > 0 {
+		ret.lru = newPieceLru(opts.Capacity)
+	}
+	return ret
 }
 
 func (s *mmapClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (_ TorrentImpl, err error) {
-	span, err := mMapTorrent(info, s.baseDir)
+	filePaths, err := loadFilePaths(s.pc, infoHash)
+	if err != nil {
+		err = fmt.Errorf("loading file paths: %w", err)
+		return
+	}
+	paths, err := mmapFilePaths(info, s.baseDir, filePaths)
+	if err != nil {
+		return
+	}
+	span, err := mMapTorrent(info, paths)
 	t := &mmapTorrentStorage{
-		infoHash: infoHash,
-		span:     span,
-		pc:       s.pc,
+		infoHash:  infoHash,
+		span:      span,
+		pc:        s.pc,
+		info:      info,
+		baseDir:   s.baseDir,
+		paths:     paths,
+		filePaths: filePaths,
+		lru:       s.lru,
+	}
+	ret := TorrentImpl{
+		Piece:       t.Piece,
+		Close:       t.Close,
+		Move:        t.Move,
+		SetFilePath: t.SetFilePath,
+		FilePaths:   t.FilePaths,
+	}
+	if t.lru != nil && err == nil {
+		t.segmentLocater = newFileSegmentsIndex(info)
+		t.lru.addTorrent(t, info, infoHash, s.pc)
+		ret.Capacity = t.lru.torrentCapacity()
+		ret.SubscribePieceCompletion = t.completionSubscribers.Subscribe
 	}
-	return TorrentImpl{Piece: t.Piece, Close: t.Close}, err
+	return ret, err
 }
 
 func (s *mmapClientImpl) Close() error {
@@ -52,10 +107,23 @@ type mmapTorrentStorage struct {
 	infoHash metainfo.Hash
 	span     *mmap_span.MMapSpan
 	pc       PieceCompletionGetSetter
+	info     *metainfo.Info
+	// These are only changed while the span is being remapped.
+	baseDir string
+	// The OS path of each file.
+	paths       []string
+	filePathsMu sync.Mutex
+	// Paths set at runtime, by file index.
+	filePaths map[int]string
+	// Shared by the client's torrents if there's a capacity. Otherwise nil.
+	lru                   *pieceLru
+	segmentLocater        segments.Index
+	completionSubscribers pieceCompletionSubscribers
 }
 
 func (ts *mmapTorrentStorage) Piece(p metainfo.Piece) PieceImpl {
 	return mmapStoragePiece{
+		t:        ts,
 		pc:       ts.pc,
 		p:        p,
 		ih:       ts.infoHash,
@@ -64,7 +132,116 @@ func (ts *mmapTorrentStorage) Piece(p metainfo.Piece) PieceImpl {
 	}
 }
 
+// Unmaps the torrent's files, moves them under the new base directory, and maps them again. If the
+// files can't be unmapped or the move fails, the files are mapped at their original location. Files
+// given locations outside the base directory aren't moved.
+func (ts *mmapTorrentStorage) Move(newBaseDir string) error {
+	return ts.span.Remap(func(unmapErr error) ([]mmap.MMap, error) {
+		if unmapErr != nil {
+			return ts.remapFiles(fmt.Errorf("unmapping files: %w", unmapErr))
+		}
+		moves := make([]fileMove, 0, len(ts.paths))
+		newPaths := make([]string, 0, len(ts.paths))
+		for _, path := range ts.paths {
+			newPath := path
+			if isSubFilepath(ts.baseDir, path) {
+				rel, err := filepath.Rel(ts.baseDir, path)
+				if err != nil {
+					return nil, err
+				}
+				newPath = filepath.Join(newBaseDir, rel)
+			}
+			moves = append(moves, fileMove{path, newPath})
+			newPaths = append(newPaths, newPath)
+		}
+		err := moveFiles(moves)
+		if err == nil {
+			removeEmptyParentDirs(ts.baseDir, moves)
+			ts.baseDir = newBaseDir
+			ts.paths = newPaths
+		}
+		return ts.remapFiles(err)
+	})
+}
+
+// Unmaps the file, moves it to the new path and maps the torrent's files again.
+func (ts *mmapTorrentStorage) SetFilePath(index int, path string) error {
+	return ts.span.Remap(func(unmapErr error) ([]mmap.MMap, error) {
+		if unmapErr != nil {
+			return ts.remapFiles(fmt.Errorf("unmapping files: %w", unmapErr))
+		}
+		newPath, err := resolveFilePath(ts.baseDir, path)
+		if err != nil {
+			return ts.remapFiles(err)
+		}
+		// Persist the path before moving the file, so that a failure leaves nothing to undo.
+		restore := restoreFilePath(ts.baseDir, ts.paths[index], ts.FilePaths(), index)
+		err = ts.setFilePath(index, path)
+		if err != nil {
+			return ts.remapFiles(err)
+		}
+		moves := []fileMove{{ts.paths[index], newPath}}
+		err = moveFiles(moves)
+		if err != nil {
+			if restoreErr := ts.setFilePath(index, restore); restoreErr != nil {
+				log.Printf("error restoring path of file %v: %v", index, restoreErr)
+			}
+			return ts.remapFiles(err)
+		}
+		removeEmptyParentDirs(ts.baseDir, moves)
+		ts.paths[index] = newPath
+		return ts.remapFiles(nil)
+	})
+}
+
+func (ts *mmapTorrentStorage) setFilePath(index int, path string) error {
+	ts.filePathsMu.Lock()
+	defer ts.filePathsMu.Unlock()
+	err := storeFilePath(ts.pc, ts.infoHash, index, path)
+	if err != nil {
+		return err
+	}
+	if ts.filePaths == nil {
+		ts.filePaths = make(map[int]string)
+	}
+	ts.filePaths[index] = path
+	return nil
+}
+
+func (ts *mmapTorrentStorage) FilePaths() map[int]string {
+	ts.filePathsMu.Lock()
+	defer ts.filePathsMu.Unlock()
+	return copyFilePaths(ts.filePaths)
+}
+
+// Maps the files at their current paths, returning err in preference to any mapping error.
+func (ts *mmapTorrentStorage) remapFiles(err error) ([]mmap.MMap, error) {
+	mMaps, mapErr := mMapFiles(ts.info, ts.paths)
+	if err == nil {
+		err = mapErr
+	}
+	return mMaps, err
+}
+
+// Marks the piece not complete, and frees its space where the filesystem supports it.
+func (ts *mmapTorrentStorage) evictPiece(piece int) {
+	err := ts.pc.Set(metainfo.PieceKey{InfoHash: ts.infoHash, Index: piece}, false)
+	if err != nil {
+		log.Printf("error marking evicted piece %v not complete: %v", piece, err)
+		return
+	}
+	ts.span.WithReadLock(func() {
+		punchPieceHoles(ts.info, ts.segmentLocater, piece, func(i int) string {
+			return ts.paths[i]
+		}, nil)
+	})
+	ts.completionSubscribers.notify(piece)
+}
+
 func (ts *mmapTorrentStorage) Close() error {
+	if ts.lru != nil {
+		ts.lru.removeTorrent(ts)
+	}
 	errs := ts.span.Close()
 	if len(errs) > 0 {
 		return errs[0]
@@ -73,6 +250,7 @@ func (ts *mmapTorrentStorage) Close() error {
 }
 
 type mmapStoragePiece struct {
+	t  *mmapTorrentStorage
 	pc PieceCompletionGetSetter
 	p  metainfo.Piece
 	ih metainfo.Hash
@@ -94,39 +272,80 @@ func (sp mmapStoragePiece) Completion() Completion {
 
 func (sp mmapStoragePiece) MarkComplete() error {
 	sp.pc.Set(sp.pieceKey(), true)
+	if sp.t.lru != nil {
+		sp.t.lru.complete(sp.t, sp.p.Index(), sp.p.Length())
+	}
 	return nil
 }
 
 func (sp mmapStoragePiece) MarkNotComplete() error {
 	sp.pc.Set(sp.pieceKey(), false)
+	if sp.t.lru != nil {
+		sp.t.lru.remove(sp.t, sp.p.Index())
+	}
 	return nil
 }
 
-func mMapTorrent(md *metainfo.Info, location string) (mms *mmap_span.MMapSpan, err error) {
-	mms = &mmap_span.MMapSpan{}
-	defer func() {
-		if err != nil {
-			mms.Close()
+func (sp mmapStoragePiece) ReadAt(b []byte, off int64) (int, error) {
+	if sp.t.lru != nil {
+		sp.t.lru.touch(sp.t, sp.p.Index())
+	}
+	return sp.ReaderAt.ReadAt(b, off)
+}
+
+func (sp mmapStoragePiece) WriteAt(b []byte, off int64) (int, error) {
+	if sp.t.lru != nil {
+		sp.t.lru.touch(sp.t, sp.p.Index())
+	}
+	return sp.WriterAt.WriteAt(b, off)
+}
+
+// Returns the OS path for each of the torrent's files, with any paths set at runtime applied.
+func mmapFilePaths(md *metainfo.Info, baseDir string, filePaths map[int]string) (paths []string, err error) {
+	for i, miFile := range md.UpvertedFiles() {
+		var path string
+		if custom, ok := filePaths[i]; ok {
+			path, err = resolveFilePath(baseDir, custom)
+		} else {
+			var safeName string
+			safeName, err = ToSafeFilePath(append([]string{md.Name}, miFile.Path...)...)
+			path = filepath.Join(baseDir, safeName)
 		}
-	}()
-	for _, miFile := range md.UpvertedFiles() {
-		var safeName string
-		safeName, err = ToSafeFilePath(append([]string{md.Name}, miFile.Path...)...)
 		if err != nil {
 			return
 		}
-		fileName := filepath.Join(location, safeName)
+		paths = append(paths, path)
+	}
+	return
+}
+
+func mMapTorrent(md *metainfo.Info, paths []string) (mms *mmap_span.MMapSpan, err error) {
+	mms = &mmap_span.MMapSpan{}
+	mMaps, err := mMapFiles(md, paths)
+	for _, mm := range mMaps {
+		mms.Append(mm)
+	}
+	mms.InitIndex()
+	if err != nil {
+		mms.Close()
+	}
+	return
+}
+
+// Maps the torrent's files at the given paths. On error, the regions mapped so far are returned so
+// the caller can unmap them.
+func mMapFiles(md *metainfo.Info, paths []string) (mMaps []mmap.MMap, err error) {
+	for i, miFile := range md.UpvertedFiles() {
 		var mm mmap.MMap
-		mm, err = mmapFile(fileName, miFile.Length)
+		mm, err = mmapFile(paths[i], miFile.Length)
 		if err != nil {
 			err = fmt.Errorf("file %q: %s", miFile.DisplayPath(md), err)
 			return
 		}
 		if mm != nil {
-			mms.Append(mm)
+			mMaps = append(mMaps, mm)
 		}
 	}
-	mms.InitIndex()
 	return
 }
 
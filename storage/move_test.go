@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func testMoveTorrent(t *testing.T, ci func(string) ClientImplCloser) {
+	c := qt.New(t)
+	oldDir := t.TempDir()
+	newDir := filepath.Join(t.TempDir(), "moved")
+	cs := ci(oldDir)
+	defer cs.Close()
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 2,
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 1},
+			{Path: []string{"sub", "b"}, Length: 1},
+		},
+	}
+	ts, err := NewClient(cs).OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	defer ts.Close()
+	p := ts.Piece(info.Piece(0))
+	_, err = p.WriteAt([]byte("hi"), 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.MarkComplete(), qt.IsNil)
+	c.Assert(ts.Move(newDir), qt.IsNil)
+	_, err = os.Stat(filepath.Join(oldDir, "t", "sub"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+	b, err := os.ReadFile(filepath.Join(newDir, "t", "sub", "b"))
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "i")
+	buf := make([]byte, 2)
+	_, err = p.ReadAt(buf, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(string(buf), qt.Equals, "hi")
+	c.Check(p.Completion().Complete, qt.IsTrue)
+}
+
+func TestMoveFileTorrent(t *testing.T) {
+	testMoveTorrent(t, NewFile)
+}
+
+func TestMoveMMapTorrent(t *testing.T) {
+	testMoveTorrent(t, NewMMap)
+}
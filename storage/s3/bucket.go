@@ -0,0 +1,276 @@
+package s3Storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNotFound = errors.New("object not found")
+
+// A minimal client for the parts of the S3 API that the storage uses. Requests are signed with AWS
+// Signature Version 4, and use path-style addressing so they work with S3-compatible servers.
+type bucket struct {
+	endpoint        string
+	name            string
+	region          string
+	accessKeyId     string
+	secretAccessKey string
+	httpClient      *http.Client
+}
+
+// Encodes a string as S3 requires for canonical requests. Slashes are kept for object key paths.
+func awsUriEncode(s string, keepSlash bool) string {
+	var sb strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && keepSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, awsUriEncode(k, false)+"="+awsUriEncode(v, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Adds the AWS Signature Version 4 headers to the request. The host, any range, and the x-amz-*
+// headers are signed.
+func signRequest(
+	req *http.Request, encodedPath, query, payloadHash, accessKeyId, secretAccessKey, region string,
+	now time.Time,
+) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, vs := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "range" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(vs, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method, encodedPath, query, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSha256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyId, scope, signedHeaders, signature))
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Makes a signed request for an object, returning the response if it was successful.
+func (b *bucket) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	encodedPath := "/" + awsUriEncode(b.name, false) + "/" + awsUriEncode(key, true)
+	q := canonicalQuery(query)
+	u := strings.TrimSuffix(b.endpoint, "/") + encodedPath
+	if q != "" {
+		u += "?" + q
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	signRequest(req, encodedPath, q, sha256Hex(body), b.accessKeyId, b.secretAccessKey, b.region, time.Now())
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s %q: %w", method, key, errNotFound)
+	}
+	var e s3Error
+	respBody, _ := io.ReadAll(resp.Body)
+	if xml.Unmarshal(respBody, &e) == nil && e.Code != "" {
+		return nil, fmt.Errorf("%s %q: %s: %s", method, key, e.Code, e.Message)
+	}
+	return nil, fmt.Errorf("%s %q: unexpected status %v", method, key, resp.Status)
+}
+
+func (b *bucket) put(key string, data []byte) error {
+	resp, err := b.do(http.MethodPut, key, nil, nil, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Returns the whole object.
+func (b *bucket) get(key string) ([]byte, error) {
+	resp, err := b.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// Reads part of an object with a ranged GET.
+func (b *bucket) readAt(key string, p []byte, off int64) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)}}
+	resp, err := b.do(http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && off != 0 {
+		return 0, fmt.Errorf("GET %q: range not supported", key)
+	}
+	n, err = io.ReadFull(resp.Body, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// Uploads an object in parts of at most partSize bytes, read from r. The upload is aborted if any
+// part fails.
+func (b *bucket) putMultipart(key string, r io.Reader, partSize int64) (err error) {
+	resp, err := b.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadId string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("decoding multipart upload: %w", err)
+	}
+	uploadId := initiated.UploadId
+	defer func() {
+		if err == nil {
+			return
+		}
+		resp, abortErr := b.do(http.MethodDelete, key, url.Values{"uploadId": {uploadId}}, nil, nil)
+		if abortErr == nil {
+			resp.Body.Close()
+		}
+	}()
+	var complete completeMultipartUpload
+	buf := make([]byte, partSize)
+	for partNumber := 1; ; partNumber++ {
+		var n int
+		n, err = io.ReadFull(r, buf)
+		if n == 0 && partNumber != 1 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadId},
+		}
+		resp, err = b.do(http.MethodPut, key, query, nil, buf[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, completedPart{partNumber, resp.Header.Get("ETag")})
+		if n < len(buf) {
+			break
+		}
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err = b.do(http.MethodPost, key, url.Values{"uploadId": {uploadId}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The server can report an error in a successful response once it has started replying.
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var e s3Error
+	if xml.Unmarshal(respBody, &e) == nil && e.Code != "" {
+		return fmt.Errorf("completing multipart upload of %q: %s: %s", key, e.Code, e.Message)
+	}
+	return nil
+}
@@ -0,0 +1,509 @@
+package s3Storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/common"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/segments"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// How piece data is laid out in the bucket.
+type Layout int
+
+const (
+	// Each complete piece is an object.
+	LayoutPieces Layout = iota
+	// Each file is an object, uploaded once all of its pieces are complete.
+	LayoutFiles
+)
+
+type NewClientOpts struct {
+	// The URL of the S3-compatible service, such as "https://s3.us-east-1.amazonaws.com".
+	Endpoint string
+	Bucket   string
+	// Defaults to "us-east-1".
+	Region          string
+	AccessKeyId     string
+	SecretAccessKey string
+	// Defaults to http.DefaultClient.
+	HttpClient *http.Client
+	// Prepended to the keys of all objects.
+	Prefix string
+	// Where pieces are written until they're complete and uploaded.
+	StagingDir string
+	Layout     Layout
+	// Objects larger than this are uploaded in parts of this size. Defaults to 16 MiB. S3 requires
+	// parts to be at least 5 MiB.
+	PartSize int64
+}
+
+// Stores torrent data in an S3-compatible bucket. Incomplete pieces are kept in a local staging
+// directory, and uploaded when they're complete, or when all the pieces of their files are,
+// depending on the layout. Complete data is read with ranged GETs. Completion of pieces whose data is
+// in the bucket is kept in the bucket too, so a client with an empty staging directory can serve the
+// data. Completion of pieces that are only staged is kept in the staging directory.
+func NewClient(opts NewClientOpts) storage.ClientImplCloser {
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.HttpClient == nil {
+		opts.HttpClient = http.DefaultClient
+	}
+	if opts.PartSize <= 0 {
+		opts.PartSize = 16 << 20
+	}
+	return &client{
+		opts: opts,
+		bucket: &bucket{
+			endpoint:        opts.Endpoint,
+			name:            opts.Bucket,
+			region:          opts.Region,
+			accessKeyId:     opts.AccessKeyId,
+			secretAccessKey: opts.SecretAccessKey,
+			httpClient:      opts.HttpClient,
+		},
+	}
+}
+
+type client struct {
+	opts   NewClientOpts
+	bucket *bucket
+}
+
+func (c *client) Close() error {
+	return nil
+}
+
+// The completion of a torrent's pieces, and which files have been uploaded, as stored in the bucket.
+type completionState struct {
+	Pieces []byte `bencode:"pieces"`
+	Files  []byte `bencode:"files,omitempty"`
+}
+
+func bitmapGet(b []byte, i int) bool {
+	return i/8 < len(b) && b[i/8]&(0x80>>(i%8)) != 0
+}
+
+func bitmapSet(b []byte, i int, v bool) {
+	if v {
+		b[i/8] |= 0x80 >> (i % 8)
+	} else {
+		b[i/8] &^= 0x80 >> (i % 8)
+	}
+}
+
+func (c *client) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	t := &torrent{
+		c:          c,
+		info:       info,
+		prefix:     c.opts.Prefix + infoHash.HexString() + "/",
+		stagingDir: filepath.Join(c.opts.StagingDir, infoHash.HexString()),
+		files:      info.UpvertedFiles(),
+	}
+	t.locater = segments.NewIndex(common.LengthIterFromUpvertedFiles(t.files))
+	var offset int64
+	for _, f := range t.files {
+		t.fileOffsets = append(t.fileOffsets, offset)
+		offset += f.Length
+	}
+	b, err := c.bucket.get(t.completionKey())
+	if err == nil {
+		err = bencode.Unmarshal(b, &t.state)
+		if err != nil {
+			return storage.TorrentImpl{}, fmt.Errorf("decoding completion: %w", err)
+		}
+	} else if !errors.Is(err, errNotFound) {
+		return storage.TorrentImpl{}, fmt.Errorf("getting completion: %w", err)
+	}
+	if len(t.state.Pieces) < (info.NumPieces()+7)/8 {
+		t.state.Pieces = make([]byte, (info.NumPieces()+7)/8)
+	}
+	if len(t.state.Files) < (len(t.files)+7)/8 {
+		t.state.Files = make([]byte, (len(t.files)+7)/8)
+	}
+	if c.opts.Layout == LayoutFiles {
+		err = t.loadStagedCompletion()
+		if err != nil {
+			return storage.TorrentImpl{}, err
+		}
+	}
+	return storage.TorrentImpl{Piece: t.Piece, Close: t.Close}, nil
+}
+
+type torrent struct {
+	c           *client
+	info        *metainfo.Info
+	prefix      string
+	stagingDir  string
+	files       []metainfo.FileInfo
+	fileOffsets []int64
+	locater     segments.Index
+	// Held while pieces are uploaded, so files are only uploaded once.
+	uploadMu sync.Mutex
+	mu       sync.Mutex
+	state    completionState
+}
+
+func (t *torrent) completionKey() string {
+	return t.prefix + "completion"
+}
+
+// Where completion is kept for pieces that are staged but not yet in the bucket.
+func (t *torrent) stagedCompletionPath() string {
+	return t.stagingDir + ".completion"
+}
+
+func (t *torrent) pieceKey(index int) string {
+	return t.prefix + "pieces/" + strconv.Itoa(index)
+}
+
+func (t *torrent) fileKey(index int) string {
+	return t.prefix + "files/" + t.files[index].DisplayPath(t.info)
+}
+
+func (t *torrent) stagingPath(piece int) string {
+	return filepath.Join(t.stagingDir, strconv.Itoa(piece))
+}
+
+func (t *torrent) pieceComplete(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return bitmapGet(t.state.Pieces, index)
+}
+
+func (t *torrent) fileUploaded(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return bitmapGet(t.state.Files, index)
+}
+
+// Returns whether all the files overlapping the piece have been uploaded. Must be called with mu
+// held.
+func (t *torrent) pieceUploadedLocked(index int) (uploaded bool) {
+	p := t.info.Piece(index)
+	uploaded = true
+	t.locater.Locate(segments.Extent{Start: p.Offset(), Length: p.Length()}, func(i int, _ segments.Extent) bool {
+		uploaded = bitmapGet(t.state.Files, i)
+		return uploaded
+	})
+	return
+}
+
+// Applies the completion of staged pieces recorded locally, and drops completion from the bucket
+// for pieces whose data isn't there, such as when the staging directory is from another client.
+func (t *torrent) loadStagedCompletion() error {
+	var staged []byte
+	b, err := os.ReadFile(t.stagedCompletionPath())
+	if err == nil {
+		err = bencode.Unmarshal(b, &staged)
+		if err != nil {
+			return fmt.Errorf("decoding staged completion: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("reading staged completion: %w", err)
+	}
+	for i := 0; i < t.info.NumPieces(); i++ {
+		if t.pieceUploadedLocked(i) {
+			continue
+		}
+		_, statErr := os.Stat(t.stagingPath(i))
+		bitmapSet(t.state.Pieces, i, statErr == nil && bitmapGet(staged, i))
+	}
+	return nil
+}
+
+// Saves completion to the bucket, and in the files layout, the completion of staged pieces to the
+// staging directory. Must be called with uploadMu held.
+func (t *torrent) saveState() error {
+	t.mu.Lock()
+	state := t.state
+	var staged []byte
+	if t.c.opts.Layout == LayoutFiles {
+		state.Pieces = append([]byte(nil), t.state.Pieces...)
+		staged = make([]byte, len(state.Pieces))
+		for i := 0; i < t.info.NumPieces(); i++ {
+			if bitmapGet(state.Pieces, i) && !t.pieceUploadedLocked(i) {
+				bitmapSet(state.Pieces, i, false)
+				bitmapSet(staged, i, true)
+			}
+		}
+	}
+	t.mu.Unlock()
+	if staged != nil {
+		b, err := bencode.Marshal(staged)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(t.stagedCompletionPath()), 0o750)
+		if err == nil {
+			err = os.WriteFile(t.stagedCompletionPath(), b, 0o640)
+		}
+		if err != nil {
+			return fmt.Errorf("saving staged completion: %w", err)
+		}
+	}
+	b, err := bencode.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return t.c.bucket.put(t.completionKey(), b)
+}
+
+func (t *torrent) Piece(p metainfo.Piece) storage.PieceImpl {
+	return &piece{t, p}
+}
+
+func (t *torrent) Close() error {
+	return nil
+}
+
+func (t *torrent) readStaging(piece int, b []byte, off int64) (int, error) {
+	f, err := os.Open(t.stagingPath(piece))
+	if os.IsNotExist(err) {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(b, off)
+}
+
+type readerAtFunc func(b []byte, off int64) (int, error)
+
+func (f readerAtFunc) ReadAt(b []byte, off int64) (int, error) {
+	return f(b, off)
+}
+
+// Reads data for the piece. Staged data is the most recent, so it's preferred. Otherwise data for
+// complete pieces comes from the uploaded objects.
+func (t *torrent) readPieceData(p metainfo.Piece, b []byte, off int64) (n int, err error) {
+	_, statErr := os.Stat(t.stagingPath(p.Index()))
+	if statErr == nil || !t.pieceComplete(p.Index()) {
+		return t.readStaging(p.Index(), b, off)
+	}
+	if t.c.opts.Layout == LayoutPieces {
+		return t.c.bucket.readAt(t.pieceKey(p.Index()), b, off)
+	}
+	t.locater.Locate(segments.Extent{Start: p.Offset() + off, Length: int64(len(b))}, func(i int, e segments.Extent) bool {
+		var n1 int
+		if t.fileUploaded(i) {
+			n1, err = t.c.bucket.readAt(t.fileKey(i), b[:e.Length], e.Start)
+		} else {
+			n1, err = t.readStaging(p.Index(), b[:e.Length], off+int64(n))
+		}
+		n += n1
+		b = b[n1:]
+		if n1 == int(e.Length) {
+			err = nil
+		}
+		return err == nil
+	})
+	return
+}
+
+// Reads a file's data from its pieces, for uploading.
+type fileDataReader struct {
+	t    *torrent
+	file int
+}
+
+func (me fileDataReader) ReadAt(b []byte, off int64) (n int, err error) {
+	t := me.t
+	for len(b) != 0 {
+		torrentOff := t.fileOffsets[me.file] + off
+		p := t.info.Piece(int(torrentOff / t.info.PieceLength))
+		pieceOff := torrentOff - p.Offset()
+		b1 := b
+		if int64(len(b1)) > p.Length()-pieceOff {
+			b1 = b1[:p.Length()-pieceOff]
+		}
+		var n1 int
+		n1, err = t.readPieceData(p, b1, pieceOff)
+		n += n1
+		off += int64(n1)
+		b = b[n1:]
+		if n1 == len(b1) {
+			err = nil
+		} else if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (t *torrent) upload(key string, r io.ReaderAt, length int64) error {
+	if length <= t.c.opts.PartSize {
+		b := make([]byte, length)
+		n, err := r.ReadAt(b, 0)
+		if int64(n) == length {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		return t.c.bucket.put(key, b)
+	}
+	return t.c.bucket.putMultipart(key, io.NewSectionReader(r, 0, length), t.c.opts.PartSize)
+}
+
+// Removes the staged data for a piece once it's available from the bucket.
+func (t *torrent) removeStagingIfUploaded(piece int) {
+	if t.c.opts.Layout == LayoutFiles {
+		p := t.info.Piece(piece)
+		uploaded := true
+		t.locater.Locate(segments.Extent{Start: p.Offset(), Length: p.Length()}, func(i int, _ segments.Extent) bool {
+			uploaded = t.fileUploaded(i)
+			return uploaded
+		})
+		if !uploaded {
+			return
+		}
+	}
+	os.Remove(t.stagingPath(piece))
+}
+
+type piece struct {
+	t *torrent
+	p metainfo.Piece
+}
+
+var _ storage.PieceImpl = (*piece)(nil)
+
+func (me *piece) ReadAt(b []byte, off int64) (n int, err error) {
+	if off >= me.p.Length() {
+		return 0, io.EOF
+	}
+	b1 := b
+	if int64(len(b1)) > me.p.Length()-off {
+		b1 = b1[:me.p.Length()-off]
+	}
+	n, err = me.t.readPieceData(me.p, b1, off)
+	if n == len(b1) {
+		err = nil
+		if n < len(b) {
+			err = io.EOF
+		}
+	}
+	return
+}
+
+func (me *piece) WriteAt(b []byte, off int64) (n int, err error) {
+	err = os.MkdirAll(me.t.stagingDir, 0o750)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(me.t.stagingPath(me.p.Index()), os.O_WRONLY|os.O_CREATE, 0o640)
+	if err != nil {
+		return
+	}
+	n, err = f.WriteAt(b, off)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
+
+func (me *piece) setComplete(complete bool) {
+	me.t.mu.Lock()
+	defer me.t.mu.Unlock()
+	bitmapSet(me.t.state.Pieces, me.p.Index(), complete)
+}
+
+// Uploads the piece, or the files it completes, and records the completion in the bucket.
+func (me *piece) MarkComplete() error {
+	t := me.t
+	t.uploadMu.Lock()
+	defer t.uploadMu.Unlock()
+	index := me.p.Index()
+	if t.c.opts.Layout == LayoutPieces {
+		err := t.upload(t.pieceKey(index), readerAtFunc(func(b []byte, off int64) (int, error) {
+			return t.readStaging(index, b, off)
+		}), me.p.Length())
+		if err != nil {
+			return fmt.Errorf("uploading piece: %w", err)
+		}
+		me.setComplete(true)
+		if err := t.saveState(); err != nil {
+			me.setComplete(false)
+			return err
+		}
+		t.removeStagingIfUploaded(index)
+		return nil
+	}
+	me.setComplete(true)
+	var uploaded []int
+	var err error
+	t.locater.Locate(segments.Extent{Start: me.p.Offset(), Length: me.p.Length()}, func(i int, _ segments.Extent) bool {
+		begin, end := filePieceRange(t.info, t.fileOffsets[i], t.files[i].Length)
+		for p := begin; p < end; p++ {
+			if !t.pieceComplete(p) {
+				return true
+			}
+		}
+		err = t.upload(t.fileKey(i), fileDataReader{t, i}, t.files[i].Length)
+		if err != nil {
+			err = fmt.Errorf("uploading file %v: %w", i, err)
+			return false
+		}
+		uploaded = append(uploaded, i)
+		return true
+	})
+	t.mu.Lock()
+	for _, i := range uploaded {
+		bitmapSet(t.state.Files, i, true)
+	}
+	t.mu.Unlock()
+	if err == nil {
+		err = t.saveState()
+	}
+	if err != nil {
+		me.setComplete(false)
+		return err
+	}
+	for _, i := range uploaded {
+		begin, end := filePieceRange(t.info, t.fileOffsets[i], t.files[i].Length)
+		for p := begin; p < end; p++ {
+			t.removeStagingIfUploaded(p)
+		}
+	}
+	return nil
+}
+
+func (me *piece) MarkNotComplete() error {
+	me.t.uploadMu.Lock()
+	defer me.t.uploadMu.Unlock()
+	me.setComplete(false)
+	return me.t.saveState()
+}
+
+func (me *piece) Completion() storage.Completion {
+	return storage.Completion{
+		Complete: me.t.pieceComplete(me.p.Index()),
+		Ok:       true,
+	}
+}
+
+// Returns the range of pieces that overlap the file at the given torrent offset.
+func filePieceRange(info *metainfo.Info, offset, length int64) (begin, end int) {
+	if length == 0 {
+		return
+	}
+	begin = int(offset / info.PieceLength)
+	end = int((offset + length + info.PieceLength - 1) / info.PieceLength)
+	return
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/anacrolix/torrent/metainfo"
 	"zombiezen.com/go/sqlite"
@@ -19,7 +20,11 @@ type sqlitePieceCompletion struct {
 	db     *sqlite.Conn
 }
 
-var _ PieceCompletion = (*sqlitePieceCompletion)(nil)
+var (
+	_ PieceCompletion = (*sqlitePieceCompletion)(nil)
+	_ FilePathStore   = (*sqlitePieceCompletion)(nil)
+	_ FileStampStore  = (*sqlitePieceCompletion)(nil)
+)
 
 func NewSqlitePieceCompletion(dir string) (ret *sqlitePieceCompletion, err error) {
 	p := filepath.Join(dir, ".torrent.db")
@@ -27,7 +32,11 @@ func NewSqlitePieceCompletion(dir string) (ret *sqlitePieceCompletion, err error
 	if err != nil {
 		return
 	}
-	err = sqlitex.ExecScript(db, `create table if not exists piece_completion(infohash, "index", complete, unique(infohash, "index"))`)
+	err = sqlitex.ExecScript(db, `
+		create table if not exists piece_completion(infohash, "index", complete, unique(infohash, "index"));
+		create table if not exists file_path(infohash, "index", path, unique(infohash, "index"));
+		create table if not exists file_stamp(infohash, "index", size, mtime, unique(infohash, "index"));
+	`)
 	if err != nil {
 		db.Close()
 		return
@@ -63,6 +72,63 @@ func (me *sqlitePieceCompletion) Set(pk metainfo.PieceKey, b bool) error {
 		pk.InfoHash.HexString(), pk.Index, b)
 }
 
+func (me *sqlitePieceCompletion) GetFilePaths(ih metainfo.Hash) (ret map[int]string, err error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret = make(map[int]string)
+	err = sqlitex.Exec(
+		me.db, `select "index", path from file_path where infohash=?`,
+		func(stmt *sqlite.Stmt) error {
+			ret[stmt.ColumnInt(0)] = stmt.ColumnText(1)
+			return nil
+		},
+		ih.HexString())
+	return
+}
+
+func (me *sqlitePieceCompletion) SetFilePath(ih metainfo.Hash, fileIndex int, path string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.closed {
+		return errors.New("closed")
+	}
+	return sqlitex.Exec(
+		me.db,
+		`insert or replace into file_path(infohash, "index", path) values(?, ?, ?)`,
+		nil,
+		ih.HexString(), fileIndex, path)
+}
+
+func (me *sqlitePieceCompletion) GetFileStamps(ih metainfo.Hash) (ret map[int]FileStamp, err error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret = make(map[int]FileStamp)
+	err = sqlitex.Exec(
+		me.db, `select "index", size, mtime from file_stamp where infohash=?`,
+		func(stmt *sqlite.Stmt) error {
+			ret[stmt.ColumnInt(0)] = FileStamp{
+				Size:    stmt.ColumnInt64(1),
+				ModTime: time.Unix(0, stmt.ColumnInt64(2)),
+			}
+			return nil
+		},
+		ih.HexString())
+	return
+}
+
+func (me *sqlitePieceCompletion) SetFileStamp(ih metainfo.Hash, fileIndex int, stamp FileStamp) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.closed {
+		return errors.New("closed")
+	}
+	return sqlitex.Exec(
+		me.db,
+		`insert or replace into file_stamp(infohash, "index", size, mtime) values(?, ?, ?, ?)`,
+		nil,
+		ih.HexString(), fileIndex, stamp.Size, stamp.ModTime.UnixNano())
+}
+
 func (me *sqlitePieceCompletion) Close() (err error) {
 	me.mu.Lock()
 	defer me.mu.Unlock()
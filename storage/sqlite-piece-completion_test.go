@@ -0,0 +1,25 @@
+//go:build !nosqlite
+// +build !nosqlite
+
+package storage
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestSqlitePieceCompletionFilePaths(t *testing.T) {
+	c := qt.New(t)
+	pc, err := NewSqlitePieceCompletion(t.TempDir())
+	c.Assert(err, qt.IsNil)
+	defer pc.Close()
+	var ih metainfo.Hash
+	c.Assert(pc.SetFilePath(ih, 3, "a/b"), qt.IsNil)
+	c.Assert(pc.SetFilePath(ih, 3, "a/c"), qt.IsNil)
+	fps, err := pc.GetFilePaths(ih)
+	c.Assert(err, qt.IsNil)
+	c.Check(fps, qt.DeepEquals, map[int]string{3: "a/c"})
+}
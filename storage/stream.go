@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+
+	"github.com/anacrolix/missinggo/v2"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Builds a torrent from streams, writing the data into storage as it's hashed, so the torrent can
+// be seeded from the storage. The storage must place data by the info's file layout rather than by
+// infohash, as file and mmap storage do with their default directory layout, because the infohash
+// isn't known until all the data has been read. Finish checks the data is where the finished info
+// expects it, so other storage fails rather than having pieces marked complete without their data.
+type StreamWriter struct {
+	storage ClientImpl
+	builder metainfo.StreamBuilder
+}
+
+// The builder's options are used for the info. It shouldn't have had files added.
+func NewStreamWriter(storage ClientImpl, builder metainfo.StreamBuilder) *StreamWriter {
+	return &StreamWriter{
+		storage: storage,
+		builder: builder,
+	}
+}
+
+// Returns an info containing just the file, laid out as it will be in the final info, so the
+// storage puts its data in the same place.
+func (me *StreamWriter) fileInfo(path []string, length int64) *metainfo.Info {
+	info := &metainfo.Info{
+		Name:        me.builder.Name,
+		PieceLength: length,
+		Pieces:      make([]byte, metainfo.HashSize),
+	}
+	if info.PieceLength == 0 {
+		info.PieceLength = 1
+	}
+	if len(path) == 0 {
+		info.Length = length
+	} else {
+		info.Files = []metainfo.FileInfo{{Path: path, Length: length}}
+	}
+	return info
+}
+
+// Reads length bytes from r as the data of the next file, and writes them to storage. A nil path
+// makes a single-file torrent, and must be the only file added.
+func (me *StreamWriter) AddFile(path []string, r io.Reader, length int64) (err error) {
+	info := me.fileInfo(path, length)
+	t, err := me.storage.OpenTorrent(info, metainfo.Hash{})
+	if err != nil {
+		return fmt.Errorf("opening storage for %q: %w", path, err)
+	}
+	defer func() {
+		if t.Close == nil {
+			return
+		}
+		if closeErr := t.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	w := &pieceStreamWriter{p: t.Piece(info.Piece(0))}
+	return me.builder.AddFile(path, io.TeeReader(r, w), length)
+}
+
+// Writes sequentially to a piece.
+type pieceStreamWriter struct {
+	p   PieceImpl
+	off int64
+}
+
+func (me *pieceStreamWriter) Write(b []byte) (n int, err error) {
+	n, err = me.p.WriteAt(b, me.off)
+	me.off += int64(n)
+	return
+}
+
+// Builds the info, and marks all its pieces complete in storage once their data there is checked.
+func (me *StreamWriter) Finish() (info metainfo.Info, err error) {
+	info, err = me.builder.Info()
+	if err != nil {
+		return
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		return
+	}
+	t, err := me.storage.OpenTorrent(&info, metainfo.HashBytes(infoBytes))
+	if err != nil {
+		err = fmt.Errorf("opening storage: %w", err)
+		return
+	}
+	for i := 0; i < info.NumPieces(); i++ {
+		p := info.Piece(i)
+		pi := t.Piece(p)
+		var sum metainfo.Hash
+		sum, err = hashPieceImpl(pi, p.Length())
+		if err != nil {
+			err = fmt.Errorf("hashing piece %v: %w", i, err)
+			break
+		}
+		if sum != p.Hash() {
+			err = fmt.Errorf(
+				"piece %v doesn't match the data written, storage might not place data by file layout", i)
+			break
+		}
+		err = pi.MarkComplete()
+		if err != nil {
+			err = fmt.Errorf("marking piece %v complete: %w", i, err)
+			break
+		}
+	}
+	if t.Close != nil {
+		if closeErr := t.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return
+}
+
+func hashPieceImpl(p PieceImpl, length int64) (ret metainfo.Hash, err error) {
+	if sh, ok := p.(SelfHashing); ok {
+		return sh.SelfHash()
+	}
+	h := sha1.New()
+	_, err = io.Copy(h, io.NewSectionReader(p, 0, length))
+	missinggo.CopyExact(&ret, h.Sum(nil))
+	return
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestStreamWriter(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	pc := NewMapPieceCompletion()
+	ci := NewFileOpts(NewFileClientOpts{
+		ClientBaseDir:   dir,
+		PieceCompletion: pc,
+	})
+	w := NewStreamWriter(ci, metainfo.StreamBuilder{
+		Name:        "t",
+		PieceLength: 4,
+	})
+	files := []struct {
+		path string
+		data string
+	}{
+		{"a", "hello"},
+		{"b/c", ""},
+		{"b/d", "world!"},
+	}
+	for _, f := range files {
+		c.Assert(w.AddFile(strings.Split(f.path, "/"), strings.NewReader(f.data), int64(len(f.data))), qt.IsNil)
+	}
+	info, err := w.Finish()
+	c.Assert(err, qt.IsNil)
+	c.Check(info.NumPieces(), qt.Equals, 3)
+	infoBytes, err := bencode.Marshal(info)
+	c.Assert(err, qt.IsNil)
+	// The data can be served from the storage for the finished info.
+	ts, err := ci.OpenTorrent(&info, metainfo.HashBytes(infoBytes))
+	c.Assert(err, qt.IsNil)
+	defer ts.Close()
+	var data []byte
+	for i := 0; i < info.NumPieces(); i++ {
+		p := info.Piece(i)
+		c.Check(ts.Piece(p).Completion(), qt.Equals, Completion{Complete: true, Ok: true})
+		b, err := io.ReadAll(io.NewSectionReader(ts.Piece(p), 0, p.Length()))
+		c.Assert(err, qt.IsNil)
+		c.Check(metainfo.HashBytes(b), qt.Equals, p.Hash())
+		data = append(data, b...)
+	}
+	c.Check(string(data), qt.Equals, "helloworld!")
+}
+
+func TestStreamWriterStorageByInfohash(t *testing.T) {
+	c := qt.New(t)
+	ci := NewBoltDB(t.TempDir())
+	defer ci.Close()
+	w := NewStreamWriter(ci, metainfo.StreamBuilder{
+		Name:        "t",
+		PieceLength: 4,
+	})
+	c.Assert(w.AddFile([]string{"a"}, strings.NewReader("hello"), 5), qt.IsNil)
+	c.Assert(w.AddFile([]string{"b"}, strings.NewReader("world!"), 6), qt.IsNil)
+	// Bolt storage keys data by infohash, so the data written before it was known is lost.
+	info, err := w.Finish()
+	c.Assert(err, qt.ErrorMatches, `piece 0 doesn't match .*`)
+	infoBytes, err := bencode.Marshal(info)
+	c.Assert(err, qt.IsNil)
+	ts, err := ci.OpenTorrent(&info, metainfo.HashBytes(infoBytes))
+	c.Assert(err, qt.IsNil)
+	defer ts.Close()
+	for i := 0; i < info.NumPieces(); i++ {
+		c.Check(ts.Piece(info.Piece(i)).Completion().Complete, qt.IsFalse)
+	}
+}
@@ -1,6 +1,9 @@
 package torrent
 
 import (
+	"errors"
+	"fmt"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -128,6 +131,68 @@ func (t *Torrent) Seeding() (ret bool) {
 	return
 }
 
+// Relocates the torrent's data to newDir while the torrent is running. Storage IO is blocked until
+// the move completes, and piece completion is retained. Requires that the info has been obtained,
+// and that the storage implementation supports moving.
+func (t *Torrent) MoveStorage(newDir string) error {
+	t.cl.rLock()
+	s := t.storage
+	t.cl.rUnlock()
+	if s == nil {
+		return errors.New("storage not open")
+	}
+	if s.Move == nil {
+		return errors.New("storage does not support moving")
+	}
+	err := func() error {
+		// Waits for active hashers, and blocks storage closing.
+		t.storageLock.Lock()
+		defer t.storageLock.Unlock()
+		if t.closed.IsSet() {
+			return errors.New("torrent closed")
+		}
+		return s.Move(newDir)
+	}()
+	t.cl.lock()
+	t.updateHashDevice()
+	t.cl.unlock()
+	return err
+}
+
+// Renames or relocates the file with the given index. Absolute paths are used as is. Relative paths
+// use '/' separators, and are relative to the directory storage keeps the torrent in, the same as
+// File.Path. Data already written is moved, so seeding can continue. Requires that the info has
+// been obtained, and that the storage implementation supports it.
+func (t *Torrent) RenameFile(index int, path string) error {
+	t.cl.rLock()
+	s := t.storage
+	t.cl.rUnlock()
+	if s == nil {
+		return errors.New("storage not open")
+	}
+	if s.SetFilePath == nil {
+		return errors.New("storage does not support renaming files")
+	}
+	files := t.Files()
+	if index < 0 || index >= len(files) {
+		return fmt.Errorf("file index %v out of range", index)
+	}
+	// Blocks storage closing.
+	t.storageLock.RLock()
+	defer t.storageLock.RUnlock()
+	if t.closed.IsSet() {
+		return errors.New("torrent closed")
+	}
+	err := s.SetFilePath(index, path)
+	if err != nil {
+		return err
+	}
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.setFilePath(files[index], path)
+	return nil
+}
+
 // Clobbers the torrent display name if metainfo is unavailable.
 // The display name is used as the torrent name while the metainfo is unavailable.
 func (t *Torrent) SetDisplayName(dn string) {
@@ -210,7 +275,7 @@ func (t *Torrent) cancelPiecesLocked(begin, end pieceIndex, reason string) {
 func (t *Torrent) initFiles() {
 	var offset int64
 	t.files = new([]*File)
-	for _, fi := range t.info.UpvertedFiles() {
+	for i, fi := range t.info.UpvertedFiles() {
 		var path []string
 		if len(fi.PathUTF8) != 0 {
 			path = fi.PathUTF8
@@ -222,16 +287,39 @@ func (t *Torrent) initFiles() {
 			dp = strings.Join(fi.Path, "/")
 		}
 		*t.files = append(*t.files, &File{
-			t,
-			strings.Join(append([]string{t.info.Name}, path...), "/"),
-			offset,
-			fi.Length,
-			fi,
-			dp,
-			PiecePriorityNone,
+			t:           t,
+			path:        strings.Join(append([]string{t.info.Name}, path...), "/"),
+			offset:      offset,
+			length:      fi.Length,
+			fi:          fi,
+			displayPath: dp,
+			prio:        PiecePriorityNone,
+			index:       i,
 		})
 		offset += fi.Length
 	}
+	if t.storage != nil && t.storage.FilePaths != nil {
+		for i, path := range t.storage.FilePaths() {
+			if i < len(*t.files) {
+				t.setFilePath((*t.files)[i], path)
+			}
+		}
+	}
+}
+
+// Updates the paths reported for a file that storage has renamed. Path and DisplayPath stay relative
+// to the torrent, so they're only changed for relative paths.
+func (t *Torrent) setFilePath(f *File, path string) {
+	f.storagePath = path
+	if filepath.IsAbs(path) {
+		return
+	}
+	path = filepath.ToSlash(path)
+	f.path = path
+	f.displayPath = path
+	if len(t.info.Files) != 0 {
+		f.displayPath = strings.TrimPrefix(path, t.info.Name+"/")
+	}
 }
 
 // Returns handles to the files in the torrent. This requires that the Info is
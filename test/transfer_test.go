@@ -326,6 +326,18 @@ func TestClientTransferVarious(t *testing.T) {
 	for _, ls := range []leecherStorageTestCase{
 		{"Filecache", newFileCacheClientStorageFactory(fileCacheClientStorageFactoryParams{}), 0},
 		{"Boltdb", storage.NewBoltDB, 0},
+		{"FileWithCache", func(s string) storage.ClientImplCloser {
+			return storage.NewCache(storage.NewFile(s), storage.CacheOpts{Capacity: 1 << 20})
+		}, 0},
+		{"FileEncrypted", func(s string) storage.ClientImplCloser {
+			cl, err := storage.NewEncrypted(storage.NewFile(s), storage.EncryptedOpts{
+				MasterKey: []byte("0123456789abcdef"),
+			})
+			if err != nil {
+				panic(err)
+			}
+			return cl
+		}, 0},
 		{"SqliteDirect", func(s string) storage.ClientImplCloser {
 			path := filepath.Join(s, "sqlite3.db")
 			var opts sqliteStorage.NewDirectStorageOpts
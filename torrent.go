@@ -74,6 +74,8 @@ type Torrent struct {
 	storage *storage.Torrent
 	// Read-locked for using storage, and write-locked for Closing.
 	storageLock sync.RWMutex
+	// File allocations running in the background.
+	allocating sync.WaitGroup
 
 	// TODO: Only announce stuff is used?
 	metainfo metainfo.MetaInfo
@@ -89,9 +91,13 @@ type Torrent struct {
 	// open (not-closed) connections only.
 	conns               map[*PeerConn]struct{}
 	maxEstablishedConns int
+	// Restricts peer countries in addition to ClientConfig.CountryPolicy.
+	countryPolicy CountryPolicy
 	// Set of addrs to which we're attempting to connect. Connections are
 	// half-open until all handshakes are completed.
 	halfOpen map[string]PeerInfo
+	// Outcomes of dialing peer addresses, for backoff.
+	dialHistory map[string]*peerDialHistory
 
 	// Reserve of peers to connect to. A peer can be both here and in the
 	// active connections if were told about the peer after connecting with
@@ -132,8 +138,11 @@ type Torrent struct {
 	// A cache of completed piece indices.
 	_completedPieces roaring.Bitmap
 	// Pieces that need to be hashed.
-	piecesQueuedForHash       bitmap.Bitmap
-	activePieceHashes         int
+	piecesQueuedForHash bitmap.Bitmap
+	activePieceHashes   int
+	hashProgress        pieceHashProgress
+	// Identifies the storage device for limiting concurrent hashing, if the storage supports it.
+	hashDevice                string
 	initialPieceCheckDisabled bool
 
 	// Count of each request across active connections.
@@ -283,6 +292,15 @@ func (t *Torrent) addPeer(p PeerInfo) (added bool) {
 			// cl.logger.Printf("peers not added because of bad addr: %v", p)
 			return false
 		}
+		p.Geo = cl.lookupGeoIP(ipAddr.IP)
+		if !cl.countryAllowed(t.countryPolicy, p.Geo.Country) {
+			torrent.Add("peers not added because of country policy", 1)
+			return false
+		}
+	}
+	if !p.Trusted && t.peerDialBackedOff(p.Addr.String()) {
+		torrent.Add("peers not added because of dial backoff", 1)
+		return false
 	}
 	if replaced, ok := t.peers.AddReturningReplacedPeer(p); ok {
 		torrent.Add("peers replaced", 1)
@@ -411,6 +429,10 @@ func (t *Torrent) setInfo(info *metainfo.Info) error {
 		if err != nil {
 			return fmt.Errorf("error opening torrent storage: %s", err)
 		}
+		if t.storage.SubscribePieceCompletion != nil {
+			t.storage.SubscribePieceCompletion(t.onStoragePieceCompletionChanged)
+		}
+		t.updateHashDevice()
 	}
 	t.nameMu.Lock()
 	t.info = info
@@ -444,7 +466,7 @@ func (t *Torrent) onSetInfo() {
 	close(t.gotMetainfoC)
 	t.updateWantPeersEvent()
 	t.pendingRequests.Init(t.numRequests())
-	t.tryCreateMorePieceHashers()
+	t.cl.startPieceHashes()
 	t.iterPeers(func(p *Peer) {
 		p.onGotInfo(t.info)
 		p.updateRequests("onSetInfo")
@@ -691,6 +713,7 @@ func (t *Torrent) writeStatus(w io.Writer) {
 	}()
 
 	fmt.Fprintf(w, "DHT Announces: %d\n", t.numDHTAnnounces)
+	fmt.Fprintf(w, "End game: %v\n", t.inEndGame())
 
 	spew.NewDefaultConfig()
 	spew.Fdump(w, t.statsLocked())
@@ -799,6 +822,7 @@ func (t *Torrent) numPiecesCompleted() (num pieceIndex) {
 
 func (t *Torrent) close(wg *sync.WaitGroup) (err error) {
 	t.closed.Set()
+	t.cl.pieceHashes.remove(t)
 	if t.storage != nil {
 		wg.Add(1)
 		go func() {
@@ -1010,6 +1034,18 @@ func (t *Torrent) worstBadConn() (ret *PeerConn) {
 	return nil
 }
 
+// Returns the worst unclosed connection, or nil if there are none.
+func (t *Torrent) worstConn() *PeerConn {
+	wcs := worseConnSlice{conns: t.appendUnclosedConns(getPeerConnSlice(len(t.conns)))}
+	defer peerConnSlices.Put(wcs.conns)
+	if len(wcs.conns) == 0 {
+		return nil
+	}
+	wcs.initKeys()
+	heap.Init(&wcs)
+	return heap.Pop(&wcs).(*PeerConn)
+}
+
 type PieceStateChange struct {
 	Index int
 	PieceState
@@ -1110,6 +1146,7 @@ func (t *Torrent) updatePiecePriority(piece pieceIndex, reason string) {
 		if !t._pendingPieces.CheckedAdd(uint32(piece)) {
 			return
 		}
+		t.allocatePieceFiles(piece)
 	}
 	t.piecePriorityChanged(piece, reason)
 }
@@ -1246,6 +1283,19 @@ func (t *Torrent) updatePieceCompletion(piece pieceIndex) bool {
 	return changed
 }
 
+// Called by the storage when it changes a piece's completion itself, such as when it evicts data to
+// stay within its capacity. The storage may be holding its own locks.
+func (t *Torrent) onStoragePieceCompletionChanged(piece int) {
+	go func() {
+		t.cl.lock()
+		defer t.cl.unlock()
+		if t.closed.IsSet() || !t.haveInfo() {
+			return
+		}
+		t.updatePieceCompletion(piece)
+	}()
+}
+
 // Non-blocking read. Client lock is not required.
 func (t *Torrent) readAt(b []byte, off int64) (n int, err error) {
 	for len(b) != 0 {
@@ -1365,6 +1415,7 @@ func (t *Torrent) deletePeerConn(c *PeerConn) (ret bool) {
 	// Avoid adding a drop event more than once. Probably we should track whether we've generated
 	// the drop event against the PexConnState instead.
 	if ret {
+		t.cl.onConnDeleted(c)
 		if !t.cl.config.DisablePEX {
 			t.pex.Drop(c)
 		}
@@ -1785,6 +1836,9 @@ func (t *Torrent) addPeerConn(c *PeerConn) (err error) {
 	if t.closed.IsSet() {
 		return errors.New("torrent closed")
 	}
+	if !t.cl.countryAllowed(t.countryPolicy, c.PeerGeo.Country) {
+		return errors.New("peer country not allowed")
+	}
 	for c0 := range t.conns {
 		if c.PeerID != c0.PeerID {
 			continue
@@ -1799,10 +1853,14 @@ func (t *Torrent) addPeerConn(c *PeerConn) (err error) {
 			return errors.New("existing connection preferred")
 		}
 	}
+	if err := t.cl.checkIPConnLimits(c.remoteIp()); err != nil {
+		return err
+	}
 	if len(t.conns) >= t.maxEstablishedConns {
 		c := t.worstBadConn()
 		if c == nil {
-			return errors.New("don't want conns")
+			t.cl.connLimitStats.TorrentLimit.Add(1)
+			return errTorrentConnLimit
 		}
 		c.close()
 		t.deletePeerConn(c)
@@ -1810,24 +1868,36 @@ func (t *Torrent) addPeerConn(c *PeerConn) (err error) {
 	if len(t.conns) >= t.maxEstablishedConns {
 		panic(len(t.conns))
 	}
+	if err := t.makeGlobalConnRoom(); err != nil {
+		return err
+	}
 	t.conns[c] = struct{}{}
+	t.cl.onConnAdded(c)
 	if !t.cl.config.DisablePEX && !c.PeerExtensionBytes.SupportsExtended() {
 		t.pex.Add(c) // as no further extended handshake expected
 	}
 	return nil
 }
 
-func (t *Torrent) wantConns() bool {
+// Returns whether the torrent would use more connections, regardless of connection limits.
+func (t *Torrent) wantConnsIgnoringLimits() bool {
 	if !t.networkingEnabled.Bool() {
 		return false
 	}
 	if t.closed.IsSet() {
 		return false
 	}
-	if !t.needData() && (!t.seeding() || !t.haveAnyPieces()) {
+	return t.needData() || (t.seeding() && t.haveAnyPieces())
+}
+
+func (t *Torrent) wantConns() bool {
+	if !t.wantConnsIgnoringLimits() {
 		return false
 	}
-	return len(t.conns) < t.maxEstablishedConns || t.worstBadConn() != nil
+	if len(t.conns) < t.maxEstablishedConns && t.haveGlobalConnRoom() {
+		return true
+	}
+	return t.worstBadConn() != nil
 }
 
 func (t *Torrent) SetMaxEstablishedConns(max int) (oldMax int) {
@@ -1875,6 +1945,7 @@ func (t *Torrent) pieceHashed(piece pieceIndex, passed bool, hashIoErr error) {
 	defer func() {
 		p.marking = false
 		t.publishPieceChange(piece)
+		t.cl.event.Broadcast()
 	}()
 
 	if passed {
@@ -1907,6 +1978,7 @@ func (t *Torrent) pieceHashed(piece pieceIndex, passed bool, hashIoErr error) {
 			for c := range p.dirtiers {
 				// Y u do dis peer?!
 				c.stats().incrementPiecesDirtiedBad()
+				peerClientBadPieces.Add(c.clientTypeName(), 1)
 			}
 
 			bannableTouchers := make([]*Peer, 0, len(p.dirtiers))
@@ -1931,9 +2003,16 @@ func (t *Torrent) pieceHashed(piece pieceIndex, passed bool, hashIoErr error) {
 				)
 			}
 
+			for _, c := range bannableTouchers {
+				t.cl.onPeerHashFailure(c.remoteIp())
+			}
 			if len(bannableTouchers) >= 1 {
 				c := bannableTouchers[0]
-				t.cl.banPeerIP(c.remoteIp())
+				t.logger.Printf("piece %d failed with data from %v using %v (ext v %q)",
+					piece, c.remoteIp(), c.clientTypeName(), c.PeerClientName)
+				if !t.cl.peerBanned(c.remoteIp()) {
+					t.cl.banPeerIP(c.remoteIp(), "sent data for a piece that failed its hash check", t.cl.config.PeerBanDuration)
+				}
 				c.drop()
 			}
 		}
@@ -1962,6 +2041,9 @@ func (t *Torrent) onPieceCompleted(piece pieceIndex) {
 
 // Called when a piece is found to be not complete.
 func (t *Torrent) onIncompletePiece(piece pieceIndex) {
+	for c := range t.conns {
+		c.dontHave(piece)
+	}
 	if t.pieceAllDirty(piece) {
 		t.pendAllChunkSpecs(piece)
 	}
@@ -1987,59 +2069,66 @@ func (t *Torrent) onIncompletePiece(piece pieceIndex) {
 	})
 }
 
-func (t *Torrent) tryCreateMorePieceHashers() {
-	for !t.closed.IsSet() && t.activePieceHashes < 2 && t.tryCreatePieceHasher() {
-	}
-}
-
-func (t *Torrent) tryCreatePieceHasher() bool {
-	if t.storage == nil {
-		return false
+// Returns the next queued piece to hash, preferring pieces that readers are waiting on, which are
+// urgent.
+func (t *Torrent) getPieceToHash() (ret pieceIndex, urgent bool, ok bool) {
+	find := func(pieces bitmap.Bitmap, queued bool) {
+		pieces.IterTyped(func(i pieceIndex) bool {
+			if t.piece(i).hashing || queued && !t.piece(i).queuedForHash() {
+				return true
+			}
+			ret = i
+			ok = true
+			return false
+		})
 	}
-	pi, ok := t.getPieceToHash()
+	find(t.readerNowPieces(), true)
 	if !ok {
-		return false
+		find(t.readerReadaheadPieces(), true)
 	}
-	p := t.piece(pi)
-	t.piecesQueuedForHash.Remove(bitmap.BitIndex(pi))
-	p.hashing = true
-	t.publishPieceChange(pi)
-	t.updatePiecePriority(pi, "Torrent.tryCreatePieceHasher")
-	t.storageLock.RLock()
-	t.activePieceHashes++
-	go t.pieceHasher(pi)
-	return true
-}
-
-func (t *Torrent) getPieceToHash() (ret pieceIndex, ok bool) {
-	t.piecesQueuedForHash.IterTyped(func(i pieceIndex) bool {
-		if t.piece(i).hashing {
-			return true
-		}
-		ret = i
-		ok = true
-		return false
-	})
+	if ok {
+		urgent = true
+		return
+	}
+	find(t.piecesQueuedForHash, false)
 	return
 }
 
-func (t *Torrent) pieceHasher(index pieceIndex) {
+// device is the storage device the hash was counted against when it started.
+func (t *Torrent) pieceHasher(index pieceIndex, device string) {
 	p := t.piece(index)
-	sum, copyErr := t.hashPiece(index)
+	// Blocks storage closing.
+	t.storageLock.RLock()
+	closed := t.closed.IsSet()
+	var (
+		sum     metainfo.Hash
+		copyErr error
+	)
+	if !closed {
+		sum, copyErr = t.hashPiece(index)
+	}
+	t.storageLock.RUnlock()
 	correct := sum == *p.hash
 	switch copyErr {
 	case nil, io.EOF:
 	default:
 		log.Fmsg("piece %v (%s) hash failure copy error: %v", p, p.hash.HexString(), copyErr).Log(t.logger)
 	}
-	t.storageLock.RUnlock()
 	t.cl.lock()
 	defer t.cl.unlock()
 	p.hashing = false
-	t.pieceHashed(index, correct, copyErr)
-	t.updatePiecePriority(index, "Torrent.pieceHasher")
+	if !closed {
+		t.pieceHashed(index, correct, copyErr)
+		t.updatePiecePriority(index, "Torrent.pieceHasher")
+	}
 	t.activePieceHashes--
-	t.tryCreateMorePieceHashers()
+	t.hashProgress.checked++
+	t.hashProgress.bytes += int64(t.pieceLength(index))
+	if t.hashingIdle() {
+		t.hashProgress.finished = time.Now()
+	}
+	t.cl.pieceHashes.finished(device)
+	t.cl.startPieceHashes()
 }
 
 // Return the connections that touched a piece, and clear the entries while doing it.
@@ -2063,17 +2152,43 @@ func (t *Torrent) queuePieceCheck(pieceIndex pieceIndex) {
 	if piece.queuedForHash() {
 		return
 	}
+	if t.hashingIdle() {
+		t.hashProgress = pieceHashProgress{started: time.Now()}
+	}
 	t.piecesQueuedForHash.Add(bitmap.BitIndex(pieceIndex))
+	t.cl.pieceHashes.add(t)
 	t.publishPieceChange(pieceIndex)
 	t.updatePiecePriority(pieceIndex, "Torrent.queuePieceCheck")
-	t.tryCreateMorePieceHashers()
+	t.cl.startPieceHashes()
 }
 
 // Forces all the pieces to be re-hashed. See also Piece.VerifyData. This should not be called
-// before the Info is available.
+// before the Info is available. Storage stops trusting its recorded completion first, so that pieces
+// not checked before the torrent is closed are checked when it's opened again.
 func (t *Torrent) VerifyData() {
-	for i := pieceIndex(0); i < t.NumPieces(); i++ {
-		t.Piece(i).VerifyData()
+	t.cl.rLock()
+	s := t.storage
+	t.cl.rUnlock()
+	if s != nil && s.DiscardFileStamps != nil {
+		t.storageLock.RLock()
+		var err error
+		if !t.closed.IsSet() {
+			err = s.DiscardFileStamps()
+		}
+		t.storageLock.RUnlock()
+		if err != nil {
+			t.logger.WithDefaultLevel(log.Warning).Printf("error discarding file stamps: %v", err)
+		}
+	}
+	t.cl.lock()
+	defer t.cl.unlock()
+	// Queue every piece first, so they can be hashed concurrently.
+	targets := make([]int64, t.numPieces())
+	for i := range targets {
+		targets[i] = t.piece(i).queueVerify()
+	}
+	for i, target := range targets {
+		t.piece(i).waitVerified(target)
 	}
 }
 
@@ -2085,10 +2200,16 @@ func (t *Torrent) initiateConn(peer PeerInfo) {
 	if t.cl.badPeerAddr(peer.Addr) && !peer.Trusted {
 		return
 	}
+	if !t.cl.countryAllowed(t.countryPolicy, peer.Geo.Country) && !peer.Trusted {
+		return
+	}
 	addr := peer.Addr
 	if t.addrActive(addr.String()) {
 		return
 	}
+	if ipa, ok := tryIpPortFromNetAddr(addr); ok && !peer.Trusted && t.cl.checkIPConnLimits(ipa.IP) != nil {
+		return
+	}
 	t.cl.numHalfOpen++
 	t.halfOpen[addr.String()] = peer
 	go t.cl.outgoingConnection(t, addr, peer.Source, peer.Trusted)
@@ -2140,6 +2261,45 @@ func (t *Torrent) onWriteChunkErr(err error) {
 	t.disallowDataDownloadLocked()
 }
 
+// Asks storage to allocate space for files overlapping a piece that has become wanted, if it hasn't
+// been done already.
+func (t *Torrent) allocatePieceFiles(piece pieceIndex) {
+	if t.storage == nil || t.storage.AllocateFile == nil {
+		return
+	}
+	for _, f := range t.piece(piece).files {
+		if f.allocated {
+			continue
+		}
+		f.allocated = true
+		t.allocating.Add(1)
+		go t.allocateFile(t.storage.AllocateFile, f)
+	}
+}
+
+// Runs without the Client lock, so that it isn't held while waiting for a storage move to finish.
+func (t *Torrent) allocateFile(allocate func(int) error, f *File) {
+	defer t.allocating.Done()
+	err := func() error {
+		// Blocks storage closing.
+		t.storageLock.RLock()
+		defer t.storageLock.RUnlock()
+		if t.closed.IsSet() {
+			return nil
+		}
+		return allocate(f.index)
+	}()
+	if err == nil {
+		return
+	}
+	t.cl.lock()
+	defer t.cl.unlock()
+	if t.closed.IsSet() {
+		return
+	}
+	t.onWriteChunkErr(fmt.Errorf("allocating storage for file %q: %w", f.displayPath, err))
+}
+
 func (t *Torrent) DisallowDataDownload() {
 	t.disallowDataDownloadLocked()
 }
@@ -216,3 +216,77 @@ func TestTorrentMetainfoIncompleteMetadata(t *testing.T) {
 	assert.False(t, tt.haveAllMetadataPieces())
 	assert.Nil(t, tt.Metainfo().InfoBytes)
 }
+
+func TestFilesAllocatedWhenWanted(t *testing.T) {
+	cfg := TestingConfig(t)
+	pc := storage.NewMapPieceCompletion()
+	ci := storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir:   cfg.DataDir,
+		PieceCompletion: pc,
+		Preallocation:   storage.PreallocateSparse,
+	})
+	defer ci.Close()
+	info := metainfo.Info{
+		Name:        "t",
+		PieceLength: 4,
+		Pieces:      make([]byte, 3*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 4},
+			{Path: []string{"b"}, Length: 6},
+		},
+	}
+	ib, err := bencode.Marshal(info)
+	require.NoError(t, err)
+	// Known incomplete pieces aren't hashed on start, which would delay them becoming wanted.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, pc.Set(metainfo.PieceKey{InfoHash: metainfo.HashBytes(ib), Index: i}, false))
+	}
+	cfg.DefaultStorage = ci
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(&metainfo.MetaInfo{InfoBytes: ib})
+	require.NoError(t, err)
+	tt.Files()[1].Download()
+	tt.allocating.Wait()
+	fi, err := os.Stat(filepath.Join(cfg.DataDir, "t", "b"))
+	require.NoError(t, err)
+	assert.EqualValues(t, 6, fi.Size())
+	_, err = os.Stat(filepath.Join(cfg.DataDir, "t", "a"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRenameFile(t *testing.T) {
+	cfg := TestingConfig(t)
+	ci := storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir:   cfg.DataDir,
+		PieceCompletion: storage.NewMapPieceCompletion(),
+	})
+	defer ci.Close()
+	cfg.DefaultStorage = ci
+	info := metainfo.Info{
+		Name:        "t",
+		PieceLength: 4,
+		Pieces:      make([]byte, metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 2},
+			{Path: []string{"b"}, Length: 2},
+		},
+	}
+	ib, err := bencode.Marshal(info)
+	require.NoError(t, err)
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(&metainfo.MetaInfo{InfoBytes: ib})
+	require.NoError(t, err)
+	f := tt.Files()[1]
+	require.NoError(t, f.SetPath("t/c/d"))
+	assert.Equal(t, "t/c/d", f.Path())
+	assert.Equal(t, "c/d", f.DisplayPath())
+	abs := filepath.Join(t.TempDir(), "e")
+	require.NoError(t, f.SetPath(abs))
+	assert.Equal(t, abs, f.StoragePath())
+	assert.Equal(t, "t/c/d", f.Path())
+	assert.Error(t, tt.RenameFile(2, "e"))
+}
@@ -128,6 +128,9 @@ func (cl Client) Announce(ctx context.Context, ar AnnounceRequest, opt AnnounceO
 			Port: na.Port,
 		})
 	}
+	if l := len(trackerResponse.ExternalIp); l == net.IPv4len || l == net.IPv6len {
+		ret.ExternalIp = net.IP(trackerResponse.ExternalIp)
+	}
 	return
 }
 
@@ -136,4 +139,6 @@ type AnnounceResponse struct {
 	Leechers int32
 	Seeders  int32
 	Peers    []Peer
+	// Our IP as the tracker sees it, if it reported it (BEP 24).
+	ExternalIp net.IP
 }
@@ -44,6 +44,15 @@ func TestUnmarshalHttpResponseNoPeers(t *testing.T) {
 	assert.Len(t, hr.Peers6, 1)
 }
 
+func TestUnmarshalHttpResponseExternalIp(t *testing.T) {
+	var hr HttpResponse
+	require.NoError(t, bencode.Unmarshal(
+		[]byte("d11:external ip4:\x01\x02\x03\x045:peerslee"),
+		&hr,
+	))
+	assert.Equal(t, []byte{1, 2, 3, 4}, hr.ExternalIp)
+}
+
 func TestUnmarshalHttpResponsePeers6NotCompact(t *testing.T) {
 	var hr HttpResponse
 	require.Error(t, bencode.Unmarshal(
@@ -16,6 +16,8 @@ type HttpResponse struct {
 	Peers         Peers  `bencode:"peers"`
 	// BEP 7
 	Peers6 krpc.CompactIPv6NodeAddrs `bencode:"peers6"`
+	// BEP 24. Our IP as the tracker sees it, 4 or 16 bytes.
+	ExternalIp []byte `bencode:"external ip"`
 }
 
 type Peers []Peer
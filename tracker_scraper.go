@@ -82,7 +82,10 @@ func (me *trackerScraper) getIp() (ip net.IP, err error) {
 		return
 	}
 	for _, ip = range ips {
-		if me.t.cl.ipIsBlocked(ip) {
+		me.t.cl.rLock()
+		blocked := me.t.cl.ipIsBlocked(ip)
+		me.t.cl.rUnlock()
+		if blocked {
 			continue
 		}
 		switch me.u.Scheme {
@@ -141,6 +144,7 @@ func (me *trackerScraper) announce(ctx context.Context, event tracker.AnnounceEv
 	}
 	me.t.cl.rLock()
 	req := me.t.announceRequest(event)
+	clientIp4, clientIp6 := me.t.cl.announceIpsLocked()
 	me.t.cl.rUnlock()
 	// The default timeout works well as backpressure on concurrent access to the tracker. Since
 	// we're passing our own Context now, we will include that timeout ourselves to maintain similar
@@ -158,14 +162,17 @@ func (me *trackerScraper) announce(ctx context.Context, event tracker.AnnounceEv
 		HostHeader: me.u.Host,
 		ServerName: me.u.Hostname(),
 		UdpNetwork: me.u.Scheme,
-		ClientIp4:  krpc.NodeAddr{IP: me.t.cl.config.PublicIp4},
-		ClientIp6:  krpc.NodeAddr{IP: me.t.cl.config.PublicIp6},
+		ClientIp4:  krpc.NodeAddr{IP: clientIp4},
+		ClientIp6:  krpc.NodeAddr{IP: clientIp6},
 	}.Do()
 	me.t.logger.WithDefaultLevel(log.Debug).Printf("announce to %q returned %#v: %v", me.u.String(), res, err)
 	if err != nil {
 		ret.Err = fmt.Errorf("announcing: %w", err)
 		return
 	}
+	if res.ExternalIp != nil {
+		me.t.cl.addExternalIpVoteUnlocked(ExternalIpSourceTracker, me.u.String(), nil, res.ExternalIp)
+	}
 	me.t.AddPeers(peerInfos(nil).AppendFromTracker(res.Peers))
 	ret.NumPeers = len(res.Peers)
 	ret.Interval = time.Duration(res.Interval) * time.Second